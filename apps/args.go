@@ -0,0 +1,26 @@
+package apps
+
+import "github.com/narula/ddtxn"
+
+// An argument struct a client fills in for one query after another,
+// so making a query doesn't allocate.  Once something holds on to a
+// query past the next one, like a worker's stash or a retry queue,
+// the client calls Keep() and the next query gets a new struct.
+type ArgBuf[A any] struct {
+	a *A
+}
+
+// The struct for the next query.
+func (b *ArgBuf[A]) Get() *A {
+	if b.a == nil {
+		b.a = new(A)
+	}
+	return b.a
+}
+
+// t is being held on to; stop reusing its arguments.
+func (b *ArgBuf[A]) Keep(t ddtxn.Query) {
+	if a, ok := t.Args.(*A); ok && a == b.a {
+		b.a = nil
+	}
+}
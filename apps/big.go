@@ -39,15 +39,14 @@ func (b *Big) Populate(s *ddtxn.Store, ex *ddtxn.ETransaction) {
 }
 
 // Calls rand 4 times
-func (b *Big) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
+func (b *Big) MakeOne(w int, local_seed *uint32, args *ArgBuf[ddtxn.BigArgs], txn *ddtxn.Query) {
 	rnd := uint64(ddtxn.RandN(local_seed, uint32(b.ni)))
-	txn.U1 = rnd
-	txn.U2 = (rnd * 2) % b.ni
-	txn.U3 = (rnd * 3) % b.ni
-	txn.U4 = (rnd * 4) % b.ni
-	txn.U5 = (rnd * 5) % b.ni
-	txn.U6 = (rnd * 6) % b.ni
-	txn.U7 = (rnd) % uint64(b.np)
+	a := args.Get()
+	a.Product = rnd % uint64(b.np)
+	for i := range a.Bids {
+		a.Bids[i] = (rnd * uint64(i+1)) % b.ni
+	}
+	txn.Args = a
 	if *incr {
 		txn.TXN = ddtxn.BIG_INCR
 	} else {
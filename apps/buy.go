@@ -54,15 +54,28 @@ func (b *Buy) Populate(s *ddtxn.Store, ex *ddtxn.ETransaction) {
 	}
 	dlog.Printf("Created %v products; np: %v\n", b.nbidders, b.nproducts)
 	for i := 0; i < b.nbidders; i++ {
+		// Buy adds one to the user's purchase count
 		k := ddtxn.UserKey(uint64(i))
-		s.CreateKey(k, "x", ddtxn.WRITE)
+		s.CreateKey(k, int32(0), ddtxn.SUM)
 	}
 	dlog.Printf("Created %v bidders\n", b.nbidders)
 	dlog.Printf("Done with Populate")
 }
 
+// The argument structs one client goroutine reuses.
+type BuyClient struct {
+	buy  ArgBuf[ddtxn.BuyArgs]
+	read ArgBuf[ddtxn.TwoKeyArgs]
+}
+
+// t is being held on to; see ArgBuf.Keep().
+func (c *BuyClient) Keep(t ddtxn.Query) {
+	c.buy.Keep(t)
+	c.read.Keep(t)
+}
+
 // Calls rand 4 times
-func (b *Buy) MakeOne(w int, local_seed *uint32, sp uint32, txn *ddtxn.Query) {
+func (b *Buy) MakeOne(w int, local_seed *uint32, sp uint32, c *BuyClient, txn *ddtxn.Query) {
 	var bidder int
 	var product int
 	if *partition {
@@ -79,30 +92,32 @@ func (b *Buy) MakeOne(w int, local_seed *uint32, sp uint32, txn *ddtxn.Query) {
 		product = int(ddtxn.RandN(local_seed, uint32(b.nproducts)))
 	}
 	if x < b.read_rate {
-		if x > b.ncontended_rate {
-			// Contended read; use Zipfian distribution or np
-			txn.K1 = ddtxn.UserKey(uint64(bidder))
-			txn.K2 = ddtxn.ProductKey(product)
-		} else {
+		if x <= b.ncontended_rate {
 			// (Hopefully) uncontended read.  Random product.
 			product = int(ddtxn.RandN(local_seed, uint32(b.nbidders)))
-			txn.K1 = ddtxn.UserKey(uint64(bidder))
-			txn.K2 = ddtxn.ProductKey(product)
 		}
+		// Otherwise a contended read; use Zipfian distribution or np
+		a := c.read.Get()
+		a.K1 = ddtxn.UserKey(uint64(bidder))
+		a.K2 = ddtxn.ProductKey(product)
+		txn.Args = a
 		txn.TXN = ddtxn.D_READ_TWO
 	} else {
 		amt := int32(ddtxn.RandN(local_seed, 10))
-		txn.K1 = ddtxn.UserKey(uint64(bidder))
-		txn.K2 = ddtxn.ProductKey(product)
-		txn.A = amt
+		a := c.buy.Get()
+		a.User = ddtxn.UserKey(uint64(bidder))
+		a.Product = ddtxn.ProductKey(product)
+		a.Amount = amt
+		txn.Args = a
 		txn.TXN = ddtxn.D_BUY
 	}
 }
 
 func (b *Buy) Add(t ddtxn.Query) {
 	if t.TXN == ddtxn.D_BUY {
-		x, _ := ddtxn.UndoCKey(t.K2)
-		atomic.AddInt32(&b.validate[x], t.A)
+		a := t.Args.(*ddtxn.BuyArgs)
+		x, _ := ddtxn.UndoCKey(a.Product)
+		atomic.AddInt32(&b.validate[x], a.Amount)
 	}
 }
 
@@ -120,7 +135,7 @@ func (b *Buy) Validate(s *ddtxn.Store, nitr int) bool {
 			}
 			continue
 		}
-		x = v.Value().(int32)
+		x = v.Int32()
 		if x != b.validate[j] {
 			fmt.Printf("Validating key %v failed; store: %v should have: %v\n", k, x, b.validate[j])
 			good = false
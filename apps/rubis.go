@@ -64,9 +64,8 @@ func (b *Rubis) Populate(s *ddtxn.Store, c *ddtxn.Coordinator) {
 		w := c.Workers[wi]
 		ex := w.E
 		for i := b.sp * uint32(wi); i < b.sp*(uint32(wi+1)); i++ {
-			q := ddtxn.Query{
-				U1: uint64(rand.Intn(ddtxn.NUM_REGIONS)),
-				U2: 0,
+			q := &ddtxn.RegisterUserArgs{
+				Region: uint64(rand.Intn(ddtxn.NUM_REGIONS)),
 			}
 			r, err := ddtxn.RegisterUserTxn(q, ex)
 			if err != nil {
@@ -90,21 +89,21 @@ func (b *Rubis) Populate(s *ddtxn.Store, c *ddtxn.Coordinator) {
 		ex := w.E
 		nx := rand.Intn(b.nbidders)
 		for i := chunk * wi; i < chunk*(wi+1); i++ {
-			q := ddtxn.Query{
-				T:  ddtxn.TID(i + 1),
-				S1: "xxx",
-				S2: "lovely",
-				U1: b.users[nx],
-				U2: 100,
-				U3: 100,
-				U4: 1000,
-				U5: 1000,
-				U6: 1,
-				U7: uint64(rand.Intn(ddtxn.NUM_CATEGORIES)),
+			q := &ddtxn.NewItemArgs{
+				ID:     uint64(i + 1),
+				Name:   "xxx",
+				Desc:   "lovely",
+				Seller: b.users[nx],
+				Sprice: 100,
+				Rprice: 100,
+				Buynow: 1000,
+				Dur:    1000,
+				Qty:    1,
+				Categ:  uint64(rand.Intn(ddtxn.NUM_CATEGORIES)),
 			}
 			r, err := ddtxn.NewItemTxn(q, ex)
 			if err != nil {
-				fmt.Printf("%v Could not create item index %v error: %v user_id: %v user index: %v nb: %v\n", wi, i, err, q.U1, nx, b.nbidders)
+				fmt.Printf("%v Could not create item index %v error: %v user_id: %v user index: %v nb: %v\n", wi, i, err, q.Seller, nx, b.nbidders)
 				continue
 			}
 			v := r.V.(uint64)
@@ -128,9 +127,8 @@ func (b *Rubis) PopulateBids(s *ddtxn.Store, c *ddtxn.Coordinator) {
 	b.nbidders = 1
 	b.users = make([]uint64, 1)
 	ex := c.Workers[0].E
-	q := ddtxn.Query{
-		U1: uint64(rand.Intn(ddtxn.NUM_REGIONS)),
-		U2: 0,
+	q := &ddtxn.RegisterUserArgs{
+		Region: uint64(rand.Intn(ddtxn.NUM_REGIONS)),
 	}
 	r, err := ddtxn.RegisterUserTxn(q, ex)
 	if err != nil {
@@ -147,21 +145,21 @@ func (b *Rubis) PopulateBids(s *ddtxn.Store, c *ddtxn.Coordinator) {
 		ex := w.E
 		nx := rand.Intn(b.nbidders)
 		for i := chunk * wi; i < chunk*(wi+1); i++ {
-			q := ddtxn.Query{
-				T:  ddtxn.TID(i + 1),
-				S1: "xxx",
-				S2: "lovely",
-				U1: b.users[nx],
-				U2: 100,
-				U3: 100,
-				U4: 1000,
-				U5: 1000,
-				U6: 1,
-				U7: uint64(rand.Intn(ddtxn.NUM_CATEGORIES)),
+			q := &ddtxn.NewItemArgs{
+				ID:     uint64(i + 1),
+				Name:   "xxx",
+				Desc:   "lovely",
+				Seller: b.users[nx],
+				Sprice: 100,
+				Rprice: 100,
+				Buynow: 1000,
+				Dur:    1000,
+				Qty:    1,
+				Categ:  uint64(rand.Intn(ddtxn.NUM_CATEGORIES)),
 			}
 			r, err := ddtxn.NewItemTxn(q, ex)
 			if err != nil {
-				fmt.Printf("%v Could not create item index %v error: %v user_id: %v user index: %v nb: %v\n", wi, i, err, q.U1, nx, b.nbidders)
+				fmt.Printf("%v Could not create item index %v error: %v user_id: %v user index: %v nb: %v\n", wi, i, err, q.Seller, nx, b.nbidders)
 				continue
 			}
 			v := r.V.(uint64)
@@ -193,12 +191,14 @@ func (b *Rubis) MakeBid(w int, local_seed *uint32, txn *ddtxn.Query) {
 		log.Fatalf("Huh %v %v %v\n", x, len(b.products), b.nproducts)
 	}
 	product := b.products[x]
-	txn.U1 = uint64(bidder)
 	if product == 0 {
 		log.Fatalf("store bid ID 0? %v %v", x, b.products[x])
 	}
-	txn.U2 = uint64(product)
-	txn.U3 = uint64(time.Now().UnixNano())
+	txn.Args = &ddtxn.BidArgs{
+		Bidder: uint64(bidder),
+		Item:   uint64(product),
+		Price:  int32(time.Now().UnixNano()),
+	}
 }
 
 func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
@@ -215,13 +215,15 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 			x = ddtxn.RandN(local_seed, uint32(b.nproducts))
 		}
 		product := b.products[x]
-		txn.U1 = uint64(bidder)
 		if product == 0 {
 			log.Fatalf("store bid ID 0? %v %v", x, b.products[x])
 		}
-		txn.U2 = uint64(product)
-		//txn.U3 = uint64(ddtxn.RandN(local_seed, 10))
-		txn.U3 = uint64(time.Now().UnixNano()) & 0x000efff
+		txn.Args = &ddtxn.BidArgs{
+			Bidder: uint64(bidder),
+			Item:   uint64(product),
+			//Price: int32(ddtxn.RandN(local_seed, 10)),
+			Price: int32(time.Now().UnixNano() & 0x000efff),
+		}
 	} else if x < b.rates[1] {
 		txn.TXN = ddtxn.RUBIS_VIEWBIDHIST
 		x := ddtxn.RandN(local_seed, uint32(b.nproducts))
@@ -229,7 +231,7 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		if product == 0 {
 			log.Fatalf("view bid hist ID 0? %v %v", x, b.products[x])
 		}
-		txn.U1 = uint64(product)
+		txn.Args = &ddtxn.ItemArgs{Item: uint64(product)}
 	} else if x < b.rates[2] {
 		txn.TXN = ddtxn.RUBIS_BUYNOW
 		//bidder := b.users[int(ddtxn.RandN(local_seed, b.sp))+w*int(b.sp)]
@@ -239,9 +241,10 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		if product == 0 {
 			log.Fatalf("buy now ID 0? %v %v", x, b.products[x])
 		}
-		txn.U1 = uint64(bidder)
-		txn.U2 = uint64(product)
-		txn.A = int32(ddtxn.RandN(local_seed, 10))
+		txn.Args = &ddtxn.BuyNowArgs{
+			User: uint64(bidder),
+			Item: uint64(product),
+		}
 	} else if x < b.rates[3] {
 		txn.TXN = ddtxn.RUBIS_COMMENT
 		//		u1 := b.users[int(ddtxn.RandN(local_seed, b.sp))+w*int(b.sp)]
@@ -253,25 +256,29 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		if product == 0 {
 			log.Fatalf("comment ID 0? %v %v", x, b.products[x])
 		}
-		txn.U1 = uint64(u1)
-		txn.U2 = uint64(u2)
-		txn.U3 = uint64(product)
-		txn.S1 = "xxxx"
-		txn.U4 = 1
+		txn.Args = &ddtxn.CommentArgs{
+			To:      uint64(u1),
+			From:    uint64(u2),
+			Item:    uint64(product),
+			Comment: "xxxx",
+			Rating:  1,
+		}
 	} else if x < b.rates[4] {
 		txn.TXN = ddtxn.RUBIS_NEWITEM
 		//		bidder := b.users[int(ddtxn.RandN(local_seed, b.sp))+w*int(b.sp)]
 		bidder := b.users[int(ddtxn.RandN(local_seed, uint32(b.nbidders)))]
 		amt := uint64(ddtxn.RandN(local_seed, 10))
-		txn.U1 = uint64(bidder)
-		txn.S1 = "yyyy"
-		txn.S2 = "zzzz"
-		txn.U2 = amt
-		txn.U3 = amt
-		txn.U4 = amt
-		txn.U5 = 1
-		txn.U6 = 1
-		txn.U7 = uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES)))
+		txn.Args = &ddtxn.NewItemArgs{
+			Seller: uint64(bidder),
+			Name:   "yyyy",
+			Desc:   "zzzz",
+			Sprice: amt,
+			Rprice: amt,
+			Buynow: amt,
+			Dur:    1,
+			Qty:    1,
+			Categ:  uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES))),
+		}
 	} else if x < b.rates[5] {
 		txn.TXN = ddtxn.RUBIS_PUTBID
 		x := ddtxn.RandN(local_seed, uint32(b.nproducts))
@@ -279,7 +286,7 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		if product == 0 {
 			log.Fatalf("put bid ID 0? %v %v", x, b.products[x])
 		}
-		txn.U1 = uint64(product)
+		txn.Args = &ddtxn.ItemArgs{Item: uint64(product)}
 	} else if x < b.rates[6] {
 		txn.TXN = ddtxn.RUBIS_PUTCOMMENT
 		x := ddtxn.RandN(local_seed, uint32(b.nproducts))
@@ -289,21 +296,29 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		}
 		//		bidder := b.users[int(ddtxn.RandN(local_seed, b.sp))+w*int(b.sp)]
 		bidder := b.users[int(ddtxn.RandN(local_seed, uint32(b.nbidders)))]
-		txn.U1 = uint64(bidder)
-		txn.U2 = uint64(product)
+		txn.Args = &ddtxn.PutCommentArgs{
+			To:   uint64(bidder),
+			Item: uint64(product),
+		}
 	} else if x < b.rates[7] {
 		txn.TXN = ddtxn.RUBIS_REGISTER
-		txn.U1 = uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_REGIONS)))
-		txn.U2 = uint64(ddtxn.RandN(local_seed, 1000000000))
+		txn.Args = &ddtxn.RegisterUserArgs{
+			Region:   uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_REGIONS))),
+			Nickname: uint64(ddtxn.RandN(local_seed, 1000000000)),
+		}
 	} else if x < b.rates[8] {
 		txn.TXN = ddtxn.RUBIS_SEARCHCAT
-		txn.U1 = uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES)))
-		txn.U2 = 5
+		txn.Args = &ddtxn.SearchArgs{
+			Categ: uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES))),
+			Num:   5,
+		}
 	} else if x < b.rates[9] {
 		txn.TXN = ddtxn.RUBIS_SEARCHREG
-		txn.U1 = uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_REGIONS)))
-		txn.U2 = uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES)))
-		txn.U3 = 5
+		txn.Args = &ddtxn.SearchArgs{
+			Region: uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_REGIONS))),
+			Categ:  uint64(ddtxn.RandN(local_seed, uint32(ddtxn.NUM_CATEGORIES))),
+			Num:    5,
+		}
 	} else if x < b.rates[10] {
 		txn.TXN = ddtxn.RUBIS_VIEW
 		x := ddtxn.RandN(local_seed, uint32(b.nproducts))
@@ -311,12 +326,12 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 		if product == 0 {
 			log.Fatalf("view ID 0? %v %v", x, b.products[x])
 		}
-		txn.U1 = uint64(product)
+		txn.Args = &ddtxn.ItemArgs{Item: uint64(product)}
 	} else if x < b.rates[11] {
 		txn.TXN = ddtxn.RUBIS_VIEWUSER
 		//		bidder := b.users[int(ddtxn.RandN(local_seed, b.sp))+w*int(b.sp)]
 		bidder := b.users[int(ddtxn.RandN(local_seed, uint32(b.nbidders)))]
-		txn.U1 = uint64(bidder)
+		txn.Args = &ddtxn.UserArgs{User: uint64(bidder)}
 	} else {
 		log.Fatalf("No such transaction\n")
 	}
@@ -324,18 +339,19 @@ func (b *Rubis) MakeOne(w int, local_seed *uint32, txn *ddtxn.Query) {
 
 func (b *Rubis) Add(t ddtxn.Query) {
 	if t.TXN == ddtxn.RUBIS_BID {
-		x := b.pidIdx[t.U2]
+		a := t.Args.(*ddtxn.BidArgs)
+		x := b.pidIdx[a.Item]
 		atomic.AddInt32(&b.num_bids[x], 1)
-		for int32(t.U3) > b.maxes[x] {
+		for a.Price > b.maxes[x] {
 			v := atomic.LoadInt32(&b.maxes[x])
-			done := atomic.CompareAndSwapInt32(&b.maxes[x], v, int32(t.U3))
+			done := atomic.CompareAndSwapInt32(&b.maxes[x], v, a.Price)
 			if done {
 				break
 			}
 		}
 	} else if t.TXN == ddtxn.RUBIS_COMMENT {
 		b.Lock()
-		b.ratings[t.U1] += 1
+		b.ratings[t.Args.(*ddtxn.CommentArgs).To] += 1
 		b.Unlock()
 	}
 }
@@ -351,7 +367,7 @@ func (b *Rubis) Validate(s *ddtxn.Store, nitr int) bool {
 			good = false
 			continue
 		}
-		r := v.Value().(int32)
+		r := v.Int32()
 		if r != rat {
 			fmt.Printf("Validating key %v failed; store: has different rating for user %v (%v vs. %v): %v\n", key, k, rat, r, err)
 			good = false
@@ -370,7 +386,7 @@ func (b *Rubis) Validate(s *ddtxn.Store, nitr int) bool {
 			}
 			continue
 		}
-		x = v.Value().(int32)
+		x = v.Int32()
 		if x != b.maxes[i] {
 			fmt.Printf("Validating key %v failed; store: %v should have: %v\n", k, x, b.maxes[i])
 			good = false
@@ -388,7 +404,7 @@ func (b *Rubis) Validate(s *ddtxn.Store, nitr int) bool {
 			}
 			continue
 		}
-		x = v.Value().(int32)
+		x = v.Int32()
 		if x != b.num_bids[i] {
 			fmt.Printf("Validating key %v failed for number of bids; store: %v should have: %v\n", k, x, b.num_bids[i])
 			good = false
@@ -2,7 +2,8 @@ package ddtxn
 
 import (
 	"fmt"
-	"log"
+	"hash/fnv"
+	"strconv"
 	"time"
 
 	"github.com/narula/ddtxn/dlog"
@@ -40,6 +41,7 @@ type Item struct {
 	Buynow    uint64
 	Dur       uint64
 	Categ     uint64
+	Region    uint64 // the seller's
 }
 
 type Bid struct {
@@ -66,43 +68,150 @@ type Comment struct {
 	Comment string
 }
 
-func RegisterUserTxn(t Query, tx ETransaction) (*Result, error) {
-	region := t.U1
-	nickname := t.U2
+// Transaction arguments.
+type RegisterUserArgs struct {
+	Region   uint64
+	Nickname uint64 // 0 to pick one
+}
+
+type NewItemArgs struct {
+	ID      uint64 // 0 to pick one
+	Seller  uint64
+	Name    string
+	Desc    string
+	Sprice  uint64
+	Rprice  uint64
+	Buynow  uint64
+	Dur     uint64
+	Qty     uint64
+	Categ   uint64
+	Enddate int
+}
+
+type BidArgs struct {
+	Bidder uint64
+	Item   uint64
+	Price  int32
+}
+
+type CommentArgs struct {
+	To      uint64
+	From    uint64
+	Item    uint64
+	Comment string
+	Rating  uint64
+}
+
+type BuyNowArgs struct {
+	User uint64
+	Item uint64
+	Qty  uint64
+}
+
+type PutCommentArgs struct {
+	To   uint64
+	Item uint64
+}
+
+type SearchArgs struct {
+	Region uint64 // only for SearchItemsRegionTxn
+	Categ  uint64
+	Num    uint64
+}
+
+type ItemArgs struct {
+	Item uint64
+}
+
+type UserArgs struct {
+	User uint64
+}
+
+func init() {
+	RegisterValue(TAG_USER, &User{})
+	RegisterValue(TAG_ITEM, &Item{})
+	RegisterValue(TAG_BID, &Bid{})
+	RegisterValue(TAG_BUYNOW, &BuyNow{})
+	RegisterValue(TAG_COMMENT, &Comment{})
+	RegisterValue(TAG_REGISTER_USER_ARGS, &RegisterUserArgs{})
+	RegisterValue(TAG_NEW_ITEM_ARGS, &NewItemArgs{})
+	RegisterValue(TAG_BID_ARGS, &BidArgs{})
+	RegisterValue(TAG_COMMENT_ARGS, &CommentArgs{})
+	RegisterValue(TAG_BUYNOW_ARGS, &BuyNowArgs{})
+	RegisterValue(TAG_PUT_COMMENT_ARGS, &PutCommentArgs{})
+	RegisterValue(TAG_SEARCH_ARGS, &SearchArgs{})
+	RegisterValue(TAG_ITEM_ARGS, &ItemArgs{})
+	RegisterValue(TAG_USER_ARGS, &UserArgs{})
+	RegisterIndex(&Index{
+		Name:    "nickname",
+		Example: &User{},
+		Unique:  true,
+		Entry:   nicknameEntry,
+		Same: func(a, b Value) bool {
+			return a.(*User).Nickname == b.(*User).Nickname
+		},
+	})
+	// Searches read the newest items in each list
+	RegisterIndex(&Index{
+		Name:    "items_by_categ",
+		Example: &Item{},
+		List: func(k Key, v Value) (Key, Entry, bool) {
+			x := v.(*Item)
+			return ItemsByCatKey(x.Categ), itemEntry(x), true
+		},
+	})
+	RegisterIndex(&Index{
+		Name:    "items_by_region",
+		Example: &Item{},
+		List: func(k Key, v Value) (Key, Entry, bool) {
+			x := v.(*Item)
+			return ItemsByRegKey(x.Region, x.Categ), itemEntry(x), true
+		},
+	})
+}
+
+func itemEntry(x *Item) Entry {
+	return Entry{order: x.Startdate, top: int(x.ID), key: ItemKey(x.ID)}
+}
+
+// Users are found by nickname at NicknameKey() of its hash, or past
+// it if another nickname has the same hash.  Preallocated users have
+// none.
+func nicknameEntry(k Key, v Value) (Key, bool) {
+	nn := v.(*User).Nickname
+	if nn == "" {
+		return Key{}, false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(nn))
+	return NicknameKey(h.Sum64()), true
+}
+
+func RegisterUserTxn(t *RegisterUserArgs, tx ETransaction) (*Result, error) {
+	region := t.Region
+	nickname := t.Nickname
 	var r *Result = nil
 
 	var n uint64
-	var nick Key
 
 	if !*Allocate || nickname == 0 {
 		n = tx.UID('u')
-		nick = NicknameKey(tx.UID('d'))
+		nickname = tx.UID('d')
 	} else {
 		n = nickname
-		nick = NicknameKey(n)
 	}
 	u := UserKey(n)
 	user := &User{
 		ID:       n,
 		Name:     "xxxxxxx",
-		Nickname: string(nickname),
+		Nickname: strconv.FormatUint(nickname, 10),
 		Region:   region,
 	}
-	tx.MaybeWrite(nick)
-	br, err := tx.Read(nick)
-	var val uint64 = 0
-	if br != nil && br.exists {
-		val = br.Value().(uint64)
-	}
-
-	if err != ENOKEY && val != 0 {
-		// Someone else is using this nickname
-		dlog.Printf("Nickname taken %v %v\n", nickname, nick)
+	// The nickname index returns EUNIQUE if someone else is using it
+	if err := tx.Write(u, user, WRITE); err != nil {
 		tx.Abort()
-		return nil, ENORETRY
+		return nil, err
 	}
-	tx.Write(u, user, WRITE)
-	tx.Write(nick, nickname, WRITE)
 
 	if tx.Commit() == 0 {
 		dlog.Printf("RegisterUser() Abort\n")
@@ -115,61 +224,53 @@ func RegisterUserTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func NewItemTxn(t Query, tx ETransaction) (*Result, error) {
+func NewItemTxn(t *NewItemArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
 	now := time.Now().Second()
 	var n uint64
-	if t.T != 0 {
-		n = uint64(t.T)
+	if t.ID != 0 {
+		n = t.ID
 	} else {
 		n = tx.UID('i')
 	}
 	item := ItemKey(n)
 	x := &Item{
 		ID:        n,
-		Name:      t.S1,
-		Seller:    t.U1,
-		Desc:      t.S2,
-		Sprice:    t.U2,
-		Rprice:    t.U3,
-		Buynow:    t.U4,
-		Dur:       t.U5,
-		Qty:       t.U6,
+		Name:      t.Name,
+		Seller:    t.Seller,
+		Desc:      t.Desc,
+		Sprice:    t.Sprice,
+		Rprice:    t.Rprice,
+		Buynow:    t.Buynow,
+		Dur:       t.Dur,
+		Qty:       t.Qty,
 		Startdate: now,
-		Enddate:   t.I,
-		Categ:     t.U7,
+		Enddate:   t.Enddate,
+		Categ:     t.Categ,
 	}
-	urec, err := tx.Read(UserKey(t.U1))
+	urec, err := tx.Read(UserKey(t.Seller))
 	if err != nil {
 		if err == ESTASH {
-			dlog.Printf("User stashed %v\n", UserKey(t.U1))
+			dlog.Printf("User stashed %v\n", UserKey(t.Seller))
 			return nil, ESTASH
 		} else if err == EABORT {
 			return nil, EABORT
 		} else if err == ENOKEY {
-			fmt.Printf("NewItemTxn(): User doesn't exist %v\n", t.U1)
+			fmt.Printf("NewItemTxn(): User doesn't exist %v\n", t.Seller)
 			if tx.Commit() == 0 {
 				return nil, EABORT
 			} else {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
-	region := urec.value.(*User).Region
-	val := Entry{order: now, top: int(n), key: ItemKey(n)}
-	tx.Write(item, x, WRITE)
-	err = tx.WriteList(ItemsByCatKey(x.Categ), val, LIST)
-	if err != nil {
-		tx.Abort()
-		dlog.Printf("NewItemTxn(): Error putting item in cat list %v! %v %v\n", n, x.Categ, err)
-		return nil, err
-	}
-	err = tx.WriteList(ItemsByRegKey(region, x.Categ), val, LIST)
+	x.Region = urec.value.(*User).Region
+	err = tx.Write(item, x, WRITE)
 	if err != nil {
 		tx.Abort()
-		dlog.Printf("NewItemTxn(): Error putting item in reg list %v! %v %v\n", n, region, err)
+		dlog.Printf("NewItemTxn(): Error writing item %v! %v\n", n, err)
 		return nil, err
 	}
 	err = tx.WriteInt32(NumBidsKey(n), int32(0), SUM)
@@ -202,14 +303,14 @@ func NewItemTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-// TODO: Check and see if I need more tx.MaybeWrite()s
-func StoreBidTxn(t Query, tx ETransaction) (*Result, error) {
+func StoreBidTxn(t *BidArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
-	user := t.U1
-	item := t.U2
-	price := int32(t.U3)
+	user := t.Bidder
+	item := t.Item
+	price := t.Price
 	if price < 0 {
-		log.Fatalf("price %v %v", price, t.U3)
+		dlog.Printf("StoreBidTxn(): Negative price %v\n", price)
+		return nil, ENORETRY
 	}
 	// insert bid
 	n := tx.UID('b')
@@ -220,10 +321,16 @@ func StoreBidTxn(t Query, tx ETransaction) (*Result, error) {
 		Bidder: user,
 		Price:  price,
 	}
-	tx.Write(bid_key, bid, WRITE)
+	err := tx.Write(bid_key, bid, WRITE)
+	if err != nil {
+		tx.RelinquishKey(n, 'b')
+		tx.Abort()
+		dlog.Printf("StoreBidTxn(): Couldn't write bid for item %v; %v\n", item, err)
+		return nil, err
+	}
 
 	// update # bids per item
-	err := tx.WriteInt32(NumBidsKey(item), 1, SUM)
+	err = tx.WriteInt32(NumBidsKey(item), 1, SUM)
 	if err != nil {
 		tx.RelinquishKey(n, 'b')
 		tx.Abort()
@@ -233,8 +340,10 @@ func StoreBidTxn(t Query, tx ETransaction) (*Result, error) {
 
 	// update max bid?
 	high := MaxBidKey(item)
-	tx.MaybeWrite(high)
-	err = tx.WriteInt32(high, price, MAX)
+	err = tx.MaybeWrite(high)
+	if err == nil {
+		err = tx.WriteInt32(high, price, MAX)
+	}
 	if err != nil {
 		tx.RelinquishKey(n, 'b')
 		dlog.Println("Aborting because of max")
@@ -273,12 +382,12 @@ func StoreBidTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func StoreCommentTxn(t Query, tx ETransaction) (*Result, error) {
-	touser := t.U1
-	fromuser := t.U2
-	item := t.U3
-	comment_s := t.S1
-	rating := t.U4
+func StoreCommentTxn(t *CommentArgs, tx ETransaction) (*Result, error) {
+	touser := t.To
+	fromuser := t.From
+	item := t.Item
+	comment_s := t.Comment
+	rating := t.Rating
 
 	n := tx.UID('c')
 	com := CommentKey(n)
@@ -291,10 +400,14 @@ func StoreCommentTxn(t Query, tx ETransaction) (*Result, error) {
 		Item:    item,
 		Date:    11,
 	}
-	tx.Write(com, comment, WRITE)
+	err := tx.Write(com, comment, WRITE)
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
 
 	rkey := RatingKey(touser)
-	err := tx.WriteInt32(rkey, int32(rating), SUM)
+	err = tx.WriteInt32(rkey, int32(rating), SUM)
 	if err != nil {
 		dlog.Printf("Comment abort %v\n", t)
 		tx.Abort()
@@ -313,39 +426,42 @@ func StoreCommentTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func StoreBuyNowTxn(t Query, tx ETransaction) (*Result, error) {
+func StoreBuyNowTxn(t *BuyNowArgs, tx ETransaction) (*Result, error) {
 	now := 1
-	user := t.U1
-	item := t.U2
-	qty := t.U3
+	user := t.User
+	item := t.Item
+	qty := t.Qty
 	bnrec := &BuyNow{
 		BuyerID: user,
 		ItemID:  item,
 		Qty:     qty,
 		Date:    now,
 	}
-	uk := UserKey(t.U1)
+	uk := UserKey(user)
 	br, err := tx.Read(uk)
 	if err != nil {
 		if err == ESTASH {
-			dlog.Printf("User  %v stashed\n", t.U1)
+			dlog.Printf("User  %v stashed\n", user)
 			return nil, ESTASH
 		} else if err == EABORT {
 			return nil, EABORT
 		} else if err == ENOKEY {
-			dlog.Printf("StoreBuyNowTxn(): No user? %v\n", t.U1)
+			dlog.Printf("StoreBuyNowTxn(): No user? %v\n", user)
 			if tx.Commit() == 0 {
 				return nil, EABORT
 			} else {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
 	_ = br.Value().(*User)
 	ik := ItemKey(item)
-	tx.MaybeWrite(ik)
+	if err := tx.MaybeWrite(ik); err != nil {
+		tx.Abort()
+		return nil, err
+	}
 	irec, err := tx.Read(ik)
 	if err != nil {
 		if err == ESTASH {
@@ -361,10 +477,13 @@ func StoreBuyNowTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
-	itemv := irec.Value().(*Item)
+	// Other transactions and checkpoints share the stored *Item;
+	// change a copy.
+	itemv := new(Item)
+	*itemv = *irec.Value().(*Item)
 	maxqty := itemv.Qty
 	newq := maxqty - qty
 
@@ -374,7 +493,10 @@ func StoreBuyNowTxn(t Query, tx ETransaction) (*Result, error) {
 		return nil, ENORETRY
 	}
 	bnk := BuyNowKey(tx.UID('k'))
-	tx.Write(bnk, bnrec, WRITE)
+	if err := tx.Write(bnk, bnrec, WRITE); err != nil {
+		tx.Abort()
+		return nil, err
+	}
 
 	if newq == 0 {
 		itemv.Enddate = now
@@ -383,7 +505,10 @@ func StoreBuyNowTxn(t Query, tx ETransaction) (*Result, error) {
 		itemv.Qty = newq
 	}
 
-	tx.Write(ik, itemv, WRITE)
+	if err := tx.Write(ik, itemv, WRITE); err != nil {
+		tx.Abort()
+		return nil, err
+	}
 	if tx.Commit() == 0 {
 		return nil, EABORT
 	}
@@ -395,8 +520,8 @@ func StoreBuyNowTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
-	item := t.U1
+func ViewBidHistoryTxn(t *ItemArgs, tx ETransaction) (*Result, error) {
+	item := t.Item
 	ik := ItemKey(item)
 	br, err := tx.Read(ik)
 	if err != nil {
@@ -413,7 +538,7 @@ func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("view bid err %v\n", err)
+			return nil, err
 		}
 	}
 
@@ -434,7 +559,7 @@ func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, nil
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	listy := brec.entries
@@ -463,7 +588,7 @@ func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
 					return nil, ENORETRY
 				}
 			} else {
-				log.Fatalf("err %v\n", err)
+				return nil, err
 			}
 		}
 		bid := b.Value().(*Bid)
@@ -486,7 +611,7 @@ func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
 					return nil, ENORETRY
 				}
 			} else {
-				log.Fatalf("err %v\n", err)
+				return nil, err
 			}
 		}
 		if *Allocate {
@@ -508,24 +633,24 @@ func ViewBidHistoryTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func ViewUserInfoTxn(t Query, tx ETransaction) (*Result, error) {
-	uk := UserKey(t.U1)
+func ViewUserInfoTxn(t *UserArgs, tx ETransaction) (*Result, error) {
+	uk := UserKey(t.User)
 	urec, err := tx.Read(uk)
 	if err != nil {
 		if err == ESTASH {
-			dlog.Printf("User  %v stashed\n", t.U1)
+			dlog.Printf("User  %v stashed\n", t.User)
 			return nil, ESTASH
 		} else if err == EABORT {
 			return nil, EABORT
 		} else if err == ENOKEY {
-			dlog.Printf("No user? %v\n", t.U1)
+			dlog.Printf("No user? %v\n", t.User)
 			if tx.Commit() == 0 {
 				return nil, EABORT
 			} else {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("view user err: %v\n", err)
+			return nil, err
 		}
 	}
 	_ = urec.Value().(*User)
@@ -539,8 +664,8 @@ func ViewUserInfoTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
-	item := t.U1
+func PutBidTxn(t *ItemArgs, tx ETransaction) (*Result, error) {
+	item := t.Item
 
 	ik := ItemKey(item)
 	irec, err := tx.Read(ik)
@@ -558,7 +683,7 @@ func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	tok := UserKey(irec.Value().(*Item).Seller)
@@ -577,7 +702,7 @@ func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	nickname := torec.Value().(*User).Nickname
@@ -598,7 +723,7 @@ func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	nb := numbrec.int_value
@@ -619,7 +744,7 @@ func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	maxb := maxbrec.int_value
@@ -640,10 +765,10 @@ func PutBidTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func PutCommentTxn(t Query, tx ETransaction) (*Result, error) {
+func PutCommentTxn(t *PutCommentArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
-	touser := t.U1
-	item := t.U2
+	touser := t.To
+	item := t.Item
 	tok := UserKey(touser)
 	torec, err := tx.Read(tok)
 	if err != nil {
@@ -660,7 +785,7 @@ func PutCommentTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	nickname := torec.Value().(*User).Nickname
@@ -680,7 +805,7 @@ func PutCommentTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	itemname := irec.Value().(*Item).Name
@@ -698,12 +823,13 @@ func PutCommentTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func SearchItemsCategTxn(t Query, tx ETransaction) (*Result, error) {
-	categ := t.U1
-	num := t.U2
+func SearchItemsCategTxn(t *SearchArgs, tx ETransaction) (*Result, error) {
+	categ := t.Categ
+	num := t.Num
 	var r *Result = nil
 	if num > 10 {
-		log.Fatalf("Only 10 search items are currently supported.\n")
+		dlog.Printf("Only 10 search items are currently supported.\n")
+		return nil, ENORETRY
 	}
 	ibck := ItemsByCatKey(categ)
 	ibcrec, err := tx.Read(ibck)
@@ -722,7 +848,7 @@ func SearchItemsCategTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err %v\n", err)
+			return nil, err
 		}
 	}
 	listy := ibcrec.entries
@@ -812,13 +938,14 @@ func SearchItemsCategTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
-	region := t.U1
-	categ := t.U2
-	num := t.U3
+func SearchItemsRegionTxn(t *SearchArgs, tx ETransaction) (*Result, error) {
+	region := t.Region
+	categ := t.Categ
+	num := t.Num
 	var r *Result = nil
 	if num > 10 {
-		log.Fatalf("Only 10 search items are currently supported.\n")
+		dlog.Printf("Only 10 search items are currently supported.\n")
+		return nil, ENORETRY
 	}
 	ibrk := ItemsByRegKey(region, categ)
 	ibrrec, err := tx.Read(ibrk)
@@ -836,7 +963,7 @@ func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
 
@@ -872,7 +999,7 @@ func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
 				dlog.Printf("Item in list doesn't exist %v; %v\n", k, listy[i])
 				continue
 			} else {
-				log.Fatalf("err: %v\n", err)
+				return nil, err
 			}
 		} else {
 			val2 := br.Value().(*Item)
@@ -890,7 +1017,7 @@ func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
 			} else if err == ENOKEY {
 				dlog.Printf("No number of bids key %v\n", k)
 			} else {
-				log.Fatalf("err: %v\n", err)
+				return nil, err
 			}
 		} else {
 			val4 := br.int_value
@@ -908,7 +1035,7 @@ func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
 			} else if err == ENOKEY {
 				dlog.Printf("No max bid key %v\n", k)
 			} else {
-				log.Fatalf("err: %v\n", err)
+				return nil, err
 			}
 		} else {
 			val3 := br.int_value
@@ -934,9 +1061,9 @@ func SearchItemsRegionTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func ViewItemTxn(t Query, tx ETransaction) (*Result, error) {
+func ViewItemTxn(t *ItemArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
-	id := t.U1
+	id := t.Item
 	item, err := tx.Read(ItemKey(id))
 	if err != nil {
 		if err == ESTASH {
@@ -950,7 +1077,7 @@ func ViewItemTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
 	val := item.Value().(*Item)
@@ -968,7 +1095,7 @@ func ViewItemTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
 	val2 := maxbid.int_value
@@ -987,7 +1114,7 @@ func ViewItemTxn(t Query, tx ETransaction) (*Result, error) {
 				return nil, ENORETRY
 			}
 		} else {
-			log.Fatalf("err: %v\n", err)
+			return nil, err
 		}
 	}
 	xx := maxbidder.Value().(Overwrite)
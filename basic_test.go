@@ -1,8 +1,14 @@
 package ddtxn
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/narula/ddtxn/dlog"
 )
@@ -10,18 +16,21 @@ import (
 func TestBasic(t *testing.T) {
 	s := NewStore()
 	c := NewCoordinator(1, s)
+	defer c.Finish()
 	w := c.Workers[0]
 	s.CreateKey(ProductKey(4), int32(0), SUM)
 	s.CreateKey(ProductKey(5), int32(0), WRITE)
-	s.CreateKey(UserKey(1), "u1", WRITE)
+	s.CreateKey(UserKey(1), int32(0), SUM)
 	s.CreateKey(UserKey(2), "u2", WRITE)
 	s.CreateKey(UserKey(3), "u3", WRITE)
-	tx := Query{TXN: D_BUY, K1: UserKey(1), A: int32(5), K2: ProductKey(4), W: nil, T: 0}
+	tx := Query{TXN: D_BUY, Args: &BuyArgs{UserKey(1), ProductKey(4), 5}, W: nil, T: 0}
 
 	r, err := w.One(tx)
-	_ = err
+	if err != nil {
+		t.Errorf("Buy got %v\n", err)
+	}
 	// Fresh read test
-	tx = Query{TXN: D_READ_ONE, K1: ProductKey(4), W: make(chan struct {
+	tx = Query{TXN: D_READ_ONE, Args: &KeyArgs{ProductKey(4)}, W: make(chan struct {
 		R *Result
 		E error
 	}), T: 0}
@@ -69,15 +78,15 @@ func Test2RandN(t *testing.T) {
 func TestListRecord(t *testing.T) {
 	br := MakeBR(SKey("x"), Entry{1, SKey("y"), 0}, LIST)
 	new_entries := make([]Entry, 5)
-	for i := 4; i > 0; i-- {
-		new_entries[4-i] = Entry{i, SKey("x"), 0}
+	for i := 5; i > 0; i-- {
+		new_entries[5-i] = Entry{i, CKey(uint64(i), 'x'), 0}
 	}
 	br.Apply(new_entries)
 
 	for i := 4; i > 0; i-- {
-		new_entries[4-i] = Entry{i * 3, SKey("z"), 0}
+		new_entries[4-i] = Entry{i * 3, CKey(uint64(i), 'z'), 0}
 	}
-	br.Apply(new_entries)
+	br.Apply(new_entries[:4])
 
 	var x int = br.entries[0].order
 	for i := 1; i < DEFAULT_LIST_SIZE; i++ {
@@ -86,6 +95,45 @@ func TestListRecord(t *testing.T) {
 		}
 		x = br.entries[i].order
 	}
+	// A better entry for a key replaces the old one
+	br.Apply([]Entry{{20, SKey("y"), 0}})
+	if len(br.entries) != DEFAULT_LIST_SIZE || br.entries[0].order != 20 {
+		t.Errorf("Bad list after raising an entry %v\n", br.entries)
+	}
+	for i := 1; i < len(br.entries); i++ {
+		if br.entries[i].key == SKey("y") {
+			t.Errorf("Duplicate entry %v\n", br.entries)
+		}
+	}
+	// What's already there stays when there are fewer new entries
+	br = MakeBR(SKey("x"), Entry{9, SKey("a"), 0}, LIST)
+	br.Apply([]Entry{{8, SKey("b"), 0}, {7, SKey("c"), 0}})
+	br.Apply([]Entry{{10, SKey("d"), 0}})
+	if fmt.Sprint(orders(br.entries)) != "[10 9 8 7]" {
+		t.Errorf("Bad merge %v\n", br.entries)
+	}
+
+	br = MakeBR(SKey("x"), ListSpec{Size: 3, Ascending: true}, LIST)
+	for i, o := range []int{5, 1, 4, 2} {
+		br.AddOneToRecord(Entry{o, CKey(uint64(i), 'k'), 0})
+	}
+	br.AddOneToRecord(Entry{0, CKey(2, 'k'), 0})
+	br.AddOneToRecord(Entry{3, CKey(1, 'k'), 0})
+	if fmt.Sprint(orders(br.entries)) != "[0 1 2]" {
+		t.Errorf("Bad ascending list %v\n", br.entries)
+	}
+	br.Apply([]Entry{{-1, SKey("a"), 0}, {1, SKey("b"), 0}})
+	if fmt.Sprint(orders(br.entries)) != "[-1 0 1]" || br.entries[2].key != CKey(1, 'k') {
+		t.Errorf("Bad ascending merge %v\n", br.entries)
+	}
+}
+
+func orders(e []Entry) []int {
+	var x []int
+	for i := range e {
+		x = append(x, e[i].order)
+	}
+	return x
 }
 
 func TestTStore(t *testing.T) {
@@ -93,12 +141,44 @@ func TestTStore(t *testing.T) {
 	if len(ts.t) != 0 {
 		t.Errorf("Should have 0 length\n")
 	}
-	ts.Add(Query{K2: SKey("product")})
-	if ts.t[0].K2 != SKey("product") {
+	ts.Add(Query{Args: &KeyArgs{SKey("product")}})
+	if ts.t[0].Args.(*KeyArgs).K != SKey("product") {
 		t.Errorf("Wrong value %v\n", ts.t)
 	}
 }
 
+var stashThenAbort = RegisterTxn(TxnInfo{Name: "test_stash_then_abort", Fn: Txn(func(t *KeyArgs, tx ETransaction) (*Result, error) {
+	if tx.GetPhase() == SPLIT {
+		return nil, ESTASH
+	}
+	return nil, EABORT
+})})
+
+func TestStashGivesUp(t *testing.T) {
+	if *SysType != DOPPEL {
+		return
+	}
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	q := Query{TXN: stashThenAbort, Args: &KeyArgs{ProductKey(4)}, W: make(chan struct {
+		R *Result
+		E error
+	}, 1)}
+	if _, err := c.Workers[0].One(q); err != ESTASH {
+		t.Fatalf("Expected ESTASH, got %v\n", err)
+	}
+	c.Accelerate <- true
+	select {
+	case x := <-q.W:
+		if x.E != EABORT {
+			t.Errorf("Expected EABORT, got %v\n", x.E)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No reply after the stashed transaction gave up\n")
+	}
+}
+
 func TestStddev(t *testing.T) {
 	x := make([]int64, 100)
 	for i := 0; i < 100; i++ {
@@ -123,37 +203,40 @@ func TestStddev(t *testing.T) {
 func TestAuction(t *testing.T) {
 	s := NewStore()
 	c := NewCoordinator(1, s)
+	defer c.Finish()
 	w := c.Workers[0]
 	myname := uint64(12345)
-	tx := Query{TXN: RUBIS_REGISTER, U2: myname, U1: 1}
+	tx := Query{TXN: RUBIS_REGISTER, Args: &RegisterUserArgs{Region: 1, Nickname: myname}}
 	r, err := w.One(tx)
 	if err != nil {
 		t.Errorf("Register\n")
 	}
 	jaid := r.V.(uint64)
 
-	tx = Query{TXN: RUBIS_NEWITEM, U1: jaid, S1: "burrito", S2: "slightly used burrito",
-		T:  0,
-		U2: 1,   // initial price
-		U3: 2,   // reserve price
-		U4: 5,   // buy now price
-		U5: 100, // duration
-		U6: 10,  // quantity
-		I:  42,  // enddate
-		U7: 1,   // category
-		W:  nil}
+	tx = Query{TXN: RUBIS_NEWITEM, Args: &NewItemArgs{
+		Seller:  jaid,
+		Name:    "burrito",
+		Desc:    "slightly used burrito",
+		Sprice:  1,
+		Rprice:  2,
+		Buynow:  5,
+		Dur:     100,
+		Qty:     10,
+		Enddate: 42,
+		Categ:   1,
+	}}
 	r, err = w.One(tx)
 	if err != nil {
 		t.Fatalf("New item %v\n", err)
 	}
 	burrito := r.V.(uint64)
 
-	tx = Query{TXN: RUBIS_BID, U1: jaid, U2: burrito, U3: 20}
+	tx = Query{TXN: RUBIS_BID, Args: &BidArgs{Bidder: jaid, Item: burrito, Price: 20}}
 	r, err = w.One(tx)
 	if err != nil {
 		t.Fatalf("Bid %v\n", err)
 	}
-	tx = Query{TXN: D_READ_ONE, K1: MaxBidKey(burrito)}
+	tx = Query{TXN: D_READ_ONE, Args: &KeyArgs{MaxBidKey(burrito)}}
 	r, err = w.One(tx)
 	if err != nil {
 		t.Errorf("Get bid %v\n", err)
@@ -161,7 +244,7 @@ func TestAuction(t *testing.T) {
 	if r.V.(int32) != 20 {
 		t.Errorf("Wrong max bid %v\n", r)
 	}
-	tx = Query{TXN: RUBIS_SEARCHCAT, U1: 1, U2: 1}
+	tx = Query{TXN: RUBIS_SEARCHCAT, Args: &SearchArgs{Categ: 1, Num: 1}}
 	r, err = w.One(tx)
 	if err != nil {
 		t.Errorf("Search cat\n", err)
@@ -184,7 +267,7 @@ func TestAuction(t *testing.T) {
 		t.Errorf("Wrong numbids %v\n", st.maxbids)
 	}
 
-	tx = Query{TXN: RUBIS_VIEWBIDHIST, U1: burrito}
+	tx = Query{TXN: RUBIS_VIEWBIDHIST, Args: &ItemArgs{burrito}}
 	r, err = w.One(tx)
 	if err != nil {
 		t.Fatalf("View Bid Hist\n", err)
@@ -196,7 +279,7 @@ func TestAuction(t *testing.T) {
 	if len(lst.bids) != 1 || len(lst.nns) != 1 {
 		t.Fatalf("Wrong length\n")
 	}
-	if lst.nns[0] != string(myname) {
+	if lst.nns[0] != strconv.FormatUint(myname, 10) {
 		t.Errorf("Wrong nickname %v\n", lst.nns[0])
 	}
 	if lst.bids[0].Price != 20 {
@@ -222,3 +305,1277 @@ func TestCandidates(t *testing.T) {
 	}
 	c.Merge(&c2)
 }
+
+type incrNArgs struct {
+	K Key
+	N int32
+}
+
+func incrNTxn(a *incrNArgs, tx ETransaction) (*Result, error) {
+	if err := tx.WriteInt32(a.K, a.N, SUM); err != nil {
+		return nil, err
+	}
+	if tx.Commit() == 0 {
+		return nil, EABORT
+	}
+	return nil, nil
+}
+
+var incrN = RegisterTxn(TxnInfo{Name: "test_incr_n", Label: "incr_n", Fn: Txn(incrNTxn)})
+
+func TestRegistry(t *testing.T) {
+	if h, ok := LookupTxn("test_incr_n"); !ok || h != incrN {
+		t.Fatalf("Lookup got %v %v; expected %v\n", h, ok, incrN)
+	}
+	if h, ok := LookupTxn("rubis_buynow"); !ok || h != RUBIS_BUYNOW {
+		t.Errorf("Built-in handle %v %v\n", h, ok)
+	}
+	if !IsRead(D_READ_ONE) || IsRead(D_BUY) {
+		t.Errorf("Wrong read-only flags\n")
+	}
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	for _, w := range c.Workers {
+		for i := 0; i < 10; i++ {
+			if _, err := w.One(Query{TXN: incrN, Args: &incrNArgs{ProductKey(4), 3}}); err != nil {
+				t.Fatalf("Incr %v\n", err)
+			}
+		}
+	}
+	if _, err := c.Workers[0].One(Query{TXN: incrN, Args: &KeyArgs{ProductKey(4)}}); err != EARGS {
+		t.Errorf("Expected EARGS, got %v\n", err)
+	}
+	r, err := c.Workers[1].One(Query{TXN: D_READ_ONE, Args: &KeyArgs{ProductKey(4)}})
+	if err != nil || r.V.(int32) != 60 {
+		t.Errorf("Read got %v %v\n", r, err)
+	}
+	ts := CollectTxnCounts(c)
+	if ts[incrN].Commits != 20 || ts[D_READ_ONE].Commits != 1 || ts[D_BUY].Commits != 0 {
+		t.Errorf("Wrong counts %v %v %v\n", ts[incrN], ts[D_READ_ONE], ts[D_BUY])
+	}
+	if GetTxnInfo(incrN).Label != "incr_n" || GetTxnInfo(D_BUY).Label != "buy" {
+		t.Errorf("Wrong labels\n")
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	s := NewStore()
+	s.CreateKey(ProductKey(1), int32(7), SUM)
+	s.CreateKey(ProductKey(2), MakeOverwrite("bob", 3), OOWRITE)
+	s.CreateKey(ProductKey(3), MakeEntry(5, UserKey(5), 0), LIST)
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	tx := c.Workers[0].E
+	tx.Reset()
+	if err := tx.WriteList(ProductKey(3), MakeEntry(3, UserKey(3), 1), LIST); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+
+	tx.Reset()
+	br, err := tx.Read(ProductKey(1))
+	if err != nil || br.Int32() != 7 || br.Type() != SUM || !br.Exists() || br.Key() != ProductKey(1) {
+		t.Errorf("Bad SUM record %v %v\n", br, err)
+	}
+	br, err = tx.Read(ProductKey(2))
+	if v, i := br.OOValue(); err != nil || v != "bob" || i != 3 {
+		t.Errorf("Bad OOWRITE record %v %v %v\n", v, i, err)
+	}
+	br, err = tx.Read(ProductKey(3))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	e := br.Entries()
+	if len(e) != 2 || e[0].Order() != 5 || e[1].Key() != UserKey(3) || e[1].Top() != 1 || e[1].Order() != 3 {
+		t.Errorf("Bad LIST record %v\n", e)
+	}
+	e[0] = MakeEntry(0, UserKey(0), 0)
+	if br.Entries()[0].Order() != 5 {
+		t.Errorf("Entries() should return a copy\n")
+	}
+	tx.Commit()
+}
+
+func TestRepeatedWrites(t *testing.T) {
+	s := NewStore()
+	s.CreateKey(ProductKey(1), int32(1), SUM)
+	s.CreateKey(ProductKey(2), int32(0), MAX)
+	s.CreateKey(ProductKey(3), MakeEntry(9, UserKey(9), 0), LIST)
+	s.CreateKey(ProductKey(4), MakeOverwrite("a", 1), OOWRITE)
+	s.CreateKey(ProductKey(6), int32(10), MIN)
+	s.CreateKey(ProductKey(9), int64(1<<40), SUM64)
+	s.CreateKey(ProductKey(10), float64(-1), FMAX)
+	s.CreateKey(ProductKey(12), int32(5), SUM)
+	c := NewCoordinator(1, s)
+	tx := c.Workers[0].E
+	tx.Reset()
+	tx.WriteInt32(ProductKey(1), 2, SUM)
+	tx.WriteInt32(ProductKey(1), 3, SUM)
+	tx.WriteInt32(ProductKey(2), 5, MAX)
+	tx.WriteInt32(ProductKey(2), 3, MAX)
+	tx.WriteList(ProductKey(3), MakeEntry(5, UserKey(5), 0), LIST)
+	tx.WriteList(ProductKey(3), MakeEntry(4, UserKey(4), 0), LIST)
+	tx.WriteOO(ProductKey(4), 7, "b", OOWRITE)
+	tx.WriteOO(ProductKey(4), 6, "c", OOWRITE)
+	tx.WriteInt32(ProductKey(5), 4, SUM)
+	tx.WriteInt32(ProductKey(5), 4, SUM)
+	tx.WriteInt32(ProductKey(6), 7, MIN)
+	tx.WriteInt32(ProductKey(6), 8, MIN)
+	tx.WriteInt32(ProductKey(7), 3, MIN)
+	tx.WriteInt64(ProductKey(9), 1<<40, SUM64)
+	tx.WriteInt64(ProductKey(9), 1, SUM64)
+	tx.WriteFloat64(ProductKey(10), -0.5, FMAX)
+	tx.WriteFloat64(ProductKey(10), -0.75, FMAX)
+	if err := tx.WriteInt64(ProductKey(11), 1, SUM); err != ETYPE {
+		t.Errorf("WriteInt64() of a SUM got %v\n", err)
+	}
+	// Reads see the pending writes applied to the committed record
+	br, err := tx.Read(ProductKey(1))
+	if err != nil || br.Int32() != 6 {
+		t.Errorf("Read own SUM got %v %v\n", br, err)
+	}
+	tx.Write(ProductKey(12), int32(1), SUM)
+	br, err = tx.Read(ProductKey(12))
+	if err != nil || br.Int32() != 6 {
+		t.Errorf("Read own blind SUM got %v %v\n", br, err)
+	}
+	br, err = tx.Read(ProductKey(3))
+	if e := br.Entries(); err != nil || len(e) != 3 || e[0].Order() != 9 || e[2].Order() != 4 {
+		t.Errorf("Read own LIST got %v %v\n", e, err)
+	}
+	br, err = tx.Read(ProductKey(9))
+	if err != nil || br.Int64() != 1<<41+1 {
+		t.Errorf("Read own SUM64 got %v %v\n", br, err)
+	}
+	br, err = tx.Read(ProductKey(4))
+	if v, i := br.OOValue(); err != nil || v != "b" || i != 7 {
+		t.Errorf("Read own OOWRITE got %v %v %v\n", v, i, err)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+
+	tx.Reset()
+	for k, x := range map[Key]int32{ProductKey(1): 6, ProductKey(2): 5, ProductKey(5): 8, ProductKey(6): 7, ProductKey(7): 3} {
+		br, err := tx.Read(k)
+		if err != nil || br.Int32() != x {
+			t.Errorf("%v got %v %v; expected %v\n", k, br, err, x)
+		}
+	}
+	br, err = tx.Read(ProductKey(9))
+	if err != nil || br.Int64() != 1<<41+1 {
+		t.Errorf("SUM64 got %v %v\n", br, err)
+	}
+	br, err = tx.Read(ProductKey(10))
+	if err != nil || br.Value().(float64) != -0.5 {
+		t.Errorf("FMAX got %v %v\n", br, err)
+	}
+	br, err = tx.Read(ProductKey(3))
+	if e := br.Entries(); err != nil || len(e) != 3 || e[0].Order() != 9 || e[1].Order() != 5 || e[2].Order() != 4 {
+		t.Errorf("LIST got %v %v\n", e, err)
+	}
+	br, err = tx.Read(ProductKey(4))
+	if v, i := br.OOValue(); err != nil || v != "b" || i != 7 {
+		t.Errorf("OOWRITE got %v %v %v\n", v, i, err)
+	}
+	tx.Commit()
+	// Stop the worker so it doesn't merge underneath the split phase
+	// test.
+	c.Finish()
+
+	if *SysType != DOPPEL {
+		return
+	}
+	*AlwaysSplit = true
+	defer func() { *AlwaysSplit = false }()
+	w := c.Workers[0]
+	otx := StartOTransaction(w)
+	otx.SetPhase(SPLIT)
+	otx.Reset()
+	otx.WriteInt32(ProductKey(1), 2, SUM)
+	otx.WriteInt32(ProductKey(1), 3, SUM)
+	otx.WriteList(ProductKey(3), MakeEntry(2, UserKey(2), 0), LIST)
+	otx.WriteList(ProductKey(3), MakeEntry(1, UserKey(1), 0), LIST)
+	otx.WriteInt32(ProductKey(6), 9, MIN)
+	otx.WriteInt32(ProductKey(8), -2, MIN)
+	otx.WriteInt32(ProductKey(8), -1, MIN)
+	otx.WriteInt64(ProductKey(9), -2, SUM64)
+	otx.WriteInt64(ProductKey(9), -3, SUM64)
+	otx.WriteFloat64(ProductKey(10), -0.25, FMAX)
+	otx.WriteOO(ProductKey(4), 8, "d", OOWRITE)
+	if _, err := otx.Read(ProductKey(1)); err != ESTASH {
+		t.Errorf("Expected ESTASH, got %v\n", err)
+	}
+	if otx.Commit() == 0 {
+		t.Fatalf("Abort in split phase\n")
+	}
+	if w.local_store.sums[ProductKey(1)] != 5 || len(w.local_store.lists[ProductKey(3)]) != 2 {
+		t.Errorf("Local store got %v %v\n", w.local_store.sums[ProductKey(1)], w.local_store.lists[ProductKey(3)])
+	}
+	// Merging a MIN that isn't lower leaves the record alone
+	w.local_store.Merge()
+	for k, x := range map[Key]Value{ProductKey(6): int32(7), ProductKey(8): int32(-2), ProductKey(9): int64(1<<41 - 4), ProductKey(10): float64(-0.25), ProductKey(4): MakeOverwrite("d", 8)} {
+		if br, err := s.getKey(k, nil); err != nil || br.Value() != x {
+			t.Errorf("%v after merge got %v %v; expected %v\n", k, br, err, x)
+		}
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	tx := c.Workers[0].E
+
+	// More keys than the sets start with
+	tx.Reset()
+	for i := 0; i < 300; i++ {
+		if err := tx.WriteInt32(ProductKey(i), 1, SUM); err != nil {
+			t.Fatalf("Write %v: %v\n", i, err)
+		}
+	}
+	for i := 300; i < 600; i++ {
+		if _, err := tx.Read(ProductKey(i)); err != ENOKEY {
+			t.Fatalf("Read %v: %v\n", i, err)
+		}
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+
+	old := *MaxKeys
+	*MaxKeys = 10
+	defer func() { *MaxKeys = old }()
+	tx.Reset()
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		err = tx.WriteInt32(ProductKey(i), 1, SUM)
+	}
+	if err != ETOOLARGE {
+		t.Fatalf("Expected ETOOLARGE, got %v\n", err)
+	}
+	tx.Abort()
+
+	// Nothing was applied, and nothing is still locked
+	tx.Reset()
+	for i := 0; i < 5; i++ {
+		tx.WriteInt32(ProductKey(i), 1, SUM)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+	tx.Reset()
+	br, err := tx.Read(ProductKey(0))
+	if err != nil || br.Int32() != 2 {
+		t.Errorf("Read got %v %v\n", br, err)
+	}
+	tx.Commit()
+}
+
+// Writes K twice with different ops, and doesn't clean up after
+// itself.
+func mixedOpsTxn(a *KeyArgs, tx ETransaction) (*Result, error) {
+	if err := tx.WriteInt32(a.K, 1, SUM); err != nil {
+		return nil, err
+	}
+	if err := tx.WriteInt32(a.K, 1, MAX); err != nil {
+		return nil, err
+	}
+	tx.Commit()
+	return nil, nil
+}
+
+var mixedOps = RegisterTxn(TxnInfo{Name: "test_mixed_ops", Fn: Txn(mixedOpsTxn)})
+
+func TestErrors(t *testing.T) {
+	s := NewStore()
+	s.CreateKey(ProductKey(1), int32(0), SUM)
+	s.CreateKey(ProductKey(2), MakeEntry(1, UserKey(1), 0), LIST)
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	w := c.Workers[0]
+
+	if _, err := w.One(Query{TXN: 1000, Args: &KeyArgs{ProductKey(1)}}); err != EUNKNOWNTXN {
+		t.Errorf("Expected EUNKNOWNTXN, got %v\n", err)
+	}
+	if _, err := w.One(Query{TXN: mixedOps, Args: &KeyArgs{ProductKey(1)}}); err != ETYPE {
+		t.Errorf("Expected ETYPE, got %v\n", err)
+	}
+	// Not applied, and not left locked
+	if _, err := w.One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{ProductKey(1)}}); err != nil {
+		t.Errorf("Incr got %v\n", err)
+	}
+	r, err := w.One(Query{TXN: D_READ_ONE, Args: &KeyArgs{ProductKey(1)}})
+	if err != nil || r.V.(int32) != 1 {
+		t.Errorf("Read got %v %v\n", r, err)
+	}
+	if _, err := w.One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{ProductKey(2)}}); err != ETYPE {
+		t.Errorf("SUM to a LIST: expected ETYPE, got %v\n", err)
+	}
+
+	tx := w.E
+	tx.Reset()
+	if err := tx.WriteList(ProductKey(3), MakeEntry(1, UserKey(1), 0), SUM); err != ETYPE {
+		t.Errorf("WriteList with SUM: expected ETYPE, got %v\n", err)
+	}
+	if err := tx.WriteOO(ProductKey(3), 1, "x", WRITE); err != ETYPE {
+		t.Errorf("WriteOO with WRITE: expected ETYPE, got %v\n", err)
+	}
+	tx.Abort()
+
+	// Through Write(), and to a key already read
+	s.CreateKey(ProductKey(4), ListSpec{Size: 3}, LIST)
+	tx.Reset()
+	if err := tx.Write(ProductKey(4), int32(5), SUM); err != ETYPE {
+		t.Errorf("Write of a SUM to a LIST: expected ETYPE, got %v\n", err)
+	}
+	if err := tx.Write(ProductKey(5), "x", SUM); err != ETYPE {
+		t.Errorf("Write of a string as a SUM: expected ETYPE, got %v\n", err)
+	}
+	if err := tx.Write(ProductKey(5), int32(1), SUM64); err != ETYPE {
+		t.Errorf("Write of an int32 as a SUM64: expected ETYPE, got %v\n", err)
+	}
+	tx.Abort()
+	tx.Reset()
+	if _, err := tx.Read(ProductKey(4)); err != nil {
+		t.Errorf("Read got %v\n", err)
+	}
+	if err := tx.Write(ProductKey(4), "x", WRITE); err != ETYPE {
+		t.Errorf("WRITE to a LIST: expected ETYPE, got %v\n", err)
+	}
+	tx.Abort()
+	if l, _ := s.getKey(ProductKey(4), nil); l.key_type != LIST || l.ListSpec() != (ListSpec{Size: 3}) {
+		t.Errorf("LIST record changed to %v %v\n", l.key_type, l.ListSpec())
+	}
+
+	br, _ := s.getKey(ProductKey(1), nil)
+	if br.Unlock(0) == nil {
+		t.Errorf("Unlocked an unlocked record\n")
+	}
+	cand := w.local_store.candidates
+	cand.Write(ProductKey(1), br, SUM)
+	cand.Write(ProductKey(1), br, MAX)
+	cand.Conflict(ProductKey(1), br, MAX)
+}
+
+func TestUpgrade(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	old := *Spinlock
+	defer func() { *Spinlock = old }()
+	for i, spin := range []bool{false, true} {
+		*Spinlock = spin
+		k := ProductKey(i)
+		s.CreateKey(k, int32(0), SUM)
+		tx1 := StartLTransaction(c.Workers[0])
+		tx2 := StartLTransaction(c.Workers[1])
+
+		// Read then write, no MaybeWrite()
+		tx1.Reset()
+		if _, err := tx1.Read(k); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := tx1.WriteInt32(k, 1, SUM); err != nil {
+			t.Fatalf("Upgrade got %v\n", err)
+		}
+		tx1.Commit()
+
+		// Both read, then both try to upgrade; one has to lose
+		// rather than wait for the other forever.
+		tx1.Reset()
+		tx2.Reset()
+		tx1.Read(k)
+		tx2.Read(k)
+		errs := make(chan error)
+		for _, tx := range []*LTransaction{tx1, tx2} {
+			go func(tx *LTransaction) {
+				err := tx.WriteInt32(k, 1, SUM)
+				if err == nil {
+					tx.Commit()
+				} else {
+					tx.Abort()
+				}
+				errs <- err
+			}(tx)
+		}
+		e1, e2 := <-errs, <-errs
+		if (e1 == nil) == (e2 == nil) || (e1 != EABORT && e2 != EABORT) {
+			t.Errorf("spin %v: expected one commit and one EABORT, got %v %v\n", spin, e1, e2)
+		}
+		tx1.Reset()
+		if br, err := tx1.Read(k); err != nil || br.Int32() != 2 {
+			t.Errorf("spin %v: read got %v %v\n", spin, br, err)
+		}
+		tx1.Commit()
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	old := *Spinlock
+	defer func() { *Spinlock = old }()
+	for i, spin := range []bool{false, true} {
+		*Spinlock = spin
+		a, b := ProductKey(2*i), ProductKey(2*i+1)
+		s.CreateKey(a, int32(0), SUM)
+		s.CreateKey(b, int32(0), SUM)
+		tx1 := StartLTransaction(c.Workers[0])
+		tx2 := StartLTransaction(c.Workers[1])
+		tx1.Reset()
+		tx2.Reset()
+		if err := tx1.WriteInt32(a, 1, SUM); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if err := tx2.WriteInt32(b, 1, SUM); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+
+		// Each now wants the other's lock; at least one has to
+		// time out instead of waiting forever.
+		errs := make(chan error)
+		for _, x := range []struct {
+			tx *LTransaction
+			k  Key
+		}{{tx1, b}, {tx2, a}} {
+			go func(tx *LTransaction, k Key) {
+				err := tx.WriteInt32(k, 1, SUM)
+				if err == nil {
+					tx.Commit()
+				} else {
+					tx.Abort()
+				}
+				errs <- err
+			}(x.tx, x.k)
+		}
+		e1, e2 := <-errs, <-errs
+		if e1 != EABORT && e2 != EABORT {
+			t.Errorf("spin %v: expected an EABORT, got %v %v\n", spin, e1, e2)
+		}
+		if c.Workers[0].Nstats[NLOCKTIMEOUT]+c.Workers[1].Nstats[NLOCKTIMEOUT] == 0 {
+			t.Errorf("spin %v: no lock timeouts counted\n", spin)
+		}
+
+		// Nothing is left locked
+		tx1.Reset()
+		tx1.WriteInt32(a, 1, SUM)
+		if err := tx1.WriteInt32(b, 1, SUM); err != nil {
+			t.Errorf("spin %v: write after deadlock got %v\n", spin, err)
+		}
+		tx1.Commit()
+	}
+}
+
+var snapReadOne = RegisterTxn(TxnInfo{Name: "snapshot_read_one", Fn: Txn(ReadOneTxn), ReadOnly: true, Snapshot: true})
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	w := c.Workers[0]
+	k1, k2, k3 := ProductKey(0), ProductKey(1), ProductKey(2)
+	s.CreateKey(k1, int32(0), SUM)
+	read := func(k Key) (int32, error) {
+		r, err := w.One(Query{TXN: snapReadOne, Args: &KeyArgs{k}})
+		if err != nil {
+			return 0, err
+		}
+		return r.V.(int32), nil
+	}
+	incr := func(k Key) {
+		if _, err := w.One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{k}}); err != nil {
+			t.Fatalf("Incr got %v\n", err)
+		}
+	}
+	// The next epoch moves the snapshot along, without anyone asking
+	e := atomic.LoadUint64(&s.snapepoch)
+	incr(k1)
+	incr(k2)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&s.snapepoch) == e {
+		if time.Now().After(deadline) {
+			t.Fatalf("No new epoch\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if x, err := read(k1); err != nil || x != 1 {
+		t.Errorf("Snapshot read after an epoch got %v %v, expected 1\n", x, err)
+	}
+	if x, err := read(k2); err != nil || x != 1 {
+		t.Errorf("Snapshot read of new key after an epoch got %v %v, expected 1\n", x, err)
+	}
+
+	// Locked records don't get in the way
+	e = atomic.LoadUint64(&s.snapepoch)
+	incr(k1)
+	incr(k3)
+	br, _ := s.Get(k1)
+	_, last := br.Lock()
+	br.SLock()
+	x1, err1 := read(k1)
+	_, err3 := read(k3)
+	br.SUnlock()
+	br.Unlock(TID(last))
+	if err1 != nil {
+		t.Errorf("Snapshot read of locked key got %v\n", err1)
+	}
+	// Both written after the snapshot, unless an epoch went by; k3
+	// didn't exist before
+	if atomic.LoadUint64(&s.snapepoch) == e {
+		if x1 != 1 {
+			t.Errorf("Snapshot read got %v, expected 1\n", x1)
+		}
+		if err3 != ENOKEY {
+			t.Errorf("Snapshot read of new key got %v\n", err3)
+		}
+	}
+	tx := StartSTransaction(w)
+	tx.Reset()
+	if err := tx.WriteInt32(k1, 1, SUM); err != EREADONLY {
+		t.Errorf("Snapshot write got %v\n", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	old := *Versions
+	defer func() { *Versions = old }()
+	*Versions = 4
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	w := c.Workers[0]
+	var tx ETransaction
+	if *SysType == LOCKING {
+		tx = StartLTransaction(w)
+	} else {
+		tx = StartOTransaction(w)
+	}
+	k1, k2 := ProductKey(0), ProductKey(1)
+	s.CreateKey(k1, int32(0), SUM)
+	incr := func(k Key) TID {
+		tx.Reset()
+		if err := tx.WriteInt32(k, 1, SUM); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		tid := tx.Commit()
+		if tid == 0 {
+			t.Fatalf("Abort\n")
+		}
+		return tid
+	}
+	readAt := func(k Key, tid TID) (int32, TID, error) {
+		tx.Reset()
+		br, err := tx.ReadAt(k, tid)
+		if err != nil {
+			return 0, 0, err
+		}
+		return br.Int32(), br.Version(), nil
+	}
+	var tids []TID
+	for i := 0; i < 3; i++ {
+		tids = append(tids, incr(k1))
+	}
+	for i, tid := range tids {
+		if x, v, err := readAt(k1, tid); err != nil || x != int32(i+1) || v != tid {
+			t.Errorf("ReadAt(%v) got %v %v %v\n", i, x, v, err)
+		}
+	}
+	if x, v, err := readAt(k1, tids[1]-1); err != nil || x != 1 || v != tids[0] {
+		t.Errorf("ReadAt() between versions got %v %v %v\n", x, v, err)
+	}
+	if x, v, err := readAt(k1, 0); err != nil || x != 0 || v != 0 {
+		t.Errorf("ReadAt() before any writes got %v %v %v\n", x, v, err)
+	}
+
+	// Created by a transaction
+	tid := incr(k2)
+	if _, _, err := readAt(k2, tid-1); err != ENOKEY {
+		t.Errorf("ReadAt() before creation got %v\n", err)
+	}
+	if x, _, err := readAt(k2, tid); err != nil || x != 1 {
+		t.Errorf("ReadAt() of new key got %v %v\n", x, err)
+	}
+
+	// Only the last four versions are kept
+	incr(k1)
+	tid = incr(k1)
+	if x, _, err := readAt(k1, tids[0]); err != EVERSION {
+		t.Errorf("ReadAt() of dropped version got %v %v\n", x, err)
+	}
+	if x, _, err := readAt(k1, tid); err != nil || x != 5 {
+		t.Errorf("ReadAt() of latest got %v %v\n", x, err)
+	}
+}
+
+var deleteOne = RegisterTxn(TxnInfo{Name: "delete_one", Fn: Txn(func(t *KeyArgs, tx ETransaction) (*Result, error) {
+	if err := tx.Delete(t.K); err != nil {
+		return nil, err
+	}
+	if tx.Commit() == 0 {
+		return nil, EABORT
+	}
+	return nil, nil
+})})
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	w := c.Workers[0]
+	k1, k2, k3 := ProductKey(0), ProductKey(1), ProductKey(2)
+	s.CreateKey(k1, int32(5), SUM)
+	s.CreateKey(k2, int32(5), SUM)
+	run := func(txn int, k Key) (*Result, error) {
+		return w.One(Query{TXN: txn, Args: &KeyArgs{k}})
+	}
+	if _, err := run(deleteOne, k1); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if _, err := run(D_READ_ONE, k1); err != ENOKEY {
+		t.Errorf("Read of deleted key got %v\n", err)
+	}
+	if _, err := run(deleteOne, k1); err != ENOKEY {
+		t.Errorf("Second delete got %v\n", err)
+	}
+	// Writing it again starts over
+	if _, err := run(D_INCR_ONE, k1); err != nil {
+		t.Fatalf("Incr got %v\n", err)
+	}
+	if r, err := run(D_READ_ONE, k1); err != nil || r.V.(int32) != 1 {
+		t.Errorf("Read of re-created key got %v %v\n", r, err)
+	}
+
+	// A transaction that read k2 can't commit once it's deleted;
+	// 2PL would hold a read lock instead.
+	var tx ETransaction
+	if *SysType == LOCKING {
+		tx = StartLTransaction(c.Workers[1])
+	} else {
+		tx = StartOTransaction(c.Workers[1])
+	}
+	tx.Reset()
+	if _, err := tx.Read(k2); err != nil {
+		t.Fatalf("Read got %v\n", err)
+	}
+	if *SysType == LOCKING {
+		tx.Abort()
+	}
+	if _, err := run(deleteOne, k2); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if *SysType != LOCKING && tx.Commit() != 0 {
+		t.Errorf("Read of deleted key validated\n")
+	}
+	tx.Reset()
+	if err := tx.Delete(k3); err != ENOKEY {
+		t.Errorf("Delete of missing key got %v\n", err)
+	}
+	tx.Abort()
+
+	// Tombstones, and anything 2PL made to lock missing keys, go
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err2 := s.Get(k2)
+		_, err3 := s.Get(k3)
+		if err2 == ENOKEY && err3 == ENOKEY {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Tombstones never reclaimed: %v %v\n", err2, err3)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Finish()
+
+	s2, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	if br, err := s2.Get(k1); err != nil || br.Value().(int32) != 1 {
+		t.Errorf("Wrong value for re-created key after recovery %v %v\n", br, err)
+	}
+	if _, err := s2.Get(k2); err != ENOKEY {
+		t.Errorf("Deleted key came back after recovery %v\n", err)
+	}
+}
+
+// A split key's deltas go once merged, so they can't bring it back
+// after it's deleted.
+func TestDeleteMerged(t *testing.T) {
+	if *SysType != DOPPEL {
+		return
+	}
+	s := NewStore()
+	k1, k2 := ProductKey(1), ProductKey(2)
+	s.CreateKey(k1, int32(0), MAX)
+	s.CreateKey(k2, "", WRITE)
+	c := NewCoordinator(1, s)
+	// Stop the worker so it doesn't merge underneath the test
+	c.Finish()
+	w := c.Workers[0]
+	tx := StartOTransaction(w)
+	tx.SetPhase(SPLIT)
+
+	*AlwaysSplit = true
+	tx.Reset()
+	tx.WriteInt32(k1, 5, MAX)
+	tx.Write(k2, "v1", WRITE)
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort in split phase\n")
+	}
+	*AlwaysSplit = false
+	w.local_store.Merge()
+	if br, _ := s.Get(k1); br.Value() != int32(5) {
+		t.Errorf("MAX after merge got %v\n", br.Value())
+	}
+	if br, _ := s.Get(k2); br.Value() != "v1" {
+		t.Errorf("WRITE after merge got %v\n", br.Value())
+	}
+
+	tx.Reset()
+	if err := tx.Delete(k1); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if err := tx.Delete(k2); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+	w.local_store.Merge()
+	for _, k := range []Key{k1, k2} {
+		if br, _ := s.Get(k); br.Exists() {
+			t.Errorf("%v came back after merge as %v\n", k, br.Value())
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := NewStore()
+	s.AddOrdered("sc")
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	w := c.Workers[0]
+	k := func(i int) Key {
+		return PrefixKey("sc", uint64(i))
+	}
+	// Enough to split leaves
+	for i := 0; i < 4*ORDERED_LEAF; i += 2 {
+		s.CreateKey(k(i), int32(i), SUM)
+	}
+	var tx ETransaction
+	if *SysType == LOCKING {
+		tx = StartLTransaction(c.Workers[1])
+	} else {
+		tx = StartOTransaction(c.Workers[1])
+	}
+	scan := func(start, end, limit int) []int32 {
+		recs, err := tx.Scan(k(start), k(end), limit)
+		if err != nil {
+			t.Fatalf("Scan got %v\n", err)
+		}
+		var x []int32
+		for _, br := range recs {
+			x = append(x, br.Int32())
+		}
+		return x
+	}
+	tx.Reset()
+	if x := scan(10, 20, 0); fmt.Sprint(x) != "[10 12 14 16 18 20]" {
+		t.Errorf("Scan got %v\n", x)
+	}
+	if x := scan(121, 200, 3); fmt.Sprint(x) != "[122 124 126]" {
+		t.Errorf("Scan with limit got %v\n", x)
+	}
+	if _, err := tx.Scan(ProductKey(0), ProductKey(1), 0); err != ENOINDEX {
+		t.Errorf("Scan without an index got %v\n", err)
+	}
+	if tx.Commit() == 0 {
+		t.Errorf("Abort\n")
+	}
+
+	// Deleted keys go, and new ones show up
+	if _, err := w.One(Query{TXN: deleteOne, Args: &KeyArgs{k(12)}}); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if _, err := w.One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{k(13)}}); err != nil {
+		t.Fatalf("Incr got %v\n", err)
+	}
+	tx.Reset()
+	if x := scan(10, 20, 4); fmt.Sprint(x) != "[10 1 14 16]" {
+		t.Errorf("Scan after changes got %v\n", x)
+	}
+	tx.Commit()
+
+	// A key added to a range already scanned is a phantom
+	tx.Reset()
+	scan(30, 40, 0)
+	if _, err := w.One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{k(31)}}); err != nil {
+		t.Fatalf("Incr got %v\n", err)
+	}
+	if tx.Commit() != 0 {
+		t.Errorf("Scan with a phantom committed\n")
+	}
+
+	// Adding one myself is fine
+	tx.Reset()
+	scan(50, 60, 0)
+	if err := tx.WriteInt32(k(51), 1, SUM); err != nil {
+		t.Fatalf("Write got %v\n", err)
+	}
+	if tx.Commit() == 0 {
+		t.Errorf("Scan and insert aborted\n")
+	}
+	tx.Reset()
+	if x := scan(50, 52, 0); fmt.Sprint(x) != "[50 1 52]" {
+		t.Errorf("Scan after insert got %v\n", x)
+	}
+	tx.Commit()
+}
+
+// Commit() puts a key it creates in its ordered index before it
+// validates, without making its own scans stale, and takes it out
+// again if it aborts.
+func TestScanInsert(t *testing.T) {
+	if *SysType == LOCKING {
+		return
+	}
+	s := NewStore()
+	s.AddOrdered("sc")
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	k := func(i int) Key {
+		return PrefixKey("sc", uint64(i))
+	}
+	s.CreateKey(k(0), int32(0), SUM)
+	s.CreateKey(ProductKey(1), int32(0), SUM)
+	in := StartOTransaction(c.Workers[0])
+	sc := StartOTransaction(c.Workers[1])
+	entries := func() int {
+		n := 0
+		s.scan(k(0), k(10), 0, nil, func(br *BRecord) (bool, error) {
+			n++
+			return true, nil
+		})
+		return n
+	}
+
+	// The insert reads a key that changes before it commits
+	in.Reset()
+	if _, err := in.Read(ProductKey(1)); err != nil {
+		t.Fatalf("Read got %v\n", err)
+	}
+	if err := in.WriteInt32(k(5), 1, SUM); err != nil {
+		t.Fatalf("Write got %v\n", err)
+	}
+	sc.Reset()
+	if recs, err := sc.Scan(k(0), k(10), 0); err != nil || len(recs) != 1 {
+		t.Fatalf("Scan got %v %v\n", len(recs), err)
+	}
+	if _, err := c.Workers[1].One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{ProductKey(1)}}); err != nil {
+		t.Fatalf("Incr got %v\n", err)
+	}
+	if in.Commit() != 0 {
+		t.Fatalf("Insert after a changed read committed\n")
+	}
+	// It was in the leaf sc scanned before in validated
+	if sc.Commit() != 0 {
+		t.Errorf("Scan committed though an insert reached its leaf\n")
+	}
+	if n := entries(); n != 1 {
+		t.Errorf("Aborted insert left %v index entries\n", n)
+	}
+	if br, err := s.getKeyStatic(k(5)); err == nil && br.exists {
+		t.Errorf("Aborted insert left the key\n")
+	}
+
+	// Writing it for real puts it back
+	if _, err := c.Workers[0].One(Query{TXN: D_INCR_ONE, Args: &KeyArgs{k(5)}}); err != nil {
+		t.Fatalf("Incr got %v\n", err)
+	}
+	sc.Reset()
+	if recs, err := sc.Scan(k(0), k(10), 0); err != nil || len(recs) != 2 || recs[1].Int32() != 1 {
+		t.Errorf("Scan after insert got %v %v\n", len(recs), err)
+	}
+	sc.Commit()
+
+	// So does an insert of my own that splits the leaf I scanned
+	for i := 0; len(s.orderedFor(k(0)).leaves[0].recs) < ORDERED_LEAF; i++ {
+		s.CreateKey(k(100+i), int32(0), SUM)
+	}
+	sc.Reset()
+	sc.Scan(k(0), k(10), 0)
+	if err := sc.WriteInt32(k(6), 1, SUM); err != nil {
+		t.Fatalf("Write got %v\n", err)
+	}
+	if sc.Commit() == 0 {
+		t.Errorf("Scan and an insert that split its leaf aborted\n")
+	}
+	if n := len(s.orderedFor(k(0)).leaves); n != 2 {
+		t.Errorf("Insert into a full leaf left %v leaves\n", n)
+	}
+}
+
+type tagged struct {
+	Tag uint64 // 0 for none
+}
+
+func init() {
+	RegisterIndex(&Index{
+		Name:    "test_tag",
+		Example: &tagged{},
+		Unique:  true,
+		Entry: func(k Key, v Value) (Key, bool) {
+			x := v.(*tagged).Tag
+			return PrefixKey("tg", x), x != 0
+		},
+	})
+}
+
+func TestIndex(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	defer c.Finish()
+	w := c.Workers[0]
+	a, b := ProductKey(100), ProductKey(101)
+	s.CreateKey(a, &tagged{1}, WRITE)
+	var tx ETransaction
+	if *SysType == LOCKING {
+		tx = StartLTransaction(c.Workers[1])
+	} else {
+		tx = StartOTransaction(c.Workers[1])
+	}
+	tag := func(k Key, x uint64) error {
+		tx.Reset()
+		if err := tx.Write(k, &tagged{x}, WRITE); err != nil {
+			tx.Abort()
+			return err
+		}
+		if tx.Commit() == 0 {
+			return EABORT
+		}
+		return nil
+	}
+	// Which key has tag x, if any
+	owner := func(x uint64) (Key, bool) {
+		tx.Reset()
+		defer tx.Commit()
+		br, err := tx.Read(PrefixKey("tg", x))
+		if err != nil {
+			return Key{}, false
+		}
+		return br.Value().(Key), true
+	}
+	if k, ok := owner(1); !ok || k != a {
+		t.Errorf("Loaded record not indexed: %v %v\n", k, ok)
+	}
+	if err := tag(b, 1); err != EUNIQUE {
+		t.Errorf("Took a used tag: %v\n", err)
+	}
+	if err := tag(b, 2); err != nil {
+		t.Fatalf("Tag got %v\n", err)
+	}
+	// Moving a tag frees the old one
+	if err := tag(a, 3); err != nil {
+		t.Fatalf("Tag got %v\n", err)
+	}
+	if _, ok := owner(1); ok {
+		t.Errorf("Old entry still there\n")
+	}
+	if err := tag(b, 1); err != nil {
+		t.Fatalf("Tag got %v\n", err)
+	}
+	if err := tag(b, 1); err != nil {
+		t.Errorf("Rewriting the same tag got %v\n", err)
+	}
+	if _, ok := owner(2); ok {
+		t.Errorf("Old entry still there\n")
+	}
+	if k, ok := owner(3); !ok || k != a {
+		t.Errorf("Wrong entry %v %v\n", k, ok)
+	}
+	if _, err := w.One(Query{TXN: deleteOne, Args: &KeyArgs{a}}); err != nil {
+		t.Fatalf("Delete got %v\n", err)
+	}
+	if _, ok := owner(3); ok {
+		t.Errorf("Entry of a deleted record still there\n")
+	}
+	if err := tag(b, 0); err != nil {
+		t.Fatalf("Tag got %v\n", err)
+	}
+	if _, ok := owner(1); ok {
+		t.Errorf("Untagged record still has an entry\n")
+	}
+}
+
+func TestNicknames(t *testing.T) {
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	tx := c.Workers[0].E
+	name := func(k Key, nn string) error {
+		tx.Reset()
+		if err := tx.Write(k, &User{Nickname: nn}, WRITE); err != nil {
+			tx.Abort()
+			return err
+		}
+		if tx.Commit() == 0 {
+			return EABORT
+		}
+		return nil
+	}
+	if err := name(UserKey(1), "alice"); err != nil {
+		t.Fatalf("Register got %v\n", err)
+	}
+	if err := name(UserKey(2), "alice"); err != EUNIQUE {
+		t.Errorf("Took a used nickname: %v\n", err)
+	}
+	if err := name(UserKey(2), "bob"); err != nil {
+		t.Errorf("Register got %v\n", err)
+	}
+	if err := name(UserKey(3), "7"); err != nil {
+		t.Errorf("Register got %v\n", err)
+	}
+	if err := name(UserKey(4), "7"); err != EUNIQUE {
+		t.Errorf("Took a used numeric nickname: %v\n", err)
+	}
+}
+
+type named struct {
+	Name string
+}
+
+func init() {
+	// Hashes names by length, so most collide
+	RegisterIndex(&Index{
+		Name:    "test_name",
+		Example: &named{},
+		Unique:  true,
+		Entry: func(k Key, v Value) (Key, bool) {
+			x := v.(*named).Name
+			return PrefixKey("nm", uint64(len(x))), x != ""
+		},
+		Same: func(a, b Value) bool {
+			return a.(*named).Name == b.(*named).Name
+		},
+	})
+}
+
+func TestIndexCollisions(t *testing.T) {
+	s := NewStore()
+	s.CreateKey(ProductKey(1), &named{"ab"}, WRITE)
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	tx := c.Workers[0].E
+	name := func(k Key, x string) error {
+		tx.Reset()
+		if err := tx.Write(k, &named{x}, WRITE); err != nil {
+			tx.Abort()
+			return err
+		}
+		if tx.Commit() == 0 {
+			return EABORT
+		}
+		return nil
+	}
+	a, b, d := ProductKey(1), ProductKey(2), ProductKey(3)
+	if err := name(b, "cd"); err != nil {
+		t.Fatalf("Colliding name got %v\n", err)
+	}
+	if err := name(d, "ab"); err != EUNIQUE {
+		t.Errorf("Took a used name: %v\n", err)
+	}
+	if err := name(d, "cd"); err != EUNIQUE {
+		t.Errorf("Took a used name past a collision: %v\n", err)
+	}
+	// Freeing the first entry leaves the one past it in use
+	if err := name(a, ""); err != nil {
+		t.Fatalf("Unname got %v\n", err)
+	}
+	if err := name(d, "cd"); err != EUNIQUE {
+		t.Errorf("Took a used name past a freed entry: %v\n", err)
+	}
+	if err := name(d, "ab"); err != nil {
+		t.Errorf("Freed name got %v\n", err)
+	}
+	if err := name(d, "ab"); err != nil {
+		t.Errorf("Rewriting the same name got %v\n", err)
+	}
+	if err := name(a, "ef"); err != nil {
+		t.Errorf("Colliding name got %v\n", err)
+	}
+	if err := name(b, "ef"); err != EUNIQUE {
+		t.Errorf("Took a used name: %v\n", err)
+	}
+}
+
+func TestItemLists(t *testing.T) {
+	s := NewStore()
+	s.CreateKey(ItemKey(1), &Item{ID: 1, Categ: 2, Region: 3, Startdate: 10}, WRITE)
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	tx := c.Workers[0].E
+	tx.Reset()
+	tx.Write(ItemKey(2), &Item{ID: 2, Categ: 2, Region: 4, Startdate: 20}, WRITE)
+	// Rewriting an item doesn't list it again
+	tx.Write(ItemKey(1), &Item{ID: 1, Categ: 2, Region: 3, Startdate: 10, Qty: 1}, WRITE)
+	if tx.Commit() == 0 {
+		t.Fatalf("Commit failed\n")
+	}
+	tx.Reset()
+	br, err := tx.Read(ItemsByCatKey(2))
+	if err != nil || len(br.entries) != 2 || br.entries[0].top != 2 || br.entries[1].top != 1 {
+		t.Errorf("Category list %v %v\n", br, err)
+	}
+	br, err = tx.Read(ItemsByRegKey(3, 2))
+	if err != nil || len(br.entries) != 1 || br.entries[0].top != 1 {
+		t.Errorf("Region list %v %v\n", br, err)
+	}
+	tx.Commit()
+}
+
+func TestSet(t *testing.T) {
+	s := NewStore()
+	a, b, c := UserKey(1), UserKey(2), UserKey(3)
+	s.CreateKey(ProductKey(1), a, SET)
+	co := NewCoordinator(1, s)
+	tx := co.Workers[0].E
+	tx.Reset()
+	tx.Write(ProductKey(1), c, SET)
+	tx.Write(ProductKey(1), b, SET)
+	tx.Write(ProductKey(1), Removal{a}, SET)
+	tx.Write(ProductKey(2), MakeBitmap(1), BITMAP)
+	tx.Write(ProductKey(2), MakeBitmap(9), BITMAP)
+	if err := tx.Write(ProductKey(1), "x", SET); err != ETYPE {
+		t.Errorf("Wrote a string to a SET: %v\n", err)
+	}
+	if err := tx.Write(ProductKey(2), "x", BITMAP); err != ETYPE {
+		t.Errorf("Wrote a string to a BITMAP: %v\n", err)
+	}
+	br, err := tx.Read(ProductKey(1))
+	if err != nil || fmt.Sprint(br.Members()) != fmt.Sprint([]Key{b, c}) {
+		t.Errorf("Read own SET got %v %v\n", br, err)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+	tx.Reset()
+	br, err = tx.Read(ProductKey(1))
+	if err != nil || !br.IsMember(b) || !br.IsMember(c) || br.IsMember(a) {
+		t.Errorf("SET got %v %v\n", br.Members(), err)
+	}
+	br, err = tx.Read(ProductKey(2))
+	if err != nil || !bytes.Equal(br.Bitmap(), MakeBitmap(1, 9)) {
+		t.Errorf("BITMAP got %v %v\n", br.Bitmap(), err)
+	}
+	tx.Commit()
+	co.Finish()
+
+	if *SysType != DOPPEL {
+		return
+	}
+	*AlwaysSplit = true
+	defer func() { *AlwaysSplit = false }()
+	w := co.Workers[0]
+	otx := StartOTransaction(w)
+	otx.SetPhase(SPLIT)
+	otx.Reset()
+	if err := otx.Write(ProductKey(1), Removal{b}, SET); err != ESTASH {
+		t.Errorf("Removing from a split SET got %v\n", err)
+	}
+	otx.Abort()
+	otx.Reset()
+	otx.Write(ProductKey(1), a, SET)
+	otx.Write(ProductKey(1), c, SET)
+	otx.Write(ProductKey(2), MakeBitmap(20), BITMAP)
+	if otx.Commit() == 0 {
+		t.Fatalf("Abort in split phase\n")
+	}
+	if len(w.local_store.sets[ProductKey(1)]) != 2 {
+		t.Errorf("Local store got %v\n", w.local_store.sets[ProductKey(1)])
+	}
+	w.local_store.Merge()
+	br, _ = s.getKey(ProductKey(1), nil)
+	if fmt.Sprint(br.Members()) != fmt.Sprint([]Key{a, b, c}) {
+		t.Errorf("SET after merge got %v\n", br.Members())
+	}
+	br, _ = s.getKey(ProductKey(2), nil)
+	if !bytes.Equal(br.Bitmap(), MakeBitmap(1, 9, 20)) {
+		t.Errorf("BITMAP after merge got %v\n", br.Bitmap())
+	}
+}
+
+func TestHLL(t *testing.T) {
+	regs := hllCopy(nil)
+	for _, n := range []int{10, 1000, 100000} {
+		for i := 0; i < n; i++ {
+			hllAdd(regs, UserKey(uint64(i)))
+		}
+		// Adding them again changes nothing
+		for i := 0; i < n; i++ {
+			hllAdd(regs, UserKey(uint64(i)))
+		}
+		if e := float64(hllEstimate(regs)); e < float64(n)*0.95 || e > float64(n)*1.05 {
+			t.Errorf("Estimated %v for %v\n", e, n)
+		}
+	}
+
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	tx := c.Workers[0].E
+	tx.Reset()
+	for i := 0; i < 100; i++ {
+		tx.Write(ProductKey(1), UserKey(uint64(i%50)), HLL)
+	}
+	if err := tx.Write(ProductKey(1), 7, HLL); err != ETYPE {
+		t.Errorf("Wrote an int to an HLL: %v\n", err)
+	}
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+	tx.Reset()
+	br, err := tx.Read(ProductKey(1))
+	if err != nil {
+		t.Fatalf("Read HLL got %v\n", err)
+	}
+	if x := br.Value().(uint64); x < 49 || x > 51 {
+		t.Errorf("HLL got %v\n", x)
+	}
+	tx.Commit()
+	c.Finish()
+
+	if *SysType != DOPPEL {
+		return
+	}
+	*AlwaysSplit = true
+	defer func() { *AlwaysSplit = false }()
+	w := c.Workers[0]
+	otx := StartOTransaction(w)
+	otx.SetPhase(SPLIT)
+	otx.Reset()
+	for i := 25; i < 75; i++ {
+		otx.Write(ProductKey(1), UserKey(uint64(i)), HLL)
+	}
+	if otx.Commit() == 0 {
+		t.Fatalf("Abort in split phase\n")
+	}
+	w.local_store.Merge()
+	br, _ = s.getKey(ProductKey(1), nil)
+	// Approximately the union
+	if x := br.Estimate(); x < 73 || x > 77 {
+		t.Errorf("HLL after merge got %v\n", br.Estimate())
+	}
+}
@@ -151,11 +151,11 @@ func main() {
 					t.W = make(chan struct {
 						R *ddtxn.Result
 						E error
-					})
+					}, 1)
 				}
 				committed := false
 				_, err := w.One(t)
-				if err == ddtxn.ESTASH {
+				if err == ddtxn.ESTASH || err == ddtxn.EPENDING {
 					if *doValidate {
 						x := <-t.W
 						err = x.E
@@ -77,16 +77,17 @@ func main() {
 			// w.One(), and if we're actually reading from t later
 			// we pause and don't re-write it until it's done.
 			var t ddtxn.Query
+			var args apps.ArgBuf[ddtxn.BigArgs]
 			for duration.After(time.Now()) {
-				big_app.MakeOne(w.ID, &local_seed, &t)
+				big_app.MakeOne(w.ID, &local_seed, &args, &t)
 				if *apps.Latency || *doValidate {
 					t.W = make(chan struct {
 						R *ddtxn.Result
 						E error
-					})
+					}, 1)
 					txn_start := time.Now()
 					_, err := w.One(t)
-					if err == ddtxn.ESTASH {
+					if err == ddtxn.ESTASH || err == ddtxn.EPENDING {
 						x := <-t.W
 						err = x.E
 					}
@@ -99,8 +100,9 @@ func main() {
 							big_app.Add(t)
 						}
 					}
-				} else {
-					w.One(t)
+				} else if _, err := w.One(t); err == ddtxn.ESTASH {
+					// The worker still has t
+					args.Keep(t)
 				}
 			}
 			wg.Done()
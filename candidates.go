@@ -4,8 +4,8 @@ import (
 	"container/heap"
 	"flag"
 	"fmt"
-	"log"
-	"runtime/debug"
+
+	"github.com/narula/ddtxn/dlog"
 )
 
 var WRRatio = flag.Float64("wr", 2.0, "Ratio of sampled write conflicts and sampled writes to sampled reads at which to move a piece of data to split.  Default 3")
@@ -84,8 +84,11 @@ func (c *Candidates) Write(k Key, br *BRecord, op KeyType) {
 			o.op = op
 		}
 		if op != o.op {
-			debug.PrintStack()
-			log.Fatalf("Do not support multiple types of writes right now key %v, op write: %v op was: %v\n", k, op, o.op)
+			// Only keys written with one kind of op can be split;
+			// count this as a read, which argues against it.
+			dlog.Printf("Multiple types of writes to key %v, op write: %v op was: %v\n", k, op, o.op)
+			o.reads++
+			return
 		}
 		o.writes++
 	}
@@ -104,8 +107,9 @@ func (c *Candidates) Conflict(k Key, br *BRecord, op KeyType) {
 			o.op = op
 		}
 		if op != o.op {
-			debug.PrintStack()
-			log.Fatalf("Do not support multiple types of writes right now key %v, op conflict: %v op was: %v\n", k, op, o.op)
+			dlog.Printf("Multiple types of writes to key %v, op conflict: %v op was: %v\n", k, op, o.op)
+			o.reads++
+			return
 		}
 		o.conflicts++
 	}
@@ -134,7 +138,7 @@ func (c *Candidates) ReadWrite(k Key, br *BRecord) {
 		o.reads = o.reads + 10
 		o.conflicts = o.conflicts - 1
 	}
-	if o.ratio() > *WRRatio || o.index > -1 || br.dd {
+	if o.ratio() > *WRRatio || o.index > -1 || (br != nil && br.dd) {
 		c.h.update(o)
 	}
 }
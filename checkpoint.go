@@ -0,0 +1,312 @@
+package ddtxn
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var CheckpointInterval = flag.Int("ckptms", 0, "Milliseconds between checkpoints into -logdir.  0 means only on request\n")
+
+const (
+	CKPT_HEADER = 24 // epoch, tid, nrecords
+)
+
+var (
+	ENOLOGDIR = errors.New("doppel: checkpoints need -logdir")
+	ECKPTBUSY = errors.New("doppel: checkpoint already in progress")
+)
+
+// A checkpoint holds every record in the store as of the start of an
+// epoch: all transactions from earlier epochs and none from that
+// epoch or later.  It is written to a temporary file and renamed into
+// place, so a checkpoint that exists is complete.  Format:
+//
+//	epoch uint64, tid uint64, nrecords uint64,
+//	nrecords x (length uint32, crc32 uint32, key [16]byte, type uint8,
+//	            int32, value, nentries uint32, nentries x entry)
+//
+// tid is at least as big as any TID committed before epoch.  Values
+// are encoded with AppendValue() and entries as in the redo log.
+func CheckpointFileName(dir string, epoch TID) string {
+	return filepath.Join(dir, fmt.Sprintf("checkpoint-%016x", uint64(epoch)))
+}
+
+// The most recent complete checkpoint in dir, or "" if there isn't
+// one.
+func latestCheckpoint(dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "checkpoint-*"))
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, f := range files {
+		if strings.HasSuffix(f, ".tmp") {
+			continue
+		}
+		if f > latest {
+			latest = f
+		}
+	}
+	return latest, nil
+}
+
+// Checkpoint the store and wait for the checkpoint to be on disk.
+// Workers keep running while it is written.
+func (c *Coordinator) Checkpoint() error {
+	x := make(chan error, 1)
+	c.ckreq <- x
+	return <-x
+}
+
+// Start a checkpoint at the next epoch boundary; the contents are
+// written in the background and the result sent on done.  Called from
+// Process().
+func (c *Coordinator) checkpoint(done chan error) {
+	s := c.Workers[0].store
+	if *LogDir == "" || atomic.LoadInt32(&s.ckactive) == 1 {
+		if done != nil {
+			if *LogDir == "" {
+				done <- ENOLOGDIR
+			} else {
+				done <- ECKPTBUSY
+			}
+		}
+		return
+	}
+	c.ckdone = done
+	if *SysType == DOPPEL {
+		// IncrementEpoch() calls snapshot() once everyone has
+		// merged.
+		c.ckpending = true
+		c.IncrementEpoch(true)
+		return
+	}
+	c.cut(c.snapshot)
+}
+
+// Start writing a checkpoint for epoch e.  Workers must be stopped
+// between epochs, with nothing from e or later committed yet.
+func (c *Coordinator) snapshot(e TID) {
+	s := c.Workers[0].store
+	g := s.beginSnapshot()
+	var tid TID
+	rotated := &sync.WaitGroup{}
+	for i := 0; i < c.n; i++ {
+		w := c.Workers[i]
+		if x := w.commitTID(); x > tid {
+			tid = x
+		}
+		// Later epochs go in a new log segment, so the old ones
+		// can be deleted once this checkpoint is done.
+		if w.rlog != nil {
+			rotated.Add(1)
+			w.rotate = rotated
+		}
+	}
+	done := c.ckdone
+	c.ckdone = nil
+	c.ckwg.Add(1)
+	go func() {
+		defer c.ckwg.Done()
+		err := s.writeCheckpoint(*LogDir, g, e, tid)
+		if err == nil {
+			rotated.Wait()
+			err = removeBefore(*LogDir, e)
+		}
+		if done != nil {
+			done <- err
+		} else if err != nil {
+			log.Printf("Checkpoint for epoch %v failed: %v\n", e, err)
+		}
+	}()
+}
+
+// Write checkpoint generation g, which started at epoch.
+func (s *Store) writeCheckpoint(dir string, g uint64, epoch TID, tid TID) error {
+	defer s.endSnapshot()
+	buf := make([]byte, CKPT_HEADER, 4096)
+	n := uint64(0)
+	var err error
+	s.each(func(br *BRecord) {
+		st := br.snapshotState(g)
+		if err != nil || st == nil || !st.exists {
+			return
+		}
+		v := st.value
+		if isWide(st.key_type) {
+			v = value64(st.key_type, st.value64)
+		}
+		buf, err = appendRecordState(buf, br.key, st.key_type, st.int_value, v, st.entries)
+		n++
+	})
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(buf[0:], uint64(epoch))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(tid))
+	binary.LittleEndian.PutUint64(buf[16:], n)
+	return writeFileSync(CheckpointFileName(dir, epoch), buf)
+}
+
+// Delete log segments and checkpoints that the checkpoint for epoch
+// makes unnecessary.
+func removeBefore(dir string, epoch TID) error {
+	files, err := filepath.Glob(filepath.Join(dir, "worker-*-*.log"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		var id int
+		var e uint64
+		if _, err := fmt.Sscanf(filepath.Base(f), "worker-%d-%x.log", &id, &e); err != nil {
+			continue
+		}
+		if TID(e) <= epoch {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	files, err = filepath.Glob(filepath.Join(dir, "checkpoint-*"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f < CheckpointFileName(dir, epoch) {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func appendRecordState(buf []byte, k Key, kt KeyType, a int32, v Value, entries []Entry) ([]byte, error) {
+	start := len(buf)
+	buf = binary.LittleEndian.AppendUint64(buf, 0)
+	buf = append(buf, k[:]...)
+	buf = append(buf, byte(kt))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(a))
+	buf, err := AppendValue(buf, v)
+	if err != nil {
+		return buf, err
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entries)))
+	for i := range entries {
+		buf = appendEntry(buf, entries[i])
+	}
+	body := buf[start+LOG_HEADER:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(body))
+	return buf, nil
+}
+
+// Write to a temporary file, fsync, and rename into place.
+func writeFileSync(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	// Make the rename durable.
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Load the checkpoint in file into s, which should be empty.  Returns
+// the checkpoint's epoch and TID.
+func (s *Store) loadCheckpoint(file string) (TID, TID, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) < CKPT_HEADER {
+		return 0, 0, fmt.Errorf("doppel: checkpoint %v too short", file)
+	}
+	epoch := TID(binary.LittleEndian.Uint64(b[0:]))
+	tid := TID(binary.LittleEndian.Uint64(b[8:]))
+	n := binary.LittleEndian.Uint64(b[16:])
+	b = b[CKPT_HEADER:]
+	for i := uint64(0); i < n; i++ {
+		br, sz, err := readRecordState(b)
+		if err != nil {
+			return 0, 0, fmt.Errorf("doppel: checkpoint %v record %v: %v", file, i, err)
+		}
+		x := s.CreateKey(br.key, nil, br.key_type)
+		x.int_value = br.int_value
+		if isWide(br.key_type) {
+			x.value64 = bits64(br.value)
+		} else {
+			x.value = br.value
+		}
+		x.entries = br.entries
+		b = b[sz:]
+	}
+	return epoch, tid, nil
+}
+
+func readRecordState(b []byte) (*BRecord, int, error) {
+	if len(b) < LOG_HEADER {
+		return nil, 0, ETORN
+	}
+	n := int(binary.LittleEndian.Uint32(b[0:]))
+	if len(b)-LOG_HEADER < n {
+		return nil, 0, ETORN
+	}
+	body := b[LOG_HEADER : LOG_HEADER+n]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[4:]) {
+		return nil, 0, ETORN
+	}
+	br := &BRecord{}
+	if len(body) < len(br.key)+5 {
+		return nil, 0, ETORN
+	}
+	copy(br.key[:], body)
+	br.key_type = KeyType(body[len(br.key)])
+	br.int_value = int32(binary.LittleEndian.Uint32(body[len(br.key)+1:]))
+	var err error
+	br.value, body, err = ReadValue(body[len(br.key)+5:])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) < 4 {
+		return nil, 0, ETORN
+	}
+	ne := int(binary.LittleEndian.Uint32(body))
+	body = body[4:]
+	br.entries = make([]Entry, ne)
+	for i := 0; i < ne; i++ {
+		if body, err = readEntry(body, &br.entries[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return br, LOG_HEADER + n, nil
+}
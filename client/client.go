@@ -0,0 +1,242 @@
+// Package client calls transactions on a Doppel server.  A Client
+// keeps a pool of connections; the server hands each connection to a
+// different worker, so a pool at least as big as the number of server
+// workers spreads calls across all of them.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/narula/ddtxn"
+	"github.com/narula/ddtxn/wire"
+)
+
+const (
+	BACKOFF_STEPS = 30 // as in the benchmarks' MakeExp(30)
+)
+
+var ECLOSED = errors.New("client: connection closed")
+
+type Client struct {
+	addr   string
+	mu     sync.Mutex
+	conns  []*conn
+	closed bool
+	next   uint32
+	exp    *ddtxn.Exp2
+}
+
+type conn struct {
+	mu      sync.Mutex
+	nc      net.Conn
+	wr      *bufio.Writer
+	next    uint64
+	pending map[uint64]chan *wire.Response
+	err     error
+}
+
+// Connect to the server at addr with n connections.
+func Dial(addr string, n int) (*Client, error) {
+	c := &Client{
+		addr:  addr,
+		conns: make([]*conn, n),
+		exp:   ddtxn.MakeExp(BACKOFF_STEPS),
+	}
+	for i := range c.conns {
+		x, err := dial(addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns[i] = x
+	}
+	return c, nil
+}
+
+// Close every connection.  Calls after this return ECLOSED.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, x := range c.conns {
+		if x != nil {
+			x.close(ECLOSED)
+		}
+	}
+	return nil
+}
+
+// Run transaction txn with arguments args (e.g. *ddtxn.BuyArgs).  Aborted attempts are
+// retried after a randomized exponential backoff until one commits or
+// ctx is done; ENORETRY and other errors come straight back.
+//
+// A request that couldn't be sent is sent once more on a new
+// connection.  If the connection drops after the request went out,
+// Call returns the connection's error without retrying, since the
+// transaction may have committed; the next call redials.
+func (c *Client) Call(ctx context.Context, txn string, args interface{}) (*ddtxn.Result, error) {
+	seed := rand.Uint32()
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r, err := c.call(ctx, txn, args)
+		if err != ddtxn.EABORT {
+			return r, err
+		}
+		n := i
+		if n >= BACKOFF_STEPS {
+			n = BACKOFF_STEPS - 1
+		}
+		d := time.Duration(ddtxn.RandN(&seed, c.exp.Exp(n))) * time.Microsecond
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// One attempt, on the next connection in the pool.  A broken
+// connection is replaced.
+func (c *Client) call(ctx context.Context, txn string, args interface{}) (*ddtxn.Result, error) {
+	i := int(atomic.AddUint32(&c.next, 1)) % len(c.conns)
+	c.mu.Lock()
+	x, closed := c.conns[i], c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ECLOSED
+	}
+	id, ch, err := x.send(txn, args)
+	if err != nil {
+		if !x.broken() {
+			return nil, err
+		}
+		if x, err = c.redial(i, x); err != nil {
+			return nil, err
+		}
+		if id, ch, err = x.send(txn, args); err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case r := <-ch:
+		return r.R, r.Err
+	case <-ctx.Done():
+		x.mu.Lock()
+		delete(x.pending, id)
+		x.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Replace broken connection x in slot i, unless someone else already
+// has or c is closed.
+func (c *Client) redial(i int, x *conn) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ECLOSED
+	}
+	if c.conns[i] != x {
+		return c.conns[i], nil
+	}
+	y, err := dial(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[i] = y
+	return y, nil
+}
+
+func dial(addr string) (*conn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	x := &conn{
+		nc:      nc,
+		wr:      bufio.NewWriter(nc),
+		pending: make(map[uint64]chan *wire.Response),
+	}
+	go x.read()
+	return x, nil
+}
+
+func (x *conn) send(txn string, args interface{}) (uint64, chan *wire.Response, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.err != nil {
+		return 0, nil, x.err
+	}
+	x.next++
+	id := x.next
+	ch := make(chan *wire.Response, 1)
+	x.pending[id] = ch
+	err := wire.WriteRequest(x.wr, &wire.Request{ID: id, Txn: txn, Args: args})
+	if err == nil {
+		err = x.wr.Flush()
+	}
+	if err != nil {
+		delete(x.pending, id)
+		// Arguments that can't be encoded are never written, and
+		// leave the connection usable.
+		if x.wr.Flush() != nil {
+			x.fail(err)
+		}
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+func (x *conn) broken() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.err != nil
+}
+
+func (x *conn) read() {
+	rd := bufio.NewReader(x.nc)
+	for {
+		r := &wire.Response{}
+		if err := wire.ReadResponse(rd, r); err != nil {
+			x.close(err)
+			return
+		}
+		x.mu.Lock()
+		ch, ok := x.pending[r.ID]
+		delete(x.pending, r.ID)
+		x.mu.Unlock()
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+func (x *conn) close(err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fail(err)
+}
+
+// Close x and fail everything waiting on it.  Needs x.mu.
+func (x *conn) fail(err error) {
+	if x.err != nil {
+		return
+	}
+	x.err = err
+	x.nc.Close()
+	for id, ch := range x.pending {
+		ch <- &wire.Response{ID: id, Err: err}
+		delete(x.pending, id)
+	}
+}
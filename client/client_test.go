@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/narula/ddtxn"
+	"github.com/narula/ddtxn/server"
+)
+
+func startServer(t *testing.T, nw int) (*ddtxn.Coordinator, *ddtxn.Store, *server.Server, string) {
+	s := ddtxn.NewStore()
+	coord := ddtxn.NewCoordinator(nw, s)
+	srv := server.New(coord)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	go srv.Serve(ln)
+	return coord, s, srv, ln.Addr().String()
+}
+
+func TestCall(t *testing.T) {
+	coord, s, srv, addr := startServer(t, 2)
+	defer coord.Finish()
+	defer srv.Close()
+	s.CreateKey(ddtxn.ProductKey(4), int32(0), ddtxn.SUM)
+
+	c, err := Dial(addr, 4)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer c.Close()
+
+	// Everyone hammers the same key, so some attempts abort and get
+	// retried.
+	var wg sync.WaitGroup
+	n := 8
+	per := 50
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < per; j++ {
+				a := &ddtxn.BuyArgs{User: ddtxn.UserKey(uint64(i)), Product: ddtxn.ProductKey(4), Amount: 1}
+				if _, err := c.Call(context.Background(), "buy", a); err != nil {
+					t.Errorf("Buy %v\n", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	r, err := c.Call(context.Background(), "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)})
+	if err != nil || r == nil || r.V.(int32) != int32(n*per) {
+		t.Errorf("Read got %v %v; expected %v\n", r, err, n*per)
+	}
+
+	// No user, so this can never succeed
+	_, err = c.Call(context.Background(), "rubis_buynow", &ddtxn.BuyNowArgs{User: 1000, Item: 2, Qty: 1})
+	if err != ddtxn.ENORETRY {
+		t.Errorf("Expected ENORETRY, got %v\n", err)
+	}
+	if _, err := c.Call(context.Background(), "nope", nil); err != ddtxn.EUNKNOWNTXN {
+		t.Errorf("Expected EUNKNOWNTXN, got %v\n", err)
+	}
+	if _, err := c.Call(context.Background(), "buy", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}); err != ddtxn.EARGS {
+		t.Errorf("Expected EARGS, got %v\n", err)
+	}
+	// Can't be encoded; the connection should still work after.
+	if _, err := c.Call(context.Background(), "buy", make(chan int)); err == nil {
+		t.Errorf("Sent a channel\n")
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := c.Call(ctx, "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v\n", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	coord, s, srv, addr := startServer(t, 1)
+	defer coord.Finish()
+	s.CreateKey(ddtxn.ProductKey(4), int32(0), ddtxn.SUM)
+
+	c, err := Dial(addr, 1)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer c.Close()
+	if _, err := c.Call(context.Background(), "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}); err != nil {
+		t.Fatalf("Read got %v\n", err)
+	}
+	old := c.conns[0]
+	srv.Close()
+
+	// The old connection is dead and so is the server.
+	if _, err := c.Call(context.Background(), "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}); err == nil {
+		t.Errorf("Call to closed server succeeded\n")
+	}
+
+	// Once the server is back, the next call redials.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	srv = server.New(coord)
+	go srv.Serve(ln)
+	defer srv.Close()
+	r, err := c.Call(context.Background(), "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)})
+	if err != nil || r == nil || r.V.(int32) != 0 {
+		t.Errorf("Read after restart got %v %v\n", r, err)
+	}
+	if c.conns[0] == old {
+		t.Errorf("Broken connection not replaced\n")
+	}
+}
+
+func TestClose(t *testing.T) {
+	coord, _, srv, addr := startServer(t, 1)
+	defer coord.Finish()
+	defer srv.Close()
+
+	c, err := Dial(addr, 2)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	old := c.conns[0]
+	c.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := c.Call(context.Background(), "read_one", &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}); err != ECLOSED {
+			t.Errorf("Call after Close got %v\n", err)
+		}
+	}
+	if c.conns[0] != old {
+		t.Errorf("Redialed after Close\n")
+	}
+}
@@ -0,0 +1,345 @@
+package ddtxn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+)
+
+// A Codec turns values of one type into bytes and back.  Encode
+// appends v to buf.
+type Codec interface {
+	Encode(buf []byte, v Value) ([]byte, error)
+	Decode(b []byte) (Value, error)
+}
+
+// Every encoded value starts with a tag saying which codec wrote it.
+// Tags below FIRST_APP_TAG are reserved.
+const (
+	TAG_NIL = iota
+	TAG_GOB // types without a registered codec
+	TAG_STRING
+	TAG_BYTES
+	TAG_INT
+	TAG_INT32
+	TAG_INT64
+	TAG_UINT64
+	TAG_FLOAT64
+	TAG_BOOL
+	TAG_USER
+	TAG_ITEM
+	TAG_BID
+	TAG_BUYNOW
+	TAG_COMMENT
+	TAG_BUY_ARGS
+	TAG_KEY_ARGS
+	TAG_TWO_KEY_ARGS
+	TAG_BIG_ARGS
+	TAG_REGISTER_USER_ARGS
+	TAG_NEW_ITEM_ARGS
+	TAG_BID_ARGS
+	TAG_COMMENT_ARGS
+	TAG_BUYNOW_ARGS
+	TAG_PUT_COMMENT_ARGS
+	TAG_SEARCH_ARGS
+	TAG_ITEM_ARGS
+	TAG_USER_ARGS
+	TAG_KEY
+
+	FIRST_APP_TAG = 64
+)
+
+var (
+	ECODEC = errors.New("doppel: value does not match its codec")
+	ETAG   = errors.New("doppel: unknown value tag")
+)
+
+type codecEntry struct {
+	tag uint16
+	c   Codec
+}
+
+var codecsByType = make(map[reflect.Type]*codecEntry)
+var codecsByTag = make(map[uint16]*codecEntry)
+
+func init() {
+	RegisterValue(TAG_STRING, "")
+	RegisterValue(TAG_BYTES, []byte{})
+	RegisterValue(TAG_INT, int(0))
+	RegisterValue(TAG_INT32, int32(0))
+	RegisterValue(TAG_INT64, int64(0))
+	RegisterValue(TAG_UINT64, uint64(0))
+	RegisterValue(TAG_FLOAT64, float64(0))
+	RegisterValue(TAG_BOOL, false)
+	RegisterValue(TAG_KEY, Key{})
+}
+
+// Use c for values with the same type as example.  Registration is
+// not safe to do concurrently with encoding; do it in init().
+func RegisterCodec(tag uint16, example Value, c Codec) {
+	t := reflect.TypeOf(example)
+	if tag == TAG_NIL || tag == TAG_GOB {
+		log.Fatalf("Tag %v is reserved\n", tag)
+	}
+	if _, ok := codecsByTag[tag]; ok {
+		log.Fatalf("Tag %v already registered\n", tag)
+	}
+	if _, ok := codecsByType[t]; ok {
+		log.Fatalf("Type %v already registered\n", t)
+	}
+	e := &codecEntry{tag, c}
+	codecsByTag[tag] = e
+	codecsByType[t] = e
+}
+
+// Use the compact binary codec for values with the same type as
+// example.  It handles booleans, numbers, strings, byte slices,
+// arrays, and structs (or pointers to structs) made of those with
+// exported fields.
+func RegisterValue(tag uint16, example Value) {
+	t := reflect.TypeOf(example)
+	c := &binaryCodec{t: t}
+	if t.Kind() == reflect.Ptr {
+		c.ptr = true
+		t = t.Elem()
+	}
+	if err := checkBinary(t); err != nil {
+		log.Fatalf("Cannot register %v: %v\n", reflect.TypeOf(example), err)
+	}
+	RegisterCodec(tag, example, c)
+}
+
+// Append v's tag, length and encoding to buf.  Values of types with
+// no registered codec are gob-encoded; decoding those needs the type
+// to have been passed to gob.Register().
+func AppendValue(buf []byte, v Value) ([]byte, error) {
+	if v == nil {
+		return binary.LittleEndian.AppendUint16(buf, TAG_NIL), nil
+	}
+	tag := uint16(TAG_GOB)
+	var c Codec = gobCodec{}
+	if e, ok := codecsByType[reflect.TypeOf(v)]; ok {
+		tag, c = e.tag, e.c
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, tag)
+	start := len(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	buf, err := c.Encode(buf, v)
+	if err != nil {
+		return buf[:start-2], err
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf, nil
+}
+
+// Read a value written by AppendValue() from the start of b.  Returns
+// the value and the rest of b.
+func ReadValue(b []byte) (Value, []byte, error) {
+	if len(b) < 2 {
+		return nil, b, ETORN
+	}
+	tag := binary.LittleEndian.Uint16(b)
+	b = b[2:]
+	if tag == TAG_NIL {
+		return nil, b, nil
+	}
+	if len(b) < 4 {
+		return nil, b, ETORN
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	if len(b) < n {
+		return nil, b, ETORN
+	}
+	var c Codec = gobCodec{}
+	if tag != TAG_GOB {
+		e, ok := codecsByTag[tag]
+		if !ok {
+			return nil, b, ETAG
+		}
+		c = e.c
+	}
+	v, err := c.Decode(b[:n])
+	return v, b[n:], err
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(buf []byte, v Value) ([]byte, error) {
+	w := bytes.NewBuffer(buf)
+	err := gob.NewEncoder(w).Encode(&v)
+	return w.Bytes(), err
+}
+
+func (gobCodec) Decode(b []byte) (Value, error) {
+	var v Value
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+type binaryCodec struct {
+	t   reflect.Type
+	ptr bool
+}
+
+func checkBinary(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	case reflect.Array:
+		return checkBinary(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				return fmt.Errorf("unexported field %v", f.Name)
+			}
+			if err := checkBinary(f.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported type %v", t)
+}
+
+func (c *binaryCodec) Encode(buf []byte, v Value) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Type() != c.t {
+		return buf, ECODEC
+	}
+	if c.ptr {
+		if rv.IsNil() {
+			return buf, ECODEC
+		}
+		rv = rv.Elem()
+	}
+	return appendBinary(buf, rv), nil
+}
+
+func (c *binaryCodec) Decode(b []byte) (Value, error) {
+	t := c.t
+	if c.ptr {
+		t = t.Elem()
+	}
+	rv := reflect.New(t)
+	if _, err := readBinary(b, rv.Elem()); err != nil {
+		return nil, err
+	}
+	if c.ptr {
+		return rv.Interface(), nil
+	}
+	return rv.Elem().Interface(), nil
+}
+
+func appendBinary(buf []byte, rv reflect.Value) []byte {
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(buf, rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(rv.Float()))
+	case reflect.String:
+		buf = binary.AppendUvarint(buf, uint64(rv.Len()))
+		return append(buf, rv.String()...)
+	case reflect.Slice:
+		buf = binary.AppendUvarint(buf, uint64(rv.Len()))
+		return append(buf, rv.Bytes()...)
+	case reflect.Array:
+		// Fixed length, so no length prefix; byte arrays (keys)
+		// go as is.
+		for i := 0; i < rv.Len(); i++ {
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				buf = append(buf, byte(rv.Index(i).Uint()))
+			} else {
+				buf = appendBinary(buf, rv.Index(i))
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			buf = appendBinary(buf, rv.Field(i))
+		}
+	}
+	return buf
+}
+
+func readBinary(b []byte, rv reflect.Value) ([]byte, error) {
+	switch rv.Kind() {
+	case reflect.Bool:
+		if len(b) < 1 {
+			return b, ETORN
+		}
+		rv.SetBool(b[0] != 0)
+		return b[1:], nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(b)
+		if n <= 0 {
+			return b, ETORN
+		}
+		rv.SetInt(x)
+		return b[n:], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			return b, ETORN
+		}
+		rv.SetUint(x)
+		return b[n:], nil
+	case reflect.Float32, reflect.Float64:
+		if len(b) < 8 {
+			return b, ETORN
+		}
+		rv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		return b[8:], nil
+	case reflect.String, reflect.Slice:
+		x, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < x {
+			return b, ETORN
+		}
+		b = b[n:]
+		if rv.Kind() == reflect.String {
+			rv.SetString(string(b[:x]))
+		} else {
+			rv.SetBytes(append([]byte{}, b[:x]...))
+		}
+		return b[x:], nil
+	case reflect.Array:
+		var err error
+		for i := 0; i < rv.Len(); i++ {
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				if len(b) < 1 {
+					return b, ETORN
+				}
+				rv.Index(i).SetUint(uint64(b[0]))
+				b = b[1:]
+			} else if b, err = readBinary(b, rv.Index(i)); err != nil {
+				return b, err
+			}
+		}
+	case reflect.Struct:
+		var err error
+		for i := 0; i < rv.NumField(); i++ {
+			if b, err = readBinary(b, rv.Field(i)); err != nil {
+				return b, err
+			}
+		}
+	}
+	return b, nil
+}
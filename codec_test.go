@@ -0,0 +1,60 @@
+package ddtxn
+
+import (
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+type gobOnly struct {
+	A map[string]int
+}
+
+func TestValueCodecs(t *testing.T) {
+	gob.Register(&gobOnly{})
+	vals := []Value{
+		nil,
+		"hello",
+		[]byte{1, 2, 3},
+		int(-7),
+		int32(42),
+		uint64(1 << 40),
+		3.5,
+		true,
+		&User{ID: 1, Name: "a", Nickname: "b", Rating: 2, Region: 3},
+		&Item{ID: 5, Seller: 1, Qty: 10, Startdate: -1, Name: "thing", Desc: "a thing", Buynow: 7},
+		&Bid{ID: 9, Item: 5, Bidder: 1, Price: 100},
+		&BuyNow{BuyerID: 1, ItemID: 5, Qty: 2, Date: 3},
+		&Comment{ID: 2, From: 1, To: 3, Rating: 4, Item: 5, Comment: "great"},
+		&gobOnly{map[string]int{"x": 1}},
+	}
+	var buf []byte
+	var err error
+	for _, v := range vals {
+		buf, err = AppendValue(buf, v)
+		if err != nil {
+			t.Fatalf("Encoding %v: %v\n", v, err)
+		}
+	}
+	b := buf
+	for _, v := range vals {
+		var x Value
+		x, b, err = ReadValue(b)
+		if err != nil {
+			t.Fatalf("Decoding %v: %v\n", v, err)
+		}
+		if !reflect.DeepEqual(x, v) {
+			t.Errorf("Got %v back, expected %v\n", x, v)
+		}
+	}
+	if len(b) != 0 {
+		t.Errorf("%v bytes left over\n", len(b))
+	}
+	if _, _, err := ReadValue(buf[:len(buf)-1]); err != nil {
+		t.Errorf("First value should still decode: %v\n", err)
+	}
+	bad := []byte{200, 0, 0, 0, 0, 0}
+	if _, _, err := ReadValue(bad); err != ETAG {
+		t.Errorf("Expected ETAG, got %v\n", err)
+	}
+}
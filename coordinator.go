@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -43,6 +45,11 @@ type Coordinator struct {
 	PotentialPhaseChanges int64
 	Done                  chan chan bool
 	Accelerate            chan bool
+	logger                *GroupLogger
+	ckreq                 chan chan error
+	ckpending             bool
+	ckdone                chan error
+	ckwg                  sync.WaitGroup
 	trigger               int32
 	to_remove             map[Key]bool
 
@@ -65,11 +72,26 @@ func NewCoordinator(n int, s *Store) *Coordinator {
 		wdone:                 make([]chan TID, n),
 		Done:                  make(chan chan bool),
 		Accelerate:            make(chan bool),
+		ckreq:                 make(chan chan error),
 		Coordinate:            false,
 		PotentialPhaseChanges: 0,
 		to_remove:             make(map[Key]bool),
 		Finished:              make([]bool, n),
 	}
+	if uint64(s.recoveredEpoch) >= c.epochTID {
+		c.epochTID = uint64(s.recoveredEpoch + EPOCH_INCR)
+	}
+	if e := atomic.LoadUint64(&s.snapepoch); e >= c.epochTID {
+		c.epochTID = e + EPOCH_INCR
+	}
+	s.setSnapshot(TID(c.epochTID))
+	if GroupCommit() {
+		c.logger = NewGroupLogger(*LogDir, n)
+	} else if *LogDir != "" {
+		// Every record we write is good; don't let recovery cut
+		// them off at an old group commit watermark.
+		os.Remove(DurableFileName(*LogDir))
+	}
 	for i := 0; i < n; i++ {
 		c.wepoch[i] = make(chan TID)
 		c.wsafe[i] = make(chan TID)
@@ -97,6 +119,16 @@ func (c *Coordinator) GetEpoch() TID {
 	return TID(x)
 }
 
+// Every transaction committed in this epoch or an earlier one is on
+// disk.  Without group commit transactions are durable when Commit()
+// returns, so that is everything before the current epoch.
+func (c *Coordinator) DurableEpoch() TID {
+	if c.logger != nil {
+		return c.logger.Durable()
+	}
+	return c.GetEpoch() - EPOCH_INCR
+}
+
 var RMoved int64
 var WMoved int64
 var Time_in_IE time.Duration
@@ -124,7 +156,11 @@ func (c *Coordinator) Stats() (map[Key]bool, map[Key]bool) {
 	xx := len(*s.cand.h)
 	for i := 0; i < xx; i++ {
 		o := heap.Pop(s.cand.h).(*OneStat)
-		br, _ := s.getKey(o.k, nil)
+		br, err := s.getKey(o.k, nil)
+		if err != nil || !br.exists {
+			// Deleted
+			continue
+		}
 		if !br.dd {
 			if !s.any_dd {
 				// Higher threshold for the first one, since it kicks off phases
@@ -230,6 +266,9 @@ func (c *Coordinator) IncrementEpoch(force bool) {
 		}
 	}
 	c.MergeTime += time.Since(c.StartTime)
+	if *Versions > 0 {
+		c.versionMerged()
+	}
 
 	// All merged.  The previous epoch is now safe; tell everyone to
 	// do their reads.
@@ -246,11 +285,23 @@ func (c *Coordinator) IncrementEpoch(force bool) {
 
 	}
 	c.ReadTime += time.Since(sx)
+	// Everyone has merged and finished the join phase and no one has
+	// started next_epoch: the store holds exactly the transactions
+	// before next_epoch.
+	s.setSnapshot(next_epoch)
+	s.reclaim()
+	if c.ckpending {
+		c.ckpending = false
+		c.snapshot(next_epoch)
+	}
 	// Merge dd
 	if !*AlwaysSplit {
 		if move_dd != nil {
 			for k, _ := range move_dd {
-				br, _ := s.getKey(k, nil)
+				br, err := s.getKey(k, nil)
+				if err != nil || !br.exists {
+					continue
+				}
 				br.dd = true
 				s.dd[k] = true
 				WMoved += 1
@@ -258,7 +309,11 @@ func (c *Coordinator) IncrementEpoch(force bool) {
 		}
 		if remove_dd != nil {
 			for k, _ := range remove_dd {
-				br, _ := s.getKey(k, nil)
+				br, err := s.getKey(k, nil)
+				if err != nil {
+					delete(s.dd, k)
+					continue
+				}
 				br.dd = false
 				s.dd[k] = false
 				RMoved += 1
@@ -274,6 +329,27 @@ func (c *Coordinator) IncrementEpoch(force bool) {
 	c.TotalCoordTime += time.Since(start1)
 }
 
+// Stop every worker between transactions and start a new epoch.
+// While they are stopped the store holds exactly the transactions
+// before it, so snapshot transactions move to it, tombstones are
+// reclaimed and f (if not nil) runs.  Not for Doppel with more than
+// one worker, which stops workers in IncrementEpoch().
+func (c *Coordinator) cut(f func(e TID)) {
+	for i := 0; i < c.n; i++ {
+		c.Workers[i].Lock()
+	}
+	e := c.NextGlobalTID()
+	c.Workers[0].store.setSnapshot(e)
+	c.Workers[0].store.reclaim()
+	if f != nil {
+		f(e)
+	}
+	for i := 0; i < c.n; i++ {
+		c.Workers[i].setEpoch(e)
+		c.Workers[i].Unlock()
+	}
+}
+
 func (c *Coordinator) Finish() {
 	dlog.Printf("Coordinator finishing\n")
 	x := make(chan bool)
@@ -290,6 +366,11 @@ func (c *Coordinator) Process() {
 	// change due to long stashed queue lengths.
 	check_trigger := time.NewTicker(time.Duration(*PhaseLength) * time.Microsecond * 10).C
 
+	var ckpt <-chan time.Time
+	if *CheckpointInterval > 0 && *LogDir != "" {
+		ckpt = time.NewTicker(time.Duration(*CheckpointInterval) * time.Millisecond).C
+	}
+
 	for {
 		select {
 		case x := <-c.Done:
@@ -299,11 +380,30 @@ func (c *Coordinator) Process() {
 			for i := 0; i < c.n; i++ {
 				c.Workers[i].done <- true
 			}
+			c.ckwg.Wait()
+			if c.logger != nil {
+				for i := 0; i < c.n; i++ {
+					c.Workers[i].finishLog()
+				}
+				c.logger.Stop()
+			}
+			for i := 0; i < c.n; i++ {
+				c.Workers[i].closeLog()
+			}
 			x <- true
 			return
 		case <-tm:
-			if *SysType == DOPPEL && c.n > 1 {
-				c.IncrementEpoch(false)
+			if *Versions > 0 {
+				c.versionHorizon()
+			}
+			// Start a new epoch every phase, even with nothing to
+			// split, so the snapshot is never more than a phase
+			// old and tombstones go; that means stopping all the
+			// workers.
+			if *SysType == DOPPEL && (c.n > 1 || c.logger != nil) {
+				c.IncrementEpoch(true)
+			} else {
+				c.cut(nil)
 			}
 		case <-check_trigger:
 			if *SysType == DOPPEL && c.n > 1 {
@@ -314,6 +414,10 @@ func (c *Coordinator) Process() {
 					c.IncrementEpoch(true)
 				}
 			}
+		case <-ckpt:
+			c.checkpoint(nil)
+		case x := <-c.ckreq:
+			c.checkpoint(x)
 		case <-c.Accelerate:
 			if *SysType == DOPPEL && c.n > 1 {
 				dlog.Printf("Accelerating\n")
@@ -323,23 +427,23 @@ func (c *Coordinator) Process() {
 	}
 }
 
-func compute(w *Worker, txn int) (int64, int64) {
+func compute(ts *TxnStats, txn int) (int64, int64) {
 	var total int64
 	var sum int64
 	var i int64
 	for i = 0; i < TIMES; i++ {
-		total = total + w.times[txn][i]
-		sum = sum + (w.times[txn][i] * i)
+		total = total + ts.times[i]
+		sum = sum + (ts.times[i] * i)
 	}
-	total = total + w.tooLong[txn]
-	sum = sum + w.tooLong[txn]*10000000
+	total = total + ts.tooLong
+	sum = sum + ts.tooLong*10000000
 	var x99 int64 = int64(float64(total) * .99)
 	var y99 int64
 	var v99 int64
 	var buckets [TIMES / 1000]int64
 	for i = 0; i < TIMES; i++ {
-		buckets[i/1000] += w.times[txn][i]
-		y99 = y99 + w.times[txn][i]
+		buckets[i/1000] += ts.times[i]
+		y99 = y99 + ts.times[i]
 		if y99 >= x99 {
 			v99 = i
 			break
@@ -348,7 +452,8 @@ func compute(w *Worker, txn int) (int64, int64) {
 	if total == 0 {
 		log.Fatalf("No latency recorded\n")
 	}
-	dlog.Printf("%v avg: %v us; 99: %v us, x99: %v, sum: %v, total: %v \n", txn, sum/total, v99, x99, sum, total)
+	label := GetTxnInfo(txn).Label
+	dlog.Printf("%v avg: %v us; 99: %v us, x99: %v, sum: %v, total: %v \n", label, sum/total, v99, x99, sum, total)
 
 	var one int64
 	var ten int64
@@ -366,7 +471,7 @@ func compute(w *Worker, txn int) (int64, int64) {
 		}
 	}
 
-	fmt.Printf("Txn %v\n Less than 1ms: %v\n 1-10ms: %v\n 10-100ms: %v\n 100ms-10s: %v\n Greater than 10s: %v\n", txn, one, ten, hundred, more, w.tooLong[txn])
+	fmt.Printf("Txn %v\n Less than 1ms: %v\n 1-10ms: %v\n 10-100ms: %v\n 100ms-10s: %v\n Greater than 10s: %v\n", label, one, ten, hundred, more, ts.tooLong)
 	total_time_in_ms := (one/2 + 5*ten + 55*100 + 15000*more)
 	fmt.Printf("Rough total time in ms: %v\n", total_time_in_ms)
 	return sum / total, v99
@@ -376,15 +481,8 @@ func (c *Coordinator) Latency() (string, string) {
 	if !*Latency {
 		return "", ""
 	}
-	for i := 1; i < c.n; i++ {
-		for j := 0; j < 4; j++ {
-			for k := 0; k < TIMES; k++ {
-				c.Workers[0].times[j][k] = c.Workers[0].times[j][k] + c.Workers[i].times[j][k]
-			}
-			c.Workers[0].tooLong[j] = c.Workers[0].tooLong[j] + c.Workers[i].tooLong[j]
-		}
-	}
-	x, y := compute(c.Workers[0], D_BUY)
-	x2, y2 := compute(c.Workers[0], D_READ_TWO)
+	ts := CollectTxnCounts(c)
+	x, y := compute(&ts[D_BUY], D_BUY)
+	x2, y2 := compute(&ts[D_READ_TWO], D_READ_TWO)
 	return fmt.Sprintf("Read Avg: %v\nWrite Avg: %v\n", x2, x), fmt.Sprintf("Read 99: %v\nWrite 99: %v\n", y2, y)
 }
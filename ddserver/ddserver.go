@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+
+	"github.com/narula/ddtxn"
+	"github.com/narula/ddtxn/server"
+)
+
+var addr = flag.String("addr", ":7070", "Address to listen on")
+var nprocs = flag.Int("nprocs", 2, "GOMAXPROCS default 2")
+var nworkers = flag.Int("nw", 0, "Number of workers")
+
+func main() {
+	flag.Parse()
+	runtime.GOMAXPROCS(*nprocs)
+	if *nworkers == 0 {
+		*nworkers = *nprocs
+	}
+
+	var s *ddtxn.Store
+	if *ddtxn.LogDir != "" {
+		var err error
+		var tid ddtxn.TID
+		s, tid, err = ddtxn.NewStoreFromDisk(*ddtxn.LogDir)
+		if err != nil {
+			log.Fatalf("Could not recover from %v: %v\n", *ddtxn.LogDir, err)
+		}
+		log.Printf("Recovered %v up to TID %v\n", *ddtxn.LogDir, tid)
+	} else {
+		s = ddtxn.NewStore()
+	}
+	coord := ddtxn.NewCoordinator(*nworkers, s)
+	srv := server.New(coord)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+
+	log.Printf("Serving %v workers on %v\n", *nworkers, *addr)
+	if err := srv.ListenAndServe(*addr); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	srv.Close()
+	coord.Finish()
+}
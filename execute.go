@@ -11,6 +11,7 @@ import (
 var SampleRate = flag.Int64("sr", 500, "Sample every sr transactions\n")
 var AlwaysSplit = flag.Bool("split", false, "Split every piece of data\n")
 var NoConflictType = flag.Int("noconflict", -1, "Type of operation NOT to record conflicts on")
+var MaxKeys = flag.Int("maxkeys", 100000, "Most keys one transaction may read or write; 0 for no limit\n")
 
 // Phases
 const (
@@ -19,15 +20,187 @@ const (
 	JOIN
 )
 
-// TODO: Handle writing more than once to a key in one transaction
-type WriteKey struct {
-	key    Key
-	br     *BRecord
-	v      Value
+// A write buffered until commit.  Writing a key more than once in a
+// transaction folds the writes together: SUM deltas add up, MAX and
+// OOWRITE keep the highest, MIN the lowest, LIST entries accumulate
+// and anything else takes the later value.  SUM64, MAX64, FSUM and
+// FMAX keep their number in v.  SET adds and removes and keys added
+// to an HLL accumulate in ves, in order, and BITMAPs OR together.  A
+// DELETE drops what came before it, and a write after a DELETE starts
+// the record over.
+type pending struct {
 	op     KeyType
-	locked bool
+	del    bool // the record is deleted first
 	vint32 int32
-	ve     Entry
+	ves    []Entry
+	v      Value
+}
+
+func (p *pending) set(op KeyType, a int32, e Entry, v Value) {
+	p.op = op
+	p.del = op == DELETE
+	p.vint32 = a
+	p.v = v
+	p.ves = p.ves[:0]
+	if op == LIST || op == SET || op == HLL {
+		p.ves = append(p.ves, e)
+	}
+}
+
+func (p *pending) fold(k Key, op KeyType, a int32, e Entry, v Value) error {
+	if op == DELETE || p.op == DELETE {
+		del := p.del
+		p.set(op, a, e, v)
+		p.del = p.del || del
+		return nil
+	}
+	if op != p.op {
+		dlog.Printf("%v Written as both %v and %v in one transaction\n", k, p.op, op)
+		return ETYPE
+	}
+	switch op {
+	case SUM:
+		p.vint32 += a
+	case MAX:
+		if a > p.vint32 {
+			p.vint32 = a
+		}
+	case MIN:
+		if a < p.vint32 {
+			p.vint32 = a
+		}
+	case SUM64, MAX64, FSUM, FMAX:
+		p.v = value64(op, combine64(op, bits64(p.v), v))
+	case LIST, SET, HLL:
+		p.ves = append(p.ves, e)
+	case BITMAP:
+		p.v = orBits(p.v.([]byte), v.([]byte))
+	case OOWRITE:
+		if v != nil && (a > p.vint32 || p.v == nil) {
+			p.vint32 = a
+			p.v = v
+		}
+	default:
+		p.v = v
+	}
+	return nil
+}
+
+// Fill in dummy with what record k, now br, holds once the pending
+// write is applied, so a transaction reads its own writes.  br is nil
+// if k doesn't exist.
+func (p *pending) record(dummy *BRecord, k Key, br *BRecord) *BRecord {
+	var st recState
+	if br != nil && br.exists && !p.del {
+		br.copyState(&st)
+	} else {
+		// What revive() starts the record over with
+		MakeBR(k, nil, p.op).copyState(&st)
+	}
+	dummy.fromState(k, &st)
+	dummy.key_type = p.op
+	switch p.op {
+	case SUM:
+		dummy.int_value += p.vint32
+	case MAX:
+		if p.vint32 > dummy.int_value {
+			dummy.int_value = p.vint32
+		}
+	case MIN:
+		if p.vint32 < dummy.int_value {
+			dummy.int_value = p.vint32
+		}
+	case SUM64, MAX64, FSUM, FMAX:
+		dummy.value64 = combine64(p.op, dummy.value64, p.v)
+	case LIST:
+		l := dummy.ListSpec()
+		for _, e := range p.ves {
+			dummy.entries = l.add(dummy.entries, e)
+		}
+	case SET:
+		for _, e := range p.ves {
+			dummy.entries = applyMember(dummy.entries, e)
+		}
+	case BITMAP:
+		dummy.value = orBits(dummy.Bitmap(), p.v.([]byte))
+	case HLL:
+		regs := hllCopy(dummy.Sketch())
+		for _, e := range p.ves {
+			hllAdd(regs, e.key)
+		}
+		dummy.value = regs
+	case OOWRITE:
+		if p.v != nil && (p.vint32 > dummy.int_value || dummy.value == nil) {
+			dummy.int_value = p.vint32
+			dummy.value = p.v
+		}
+	default:
+		dummy.value = p.v
+	}
+	return dummy
+}
+
+// Each LIST entry, SET member and HLL key is logged as its own op.
+func (p *pending) logTo(l *RedoLog, k Key) error {
+	if p.del && p.op != DELETE {
+		if err := l.Add(k, DELETE, 0, Entry{}, nil); err != nil {
+			return err
+		}
+	}
+	if p.op != LIST && p.op != SET && p.op != HLL {
+		return l.Add(k, p.op, p.vint32, Entry{}, p.v)
+	}
+	for _, e := range p.ves {
+		if err := l.Add(k, p.op, 0, e, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the write to br, which the caller has locked.
+func (p *pending) apply(s *Store, br *BRecord) {
+	switch {
+	case p.op == DELETE:
+		s.tombstone(br)
+		return
+	case p.del || !br.exists:
+		s.revive(br, p.op)
+	}
+	switch p.op {
+	case SUM, MAX, MIN:
+		s.SetInt32(br, p.vint32, p.op)
+	case LIST:
+		for _, e := range p.ves {
+			s.SetList(br, e, p.op)
+		}
+	case SET:
+		for _, e := range p.ves {
+			s.SetMember(br, e)
+		}
+	case HLL:
+		s.SetHLL(br, p.ves)
+	case OOWRITE:
+		s.SetOO(br, p.vint32, p.v, p.op)
+	default:
+		s.Set(br, p.v, p.op)
+	}
+	s.indexed(br)
+}
+
+// Read and write sets start small and grow as needed, up to -maxkeys
+// entries; past that a transaction gets ETOOLARGE.
+func tooLarge(n int) bool {
+	return *MaxKeys > 0 && n >= *MaxKeys
+}
+
+type WriteKey struct {
+	key     Key
+	br      *BRecord
+	locked  bool
+	created bool   // by Commit(), so Abort() takes it back out
+	former  uint64 // br's TID when Commit() locked it
+	pending
 }
 
 type ReadKey struct {
@@ -39,10 +212,30 @@ type ReadKey struct {
 type ETransaction interface {
 	Reset()
 	Read(k Key) (*BRecord, error)
+	// Read k as it was after the transaction with TID tid, or the
+	// last one before it that wrote k.  Needs -versions; returns
+	// EVERSION if that version is gone.  Not part of the read set,
+	// and never sees this transaction's writes.
+	ReadAt(k Key, tid TID) (*BRecord, error)
+	// The records with keys from start through end, in order; at most
+	// limit of them unless limit is 0.  Needs an ordered index over
+	// the range (see Store.AddOrdered()), else ENOINDEX.  Commit()
+	// aborts if a key appears in the range meanwhile.  Doesn't see
+	// this transaction's own writes.  The slice is good until the
+	// next Scan() or Reset().
+	Scan(start, end Key, limit int) ([]*BRecord, error)
 	WriteInt32(k Key, a int32, op KeyType) error
+	// op is SUM64 or MAX64, else ETYPE
+	WriteInt64(k Key, a int64, op KeyType) error
+	// op is FSUM or FMAX, else ETYPE
+	WriteFloat64(k Key, a float64, op KeyType) error
 	WriteList(k Key, l Entry, op KeyType) error
 	WriteOO(k Key, a int32, v Value, op KeyType) error
-	Write(k Key, v Value, op KeyType)
+	Write(k Key, v Value, op KeyType) error
+	// Remove k; ENOKEY if it isn't there.  Reads of k then return
+	// ENOKEY until something writes it again.  Doppel stashes the
+	// transaction if k is split.
+	Delete(k Key) error
 	Abort() TID
 	Commit() TID
 	SetPhase(int)
@@ -50,9 +243,10 @@ type ETransaction interface {
 	Store() *Store
 	Worker() *Worker
 
-	// Tell 2PL I am going to read and potentially write this key.
-	// This is because I don't know how to upgrade locks.
-	MaybeWrite(k Key)
+	// Tell 2PL I am going to read and potentially write this key,
+	// so it takes the write lock now rather than upgrading a read
+	// lock later, which can abort.  Optional.
+	MaybeWrite(k Key) error
 
 	// Tell Doppel not to count this transaction's reads and writes
 	// when deciding if records should be split.
@@ -77,6 +271,9 @@ type OTransaction struct {
 	count       bool
 	sr_rate     int64
 	dummyRecord *BRecord
+	old         copies // handed out by ReadAt()
+	nodes       []leafRead
+	scanned     []*BRecord
 	padding     [128]byte
 }
 
@@ -106,6 +303,8 @@ func StartOTransaction(w *Worker) *OTransaction {
 }
 
 func (tx *OTransaction) Reset() {
+	tx.old.reset()
+	tx.nodes = tx.nodes[:0]
 	tx.read = tx.read[:0]
 	tx.writes = tx.writes[:0]
 	tx.t++
@@ -136,6 +335,22 @@ func (tx *OTransaction) isSplit(br *BRecord) bool {
 	return false
 }
 
+// Look up the record blind write w goes on top of, so Read() can
+// combine them, and add it to the read set.
+func (tx *OTransaction) readUnder(w *WriteKey) error {
+	br, err := tx.s.getKey(w.key, tx.w.ld)
+	if err != nil {
+		return tx.addRead(w.key, nil, 0)
+	}
+	ok, last := br.IsUnlocked()
+	if !ok {
+		tx.w.Nstats[NLOCKED]++
+		return EABORT
+	}
+	w.br = br
+	return tx.addRead(w.key, br, last)
+}
+
 func (tx *OTransaction) Read(k Key) (*BRecord, error) {
 	if len(tx.writes) > 0 {
 		for i := 0; i < len(tx.writes); i++ {
@@ -146,21 +361,21 @@ func (tx *OTransaction) Read(k Key) (*BRecord, error) {
 				// shouldn't be dd.  Also I should return this value.
 				// But I return a pointer to a record (sigh) so use a
 				// dummy record.
+				if w.br == nil {
+					if err := tx.readUnder(w); err != nil {
+						return nil, err
+					}
+				}
 				if tx.count {
 					tx.ls.candidates.ReadWrite(k, w.br)
 				}
 				if tx.isSplit(w.br) {
 					return nil, ESTASH
 				}
-				tx.dummyRecord.key_type = w.op
-				tx.dummyRecord.int_value = w.vint32
-				tx.dummyRecord.value = w.v
-				if w.op == LIST {
-					tx.dummyRecord.entries = tx.dummyRecord.entries[0 : len(w.br.entries)+1]
-					copy(tx.dummyRecord.entries, w.br.entries)
-					tx.dummyRecord.entries = append(tx.dummyRecord.entries, w.ve)
+				if w.op == DELETE {
+					return nil, ENOKEY
 				}
-				return tx.dummyRecord, nil
+				return w.record(tx.dummyRecord, k, w.br), nil
 			}
 		}
 	}
@@ -174,11 +389,9 @@ func (tx *OTransaction) Read(k Key) (*BRecord, error) {
 
 	if err == ENOKEY {
 		// Can't be stashed, right?
-		n := len(tx.read)
-		tx.read = tx.read[0 : n+1]
-		tx.read[n].key = k
-		tx.read[n].br = nil
-		tx.read[n].last = 0
+		if err := tx.addRead(k, nil, 0); err != nil {
+			return nil, err
+		}
 		return nil, err
 	} else {
 		if tx.isSplit(br) {
@@ -197,13 +410,12 @@ func (tx *OTransaction) Read(k Key) (*BRecord, error) {
 			tx.w.Nstats[NLOCKED]++
 			return nil, EABORT
 		}
-		n := len(tx.read)
-		tx.read = tx.read[0 : n+1]
-		tx.read[n].key = k
-		tx.read[n].br = br
-		tx.read[n].last = last
-		if last > tx.maxSeen {
-			tx.maxSeen = last
+		if err := tx.addRead(k, br, last); err != nil {
+			return nil, err
+		}
+		if !br.exists {
+			// Tombstone; the read set notices if it comes back
+			return nil, ENOKEY
 		}
 		return br, nil
 	}
@@ -211,7 +423,74 @@ func (tx *OTransaction) Read(k Key) (*BRecord, error) {
 	return nil, nil
 }
 
+func (tx *OTransaction) ReadAt(k Key, tid TID) (*BRecord, error) {
+	return tx.w.readAt(&tx.old, k, tid)
+}
+
+func (tx *OTransaction) Scan(start, end Key, limit int) ([]*BRecord, error) {
+	tx.scanned = tx.scanned[:0]
+	err := tx.s.scan(start, end, limit, &tx.nodes, func(br *BRecord) (bool, error) {
+		if tx.isSplit(br) {
+			if tx.count {
+				tx.ls.candidates.Stash(br.key)
+			}
+			return false, ESTASH
+		}
+		if tx.count {
+			tx.ls.candidates.Read(br.key, br)
+		}
+		ok, last := br.IsUnlocked()
+		if !ok {
+			tx.w.Nstats[NLOCKED]++
+			return false, EABORT
+		}
+		if err := tx.addRead(br.key, br, last); err != nil {
+			return false, err
+		}
+		if !br.exists {
+			return false, nil
+		}
+		tx.scanned = append(tx.scanned, br)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tx.scanned, nil
+}
+
+func (tx *OTransaction) addRead(k Key, br *BRecord, last uint64) error {
+	if tooLarge(len(tx.read)) {
+		return ETOOLARGE
+	}
+	tx.read = append(tx.read, ReadKey{key: k, br: br, last: last})
+	if last > tx.maxSeen {
+		tx.maxSeen = last
+	}
+	return nil
+}
+
 func (tx *OTransaction) WriteInt32(k Key, a int32, op KeyType) error {
+	return tx.writeSplittable(k, op, a, Entry{}, nil)
+}
+
+func (tx *OTransaction) WriteInt64(k Key, a int64, op KeyType) error {
+	if op != SUM64 && op != MAX64 {
+		return ETYPE
+	}
+	return tx.writeSplittable(k, op, 0, Entry{}, a)
+}
+
+func (tx *OTransaction) WriteFloat64(k Key, a float64, op KeyType) error {
+	if op != FSUM && op != FMAX {
+		return ETYPE
+	}
+	return tx.writeSplittable(k, op, 0, Entry{}, a)
+}
+
+// A write of an op Doppel can split: a, or e for SET and HLL, or v
+// for the 64-bit types and BITMAP.
+func (tx *OTransaction) writeSplittable(k Key, op KeyType, a int32, e Entry, v Value) error {
 	// During the normal phase, Doppel operates just like OCC, for
 	// ease of exposition.  That means it would have to put the key
 	// into the read set and potentially abort accordingly.  Doing so
@@ -223,13 +502,21 @@ func (tx *OTransaction) WriteInt32(k Key, a int32, op KeyType) error {
 			tx.w.NKeyAccesses[p]++
 		}
 	}
+	if err == nil && br.exists && br.key_type != op {
+		dlog.Printf("%v Doing a %v write to a %v record\n", k, op, br.key_type)
+		return ETYPE
+	}
 	if tx.isSplit(br) {
+		if op == SET && e.order == SET_REMOVE {
+			// Removes don't commute with adds
+			if tx.count {
+				tx.ls.candidates.Stash(k)
+			}
+			return ESTASH
+		}
 		if tx.count {
 			tx.ls.candidates.Write(k, br, op)
 		}
-		if br.key_type != op {
-			log.Fatalf("%v Doing a write to a non-%v type: %v", k, op, br.key_type)
-		}
 		// Do not need to read-validate
 	} else {
 		var last uint64
@@ -247,44 +534,101 @@ func (tx *OTransaction) WriteInt32(k Key, a int32, op KeyType) error {
 			}
 		}
 		// Note the last timestamp and save it
-		n := len(tx.read)
-		tx.read = tx.read[0 : n+1]
-		tx.read[n].key = k
-		tx.read[n].br = br
-		tx.read[n].last = last
-		if last > tx.maxSeen {
-			tx.maxSeen = last
+		if err := tx.addRead(k, br, last); err != nil {
+			return err
+		}
+	}
+	return tx.addWrite(k, br, op, a, e, v)
+}
+
+// Buffer a write, folding it into an earlier write to k if there is
+// one.
+func (tx *OTransaction) addWrite(k Key, br *BRecord, op KeyType, a int32, e Entry, v Value) error {
+	for i := 0; i < len(tx.writes); i++ {
+		w := &tx.writes[i]
+		if w.key == k {
+			if w.br == nil {
+				w.br = br
+			}
+			return w.fold(k, op, a, e, v)
 		}
 	}
 	n := len(tx.writes)
-	tx.writes = tx.writes[0 : n+1]
-	tx.writes[n].key = k
-	tx.writes[n].br = br
-	tx.writes[n].vint32 = a
-	tx.writes[n].op = op
-	tx.writes[n].locked = false
+	if tooLarge(n) {
+		return ETOOLARGE
+	}
+	if n < cap(tx.writes) {
+		// Reuse the slot, and its LIST entries
+		tx.writes = tx.writes[:n+1]
+	} else {
+		tx.writes = append(tx.writes, WriteKey{})
+	}
+	w := &tx.writes[n]
+	w.key = k
+	w.br = br
+	w.locked = false
+	w.created = false
+	w.former = 0
+	w.set(op, a, e, v)
 	return nil
 }
 
-func (tx *OTransaction) Write(k Key, v Value, op KeyType) {
-	if len(tx.writes) == cap(tx.writes) {
-		log.Fatalf("Ran out of room\n")
+func (tx *OTransaction) Write(k Key, v Value, op KeyType) error {
+	var a int32
+	if op == SUM || op == MAX || op == MIN {
+		var ok bool
+		if a, ok = v.(int32); !ok {
+			return ETYPE
+		}
 	}
-	n := len(tx.writes)
-	tx.writes = tx.writes[0 : n+1]
-	tx.writes[n].key = k
-	tx.writes[n].br = nil
-	tx.writes[n].v = v
-	tx.writes[n].op = op
-	tx.writes[n].locked = false
+	switch op {
+	case SET:
+		e, err := setEntry(v)
+		if err != nil {
+			return err
+		}
+		return tx.writeSplittable(k, op, 0, e, nil)
+	case SUM64, MAX64:
+		x, ok := v.(int64)
+		if !ok {
+			return ETYPE
+		}
+		return tx.WriteInt64(k, x, op)
+	case FSUM, FMAX:
+		x, ok := v.(float64)
+		if !ok {
+			return ETYPE
+		}
+		return tx.WriteFloat64(k, x, op)
+	case BITMAP:
+		b, err := bitmapValue(v)
+		if err != nil {
+			return err
+		}
+		return tx.writeSplittable(k, op, 0, Entry{}, b)
+	case HLL:
+		e, err := hllEntry(v)
+		if err != nil {
+			return err
+		}
+		return tx.writeSplittable(k, op, 0, e, nil)
+	}
+	if op == WRITE && isIndexed(v) {
+		if err := reindex(tx, k, v); err != nil {
+			return err
+		}
+	}
+	// A blind write; Commit() checks the type again once it's locked
+	if br, err := tx.s.getKey(k, tx.w.ld); err == nil && br.exists && br.key_type != op {
+		dlog.Printf("%v Doing a %v write to a %v record\n", k, op, br.key_type)
+		return ETYPE
+	}
+	return tx.addWrite(k, nil, op, a, Entry{}, v)
 }
 
 func (tx *OTransaction) WriteList(k Key, l Entry, op KeyType) error {
 	if op != LIST {
-		log.Fatalf("Not a list\n")
-	}
-	if len(tx.writes) == cap(tx.writes) {
-		log.Fatalf("Ran out of room\n")
+		return ETYPE
 	}
 
 	// During the normal phase, Doppel operates just like OCC, for
@@ -298,13 +642,14 @@ func (tx *OTransaction) WriteList(k Key, l Entry, op KeyType) error {
 			tx.w.NKeyAccesses[p]++
 		}
 	}
+	if err == nil && br.exists && br.key_type != op {
+		dlog.Printf("%v Doing a %v write to a %v record\n", k, op, br.key_type)
+		return ETYPE
+	}
 	if tx.isSplit(br) {
 		if tx.count {
 			tx.ls.candidates.Write(k, br, op)
 		}
-		if br.key_type != LIST {
-			log.Fatalf("%v Doing a write to a non-LIST type: %v", k, br.key_type)
-		}
 		// Do not need to read-validate
 	} else {
 		var last uint64
@@ -322,32 +667,17 @@ func (tx *OTransaction) WriteList(k Key, l Entry, op KeyType) error {
 			}
 		}
 		// Note the last timestamp and save it
-		n := len(tx.read)
-		tx.read = tx.read[0 : n+1]
-		tx.read[n].key = k
-		tx.read[n].br = br
-		tx.read[n].last = last
-		if last > tx.maxSeen {
-			tx.maxSeen = last
+		if err := tx.addRead(k, br, last); err != nil {
+			return err
 		}
 	}
 
-	n := len(tx.writes)
-	tx.writes = tx.writes[0 : n+1]
-	tx.writes[n].key = k
-	tx.writes[n].br = br
-	tx.writes[n].ve = l
-	tx.writes[n].op = op
-	tx.writes[n].locked = false
-	return nil
+	return tx.addWrite(k, br, op, 0, l, nil)
 }
 
 func (tx *OTransaction) WriteOO(k Key, a int32, v Value, op KeyType) error {
 	if op != OOWRITE {
-		log.Fatalf("Not an OOWRITE\n")
-	}
-	if len(tx.writes) == cap(tx.writes) {
-		log.Fatalf("Ran out of room\n")
+		return ETYPE
 	}
 
 	// During the normal phase, Doppel operates just like OCC, for
@@ -361,13 +691,14 @@ func (tx *OTransaction) WriteOO(k Key, a int32, v Value, op KeyType) error {
 			tx.w.NKeyAccesses[p]++
 		}
 	}
+	if err == nil && br.exists && br.key_type != op {
+		dlog.Printf("%v Doing a %v write to a %v record\n", k, op, br.key_type)
+		return ETYPE
+	}
 	if tx.isSplit(br) {
 		if tx.count {
 			tx.ls.candidates.Write(k, br, op)
 		}
-		if br.key_type != OOWRITE {
-			log.Fatalf("%v Doing a write to a non-OOWRITE type: %v", k, br.key_type)
-		}
 		// Do not need to read-validate
 	} else {
 		var last uint64
@@ -385,25 +716,30 @@ func (tx *OTransaction) WriteOO(k Key, a int32, v Value, op KeyType) error {
 			}
 		}
 		// Note the last timestamp and save it
-		n := len(tx.read)
-		tx.read = tx.read[0 : n+1]
-		tx.read[n].key = k
-		tx.read[n].br = br
-		tx.read[n].last = last
-		if last > tx.maxSeen {
-			tx.maxSeen = last
+		if err := tx.addRead(k, br, last); err != nil {
+			return err
 		}
 	}
 
-	n := len(tx.writes)
-	tx.writes = tx.writes[0 : n+1]
-	tx.writes[n].key = k
-	tx.writes[n].br = nil
-	tx.writes[n].v = v
-	tx.writes[n].vint32 = a
-	tx.writes[n].op = op
-	tx.writes[n].locked = false
-	return nil
+	return tx.addWrite(k, br, op, a, Entry{}, v)
+}
+
+func (tx *OTransaction) Delete(k Key) error {
+	// Read() stashes split data, and puts k in the read set so
+	// Commit() aborts if someone else deletes it first.
+	br, err := tx.Read(k)
+	if err != nil {
+		return err
+	}
+	if br.key_type == WRITE && isIndexed(br.value) {
+		if err := moveEntries(tx, k, br.value, nil); err != nil {
+			return err
+		}
+	}
+	if br == tx.dummyRecord {
+		br = nil
+	}
+	return tx.addWrite(k, br, DELETE, 0, Entry{}, nil)
 }
 
 func (tx *OTransaction) SetPhase(p int) {
@@ -422,10 +758,20 @@ func (tx *OTransaction) Worker() *Worker {
 	return tx.w
 }
 
+// Release any locks.  Safe to call more than once, and after Commit().
 func (tx *OTransaction) Abort() TID {
 	for i, _ := range tx.writes {
-		if tx.writes[i].locked {
-			tx.writes[i].br.Unlock(0)
+		w := &tx.writes[i]
+		if w.created {
+			// Never written; leave a tombstone, out of the ordered index
+			tx.s.tombstone(w.br)
+			tx.s.unindexed(w.br)
+			w.created = false
+		}
+		if w.locked {
+			// Keep its TID, so later writers still commit above it
+			w.br.Unlock(TID(w.former))
+			w.locked = false
 		}
 	}
 	return 0
@@ -475,6 +821,10 @@ func (tx *OTransaction) Commit() TID {
 					return tx.Abort()
 				}
 				w.locked = true
+				// Index it now, so a scan that missed it can't pass
+				// validation once I've passed mine
+				tx.s.indexedBy(w.br, &tx.nodes)
+				w.created = true
 				continue
 			}
 		}
@@ -492,9 +842,16 @@ func (tx *OTransaction) Commit() TID {
 			return tx.Abort()
 		}
 		w.locked = true
+		w.former = former
 		if former > tx.maxSeen {
 			tx.maxSeen = former
 		}
+		if w.br.exists && !w.del && w.op != DELETE && w.br.key_type != w.op {
+			// Deleted and written as another type since Write()
+			// checked; trying again gets ETYPE
+			tx.w.Nstats[NFAIL_VERIFY]++
+			return tx.Abort()
+		}
 	}
 
 	// Get TID higher than anything I've seen
@@ -522,7 +879,7 @@ func (tx *OTransaction) Commit() TID {
 			}
 			// Verify it still doesn't exist or I'm the one who
 			// created and locked it to write
-			if err == ENOKEY || tx.checkOwnership(rk.br, rk.last) {
+			if err == ENOKEY || tx.checkOwnership(rk.br, rk.last) || rk.br.tombstoned() {
 				continue
 			}
 			tx.w.Nstats[NFAIL_VERIFY]++
@@ -538,6 +895,18 @@ func (tx *OTransaction) Commit() TID {
 		tx.w.Nstats[NFAIL_VERIFY]++
 		return tx.Abort()
 	}
+	// Nothing new in the ranges I scanned
+	for i := range tx.nodes {
+		if !tx.nodes[i].valid() {
+			tx.w.Nstats[NFAIL_VERIFY]++
+			return tx.Abort()
+		}
+	}
+	if tx.w.rlog != nil && len(tx.writes) > 0 {
+		if err := tx.logCommit(tid); err != nil {
+			return tx.Abort()
+		}
+	}
 	// for each write key
 	//  if dd and split phase, apply locally
 	//  else apply globally and unlock
@@ -549,48 +918,73 @@ func (tx *OTransaction) Commit() TID {
 				tx.ls.ApplyInt32(w.key, w.op, w.vint32, w.op)
 			case MAX:
 				tx.ls.ApplyInt32(w.key, w.op, w.vint32, w.op)
+			case MIN:
+				tx.ls.ApplyInt32(w.key, w.op, w.vint32, w.op)
 			case LIST:
-				tx.ls.ApplyList(w.key, w.ve)
+				l := w.br.ListSpec()
+				for _, e := range w.ves {
+					tx.ls.ApplyList(w.key, e, l)
+				}
+			case SET:
+				for _, e := range w.ves {
+					tx.ls.ApplySet(w.key, e.key)
+				}
+			case HLL:
+				for _, e := range w.ves {
+					tx.ls.ApplyHLL(w.key, e.key)
+				}
 			case OOWRITE:
 				tx.ls.ApplyOO(w.key, w.vint32, w.v)
 			default:
 				tx.ls.Apply(w.key, w.op, w.v, w.op)
 			}
 		} else {
-			switch w.op {
-			case SUM:
-				tx.s.SetInt32(w.br, w.vint32, w.op)
-			case MAX:
-				tx.s.SetInt32(w.br, w.vint32, w.op)
-			case LIST:
-				tx.s.SetList(w.br, w.ve, w.op)
-			case OOWRITE:
-				tx.s.SetOO(w.br, w.vint32, w.v, w.op)
-			default:
-				if w.br == nil {
-					log.Fatalf("How is this nil?\n")
-				}
-				tx.s.Set(w.br, w.v, w.op)
+			if w.br == nil {
+				log.Fatalf("How is this nil?\n")
+			}
+			w.apply(tx.s, w.br)
+			if *Versions > 0 {
+				tx.s.addVersion(w.br, tid)
+			}
+			if err := w.br.Unlock(tid); err != nil {
+				dlog.Printf("%v Unlock %v: %v\n", tx.w.ID, w.key, err)
 			}
-			w.br.Unlock(tid)
+			w.locked = false
 		}
 	}
 	return tid
 }
 
-func (tx *OTransaction) MaybeWrite(k Key) {
+// Log every write, including ones to split data which will only reach
+// the global store in the next merge.  If a write can't be encoded,
+// the transaction has to abort; see Worker.logFailed().
+func (tx *OTransaction) logCommit(tid TID) error {
+	l := tx.w.rlog
+	l.Begin(tid, tx.w.commitEpoch())
+	for i, _ := range tx.writes {
+		w := &tx.writes[i]
+		if err := w.logTo(l, w.key); err != nil {
+			l.Discard()
+			return tx.w.logFailed(w.key, err)
+		}
+	}
+	if err := l.Commit(); err != nil {
+		log.Fatalf("%v Could not write redo log: %v\n", tx.w.ID, err)
+	}
+	return nil
+}
+
+func (tx *OTransaction) MaybeWrite(k Key) error {
 	// no op
+	return nil
 }
 
 type Rec struct {
-	br     *BRecord
-	read   bool
-	v      interface{}
-	vint32 int32
-	ve     Entry
-	op     KeyType
-	noset  bool
-	key    Key
+	br    *BRecord
+	read  bool
+	noset bool
+	key   Key
+	pending
 }
 
 // Not threadsafe.  Tracks execution of transaction.
@@ -603,6 +997,9 @@ type LTransaction struct {
 	ls          *LocalStore
 	phase       int
 	dummyRecord *BRecord
+	old         copies // handed out by ReadAt()
+	nodes       []leafRead
+	scanned     []*BRecord
 	padding     [128]byte
 }
 
@@ -618,6 +1015,8 @@ func StartLTransaction(w *Worker) *LTransaction {
 }
 
 func (tx *LTransaction) Reset() {
+	tx.old.reset()
+	tx.nodes = tx.nodes[:0]
 	tx.keys = tx.keys[:0]
 	tx.t++
 }
@@ -640,16 +1039,17 @@ func (tx *LTransaction) Read(k Key) (*BRecord, error) {
 			// Doesn't really exist yet; created to lock for read or MaybeWrite()
 			return nil, ENOKEY
 		}
-		if tx.keys[n].br.exists && tx.keys[n].noset == false && tx.keys[n].read == false {
-			tx.dummyRecord.key_type = tx.keys[n].op
-			tx.dummyRecord.int_value = tx.keys[n].vint32
-			tx.dummyRecord.value = tx.keys[n].v
-			dlog.Printf("Creating dummy record for key %v %v %v %v\n", k, tx.dummyRecord.key_type, tx.dummyRecord.int_value, tx.dummyRecord.value)
-			if tx.keys[n].op == LIST {
-				tx.dummyRecord.entries = tx.dummyRecord.entries[0 : len(tx.keys[n].br.entries)+1]
-				copy(tx.dummyRecord.entries, tx.keys[n].br.entries)
-				tx.dummyRecord.entries = append(tx.dummyRecord.entries, tx.keys[n].ve)
+		if tx.keys[n].noset == false && tx.keys[n].read == false {
+			// Written earlier in this transaction
+			if tx.keys[n].op == DELETE {
+				return nil, ENOKEY
+			}
+			var br *BRecord
+			if tx.keys[n].br.exists {
+				br = tx.keys[n].br
 			}
+			tx.keys[n].record(tx.dummyRecord, k, br)
+			dlog.Printf("Creating dummy record for key %v %v %v %v\n", k, tx.dummyRecord.key_type, tx.dummyRecord.int_value, tx.dummyRecord.value)
 			return tx.dummyRecord, nil
 		}
 		if tx.keys[n].br.exists && tx.keys[n].noset == false && tx.keys[n].read == true {
@@ -665,14 +1065,22 @@ func (tx *LTransaction) Read(k Key) (*BRecord, error) {
 			tx.w.NKeyAccesses[p]++
 		}
 	}
-	n := len(tx.keys)
-	tx.keys = tx.keys[0 : n+1]
+	n, err2 := tx.addKey()
+	if err2 != nil {
+		return nil, err2
+	}
 	tx.keys[n].read = true
 	tx.keys[n].noset = false
 	tx.keys[n].key = k
 	tx.keys[n].br = br
 	if err == nil {
-		br.SRLock()
+		if !br.SRLockTimeout() {
+			return nil, tx.timedOut(n)
+		}
+		if !br.exists {
+			// Tombstone; the read lock keeps it that way
+			return nil, ENOKEY
+		}
 		return br, nil
 	}
 	if br, err = tx.s.CreateMuLockedKey(k, WRITE); err == nil {
@@ -684,19 +1092,74 @@ func (tx *LTransaction) Read(k Key) (*BRecord, error) {
 	}
 	// Perhaps someone snuck in and created this key already.
 	if br, err = tx.s.getKey(k, tx.w.ld); err == nil {
-		br.SRLock()
+		if !br.SRLockTimeout() {
+			return nil, tx.timedOut(n)
+		}
 		tx.keys[n].br = br
+		if !br.exists {
+			return nil, ENOKEY
+		}
 		return br, nil
 	}
-	log.Fatalf("Can't create key %v and it's not there now\n", k)
-	return br, nil
+	dlog.Printf("Can't create key %v and it's not there now\n", k)
+	tx.keys = tx.keys[:n]
+	return nil, EABORT
+}
+
+func (tx *LTransaction) ReadAt(k Key, tid TID) (*BRecord, error) {
+	return tx.w.readAt(&tx.old, k, tid)
+}
+
+// Records found are read locked; Commit() checks nothing was added
+// to the range, since locks on records can't stop that.
+func (tx *LTransaction) Scan(start, end Key, limit int) ([]*BRecord, error) {
+	tx.scanned = tx.scanned[:0]
+	err := tx.s.scan(start, end, limit, &tx.nodes, func(br *BRecord) (bool, error) {
+		if exists, n := tx.already_exists(br.key); exists {
+			r := &tx.keys[n]
+			if r.read || r.noset {
+				if !r.br.exists {
+					return false, nil
+				}
+			} else if r.op == DELETE {
+				return false, nil
+			}
+			tx.scanned = append(tx.scanned, r.br)
+			return true, nil
+		}
+		n, err := tx.addKey()
+		if err != nil {
+			return false, err
+		}
+		if !br.SRLockTimeout() {
+			return false, tx.timedOut(n)
+		}
+		r := &tx.keys[n]
+		r.br = br
+		r.read = true
+		r.noset = false
+		r.key = br.key
+		if !br.exists {
+			return false, nil
+		}
+		tx.scanned = append(tx.scanned, br)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tx.scanned, nil
 }
 
 // This is when I am reading a key and I might write it later; acquire
 // the write lock *before* the read.
-func (tx *LTransaction) MaybeWrite(k Key) {
-	if exists, _ := tx.already_exists(k); exists {
-		log.Fatalf("Shouldn't already have a lock on this\n")
+func (tx *LTransaction) MaybeWrite(k Key) error {
+	if exists, n := tx.already_exists(k); exists {
+		return tx.upgrade(n)
+	}
+	n, err := tx.addKey()
+	if err != nil {
+		return err
 	}
 	br, err := tx.s.getKey(k, tx.w.ld)
 	if *CountKeys {
@@ -706,23 +1169,25 @@ func (tx *LTransaction) MaybeWrite(k Key) {
 		}
 	}
 	if br == nil || err != nil {
-		if br, err = tx.s.CreateMuLockedKey(k, WRITE); err != nil {
-			// Perhaps someone snuck in and created this key already.
-			if br, err = tx.s.getKey(k, tx.w.ld); err != nil {
-				log.Fatalf("Can't create key %v and it's not there now\n", k)
-			}
-			br.SLock()
-		} // Created and Locked
-		br.exists = false
-	} else {
-		br.SLock()
+		if br, err = tx.s.CreateMuLockedKey(k, WRITE); err == nil {
+			// Created and Locked
+			br.exists = false
+		} else if br, err = tx.s.getKey(k, tx.w.ld); err != nil {
+			// Someone else created it and it's gone again?
+			dlog.Printf("Can't create key %v and it's not there now\n", k)
+			tx.keys = tx.keys[:n]
+			return EABORT
+		} else if !br.SLockTimeout() {
+			return tx.timedOut(n)
+		}
+	} else if !br.SLockTimeout() {
+		return tx.timedOut(n)
 	}
-	n := len(tx.keys)
-	tx.keys = tx.keys[0 : n+1]
 	tx.keys[n].br = br
 	tx.keys[n].read = false
 	tx.keys[n].noset = true
 	tx.keys[n].key = k
+	return nil
 }
 
 func (tx *LTransaction) already_exists(k Key) (bool, int) {
@@ -732,14 +1197,26 @@ func (tx *LTransaction) already_exists(k Key) (bool, int) {
 			return true, i
 		}
 	}
-	if len(tx.keys) == cap(tx.keys) {
-		// TODO: extend
-		log.Fatalf("Ran out of room\n")
-	}
 	return false, n
 }
 
-func (tx *LTransaction) make_or_get_key(k Key, op KeyType) *BRecord {
+// Make room for one more key at the end of tx.keys and return its
+// index.  Call before locking anything for it.
+func (tx *LTransaction) addKey() (int, error) {
+	n := len(tx.keys)
+	if tooLarge(n) {
+		return n, ETOOLARGE
+	}
+	if n < cap(tx.keys) {
+		// Reuse the slot, and its LIST entries
+		tx.keys = tx.keys[:n+1]
+	} else {
+		tx.keys = append(tx.keys, Rec{})
+	}
+	return n, nil
+}
+
+func (tx *LTransaction) make_or_get_key(k Key, op KeyType) (*BRecord, error) {
 	br, err := tx.s.getKey(k, tx.w.ld)
 	if *CountKeys {
 		p, r := UndoCKey(k)
@@ -748,8 +1225,11 @@ func (tx *LTransaction) make_or_get_key(k Key, op KeyType) *BRecord {
 		}
 	}
 	if br != nil && err == nil {
-		br.SLock()
-		return br
+		if !br.SLockTimeout() {
+			tx.w.Nstats[NLOCKTIMEOUT]++
+			return nil, EABORT
+		}
+		return br, nil
 	}
 	var err2 error
 	br, err2 = tx.s.CreateMuLockedKey(k, op)
@@ -760,119 +1240,190 @@ func (tx *LTransaction) make_or_get_key(k Key, op KeyType) *BRecord {
 		}
 	}
 	if br == nil || err2 != nil {
+		// Someone else created it first
 		br, err = tx.s.getKey(k, tx.w.ld)
 		if err != nil {
-			log.Fatalf("Should exist\n")
+			dlog.Printf("Can't create key %v and it's not there now\n", k)
+			return nil, EABORT
+		}
+		if !br.SLockTimeout() {
+			tx.w.Nstats[NLOCKTIMEOUT]++
+			return nil, EABORT
 		}
-		br.SLock()
 	}
-	return br
+	return br, nil
 }
 
-func (tx *LTransaction) WriteInt32(k Key, a int32, op KeyType) error {
-	exists, n := tx.already_exists(k)
-	if exists {
-		if tx.keys[n].read == true {
-			log.Fatalf("Already have read lock on this key; cannot upgrade %v\n", k)
-		}
-		// Already locked.  TODO: aggregate
-		tx.keys[n].vint32 = a
-		tx.keys[n].op = op
-		tx.keys[n].noset = false
-		tx.keys[n].key = k
+// Make sure the lock held on tx.keys[n] is a write lock.
+func (tx *LTransaction) upgrade(n int) error {
+	r := &tx.keys[n]
+	if !r.read {
 		return nil
 	}
-	br := tx.make_or_get_key(k, op)
-	tx.keys = tx.keys[0 : n+1]
-	tx.keys[n].br = br
-	tx.keys[n].read = false
-	tx.keys[n].vint32 = a
-	tx.keys[n].op = op
-	tx.keys[n].noset = false
-	tx.keys[n].key = k
+	held, ok := r.br.SUpgrade()
+	if !held {
+		return tx.timedOut(n)
+	}
+	r.read = false
+	r.noset = true
+	if !ok {
+		dlog.Printf("Upgrade of %v lost to another writer\n", r.key)
+		return EABORT
+	}
 	return nil
 }
 
-func (tx *LTransaction) Write(k Key, v Value, op KeyType) {
-	if op == SUM || op == MAX {
-		tx.WriteInt32(k, v.(int32), op)
-		return
-	}
+// Couldn't lock tx.keys[n] in time, perhaps because of a deadlock;
+// forget the key and abort.
+func (tx *LTransaction) timedOut(n int) error {
+	tx.w.Nstats[NLOCKTIMEOUT]++
+	dlog.Printf("Timed out locking %v\n", tx.keys[n].key)
+	last := len(tx.keys) - 1
+	// Swap rather than shift, so no two slots share LIST entries
+	tx.keys[n], tx.keys[last] = tx.keys[last], tx.keys[n]
+	tx.keys = tx.keys[:last]
+	return EABORT
+}
+
+// Buffer a write, folding it into an earlier write to k if there is
+// one.
+func (tx *LTransaction) addWrite(k Key, op KeyType, a int32, e Entry, v Value) error {
 	exists, n := tx.already_exists(k)
 	if exists {
-		if tx.keys[n].read == true {
-			log.Fatalf("Already have read lock on this key; cannot upgrade %v\n", k)
+		if err := tx.upgrade(n); err != nil {
+			return err
 		}
+		r := &tx.keys[n]
 		// Already locked.
-		tx.keys[n].v = v
-		tx.keys[n].op = op
-		tx.keys[n].key = k
-		return
+		if r.noset {
+			// Locked by MaybeWrite() or Read(), not written yet
+			if r.br.exists && op != DELETE && r.br.key_type != op {
+				dlog.Printf("%v Doing a %v write to a %v record\n", k, op, r.br.key_type)
+				return ETYPE
+			}
+			r.set(op, a, e, v)
+			r.noset = false
+			return nil
+		}
+		return r.fold(k, op, a, e, v)
 	}
-	br := tx.make_or_get_key(k, op)
-	tx.keys = tx.keys[0 : n+1]
-	tx.keys[n].br = br
-	tx.keys[n].read = false
-	tx.keys[n].v = v
-	tx.keys[n].op = op
-	tx.keys[n].noset = false
-	tx.keys[n].key = k
+	n, err := tx.addKey()
+	if err != nil {
+		return err
+	}
+	r := &tx.keys[n]
+	r.br, err = tx.make_or_get_key(k, op)
+	if err != nil {
+		tx.keys = tx.keys[:n]
+		return err
+	}
+	if r.br.exists && r.br.key_type != op {
+		dlog.Printf("%v Doing a %v write to a %v record\n", k, op, r.br.key_type)
+		r.br.SUnlock()
+		tx.keys = tx.keys[:n]
+		return ETYPE
+	}
+	r.read = false
+	r.noset = false
+	r.key = k
+	r.set(op, a, e, v)
+	return nil
 }
 
-func (tx *LTransaction) WriteList(k Key, l Entry, op KeyType) error {
-	if op != LIST {
-		log.Fatalf("Not a list\n")
+func (tx *LTransaction) WriteInt32(k Key, a int32, op KeyType) error {
+	return tx.addWrite(k, op, a, Entry{}, nil)
+}
+
+func (tx *LTransaction) WriteInt64(k Key, a int64, op KeyType) error {
+	if op != SUM64 && op != MAX64 {
+		return ETYPE
 	}
-	exists, n := tx.already_exists(k)
-	if exists {
-		if tx.keys[n].read == true {
-			log.Fatalf("Already have read lock on this key; cannot upgrade %v\n", k)
+	return tx.addWrite(k, op, 0, Entry{}, a)
+}
+
+func (tx *LTransaction) WriteFloat64(k Key, a float64, op KeyType) error {
+	if op != FSUM && op != FMAX {
+		return ETYPE
+	}
+	return tx.addWrite(k, op, 0, Entry{}, a)
+}
+
+func (tx *LTransaction) Write(k Key, v Value, op KeyType) error {
+	if op == SUM || op == MAX || op == MIN {
+		a, ok := v.(int32)
+		if !ok {
+			return ETYPE
 		}
-		// Already locked.  TODO: append
-		tx.keys[n].ve = l
-		tx.keys[n].op = op
-		tx.keys[n].key = k
-		return nil
+		return tx.WriteInt32(k, a, op)
 	}
-	br := tx.make_or_get_key(k, op)
-	tx.keys = tx.keys[0 : n+1]
-	tx.keys[n].br = br
-	tx.keys[n].read = false
-	tx.keys[n].ve = l
-	tx.keys[n].op = op
-	tx.keys[n].noset = false
-	tx.keys[n].key = k
-	return nil
+	switch op {
+	case SET:
+		e, err := setEntry(v)
+		if err != nil {
+			return err
+		}
+		return tx.addWrite(k, op, 0, e, nil)
+	case SUM64, MAX64:
+		x, ok := v.(int64)
+		if !ok {
+			return ETYPE
+		}
+		return tx.WriteInt64(k, x, op)
+	case FSUM, FMAX:
+		x, ok := v.(float64)
+		if !ok {
+			return ETYPE
+		}
+		return tx.WriteFloat64(k, x, op)
+	case BITMAP:
+		b, err := bitmapValue(v)
+		if err != nil {
+			return err
+		}
+		return tx.addWrite(k, op, 0, Entry{}, b)
+	case HLL:
+		e, err := hllEntry(v)
+		if err != nil {
+			return err
+		}
+		return tx.addWrite(k, op, 0, e, nil)
+	}
+	if op == WRITE && isIndexed(v) {
+		if err := reindex(tx, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.addWrite(k, op, 0, Entry{}, v)
+}
+
+func (tx *LTransaction) WriteList(k Key, l Entry, op KeyType) error {
+	if op != LIST {
+		return ETYPE
+	}
+	return tx.addWrite(k, op, 0, l, nil)
 }
 
 func (tx *LTransaction) WriteOO(k Key, a int32, v Value, op KeyType) error {
 	if op != OOWRITE {
-		log.Fatalf("Not overwrite \n")
+		return ETYPE
 	}
-	exists, n := tx.already_exists(k)
-	if exists {
-		if tx.keys[n].read == true {
-			log.Fatalf("Already have read lock on this key; cannot upgrade %v\n", k)
-		}
-		// Already locked.
-		if a > tx.keys[n].vint32 {
-			tx.keys[n].v = v
-			tx.keys[n].vint32 = a
-			tx.keys[n].op = op
-			tx.keys[n].key = k
+	return tx.addWrite(k, op, a, Entry{}, v)
+}
+
+func (tx *LTransaction) Delete(k Key) error {
+	if err := tx.MaybeWrite(k); err != nil {
+		return err
+	}
+	br, err := tx.Read(k)
+	if err != nil {
+		return err
+	}
+	if br.key_type == WRITE && isIndexed(br.value) {
+		if err := moveEntries(tx, k, br.value, nil); err != nil {
+			return err
 		}
-		return nil
 	}
-	br := tx.make_or_get_key(k, op)
-	tx.keys = tx.keys[0 : n+1]
-	tx.keys[n].br = br
-	tx.keys[n].read = false
-	tx.keys[n].vint32 = a
-	tx.keys[n].v = v
-	tx.keys[n].op = op
-	tx.keys[n].noset = false
-	tx.keys[n].key = k
-	return nil
+	return tx.addWrite(k, DELETE, 0, Entry{}, nil)
 }
 
 func (tx *LTransaction) SetPhase(p int) {
@@ -891,46 +1442,107 @@ func (tx *LTransaction) Worker() *Worker {
 	return tx.w
 }
 
+// Release all locks.  Safe to call more than once, and after Commit().
 func (tx *LTransaction) Abort() TID {
 	for i := len(tx.keys) - 1; i >= 0; i-- {
 		if tx.keys[i].read {
 			tx.keys[i].br.SRUnlock()
 		} else {
-			tx.keys[i].br.SUnlock()
+			tx.unlockUnwritten(&tx.keys[i])
 		}
 	}
+	tx.keys = tx.keys[:0]
 	return 0
 }
 
+// Release a write lock without writing.  If r.br is a placeholder
+// made to lock a missing key, it's a tombstone now; let reclaim()
+// clean it up.
+func (tx *LTransaction) unlockUnwritten(r *Rec) {
+	if !r.br.exists {
+		tx.s.addTomb(r.br)
+	}
+	r.br.SUnlock()
+}
+
+func (tx *LTransaction) logCommit(tid TID) error {
+	l := tx.w.rlog
+	begun := false
+	for i, _ := range tx.keys {
+		r := &tx.keys[i]
+		if r.read || r.noset {
+			continue
+		}
+		if !begun {
+			l.Begin(tid, tx.w.commitEpoch())
+			begun = true
+		}
+		if err := r.logTo(l, r.key); err != nil {
+			l.Discard()
+			return tx.w.logFailed(r.key, err)
+		}
+	}
+	if !begun {
+		return nil
+	}
+	if err := l.Commit(); err != nil {
+		log.Fatalf("%v Could not write redo log: %v\n", tx.w.ID, err)
+	}
+	return nil
+}
+
+// Recovery replays the log, and versions go, in TID order, so commit
+// after whoever last wrote what this transaction has locked.
+func (tx *LTransaction) afterLocked(tid TID) TID {
+	for i := range tx.keys {
+		if _, last := tx.keys[i].br.IsUnlocked(); last >= uint64(tid) {
+			tx.w.resetTID(last)
+			tid = tx.w.commitTID()
+		}
+	}
+	return tid
+}
+
 func (tx *LTransaction) Commit() TID {
-	tid := tx.w.commitTID()
+	for i := range tx.nodes {
+		if !tx.nodes[i].valid() {
+			tx.w.Nstats[NFAIL_VERIFY]++
+			return tx.Abort()
+		}
+	}
+	tid := tx.afterLocked(tx.w.commitTID())
+	if tx.w.rlog != nil {
+		if err := tx.logCommit(tid); err != nil {
+			return tx.Abort()
+		}
+	}
+	// Apply everything before unlocking anything, so new keys are in
+	// their ordered indexes before a scan that missed them can get a
+	// lock I hold
+	for i := range tx.keys {
+		if tx.keys[i].read == false && !tx.keys[i].noset {
+			tx.keys[i].apply(tx.s, tx.keys[i].br)
+			if *Versions > 0 {
+				tx.s.addVersion(tx.keys[i].br, tid)
+			}
+			tx.keys[i].br.setLast(tid)
+		}
+	}
 	for i := len(tx.keys) - 1; i >= 0; i-- {
-		// Apply and unlock
 		if tx.keys[i].read == false {
 			if tx.keys[i].noset {
 				// No changes, we write-locked it because we thought
 				// we *might* write
-				tx.keys[i].br.SUnlock()
+				tx.unlockUnwritten(&tx.keys[i])
 				continue
 			}
-			switch tx.keys[i].op {
-			case SUM:
-				tx.s.SetInt32(tx.keys[i].br, tx.keys[i].vint32, tx.keys[i].op)
-			case MAX:
-				tx.s.SetInt32(tx.keys[i].br, tx.keys[i].vint32, tx.keys[i].op)
-			case LIST:
-				tx.s.SetList(tx.keys[i].br, tx.keys[i].ve, tx.keys[i].op)
-			case OOWRITE:
-				tx.s.SetOO(tx.keys[i].br, tx.keys[i].vint32, tx.keys[i].v, tx.keys[i].op)
-			default:
-				tx.s.Set(tx.keys[i].br, tx.keys[i].v, tx.keys[i].op)
-			}
 			tx.keys[i].br.SUnlock()
 		} else {
 			//fmt.Printf("k: %v\n", tx.keys[i].br.key)
 			tx.keys[i].br.SRUnlock()
 		}
 	}
+	tx.keys = tx.keys[:0]
 	return tid
 }
 
@@ -0,0 +1,176 @@
+package ddtxn
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/narula/ddtxn/dlog"
+)
+
+type pendingReply struct {
+	W chan struct {
+		R *Result
+		E error
+	}
+	r *Result
+}
+
+// Everything one worker logged in one epoch.
+type logBatch struct {
+	f       *os.File
+	close   bool // last batch for f
+	w       int
+	epoch   TID
+	next    TID
+	buf     []byte
+	replies []pendingReply
+}
+
+// Silo-style group commit.  Workers buffer their redo records for an
+// epoch and hand them over when they move to the next epoch; a worker
+// moving to epoch next promises it has nothing more to log in any
+// epoch before next.  The logger writes and fsyncs the batches, and an
+// epoch is durable once every worker has handed it over and it is on
+// disk.  Results for clients waiting on Query.W are held until then.
+//
+// The durable epoch is also kept on disk, so recovery can throw away
+// records from epochs that only some workers got to disk.
+type GroupLogger struct {
+	padding  [128]byte
+	durable  uint64
+	f        *os.File
+	batches  chan *logBatch
+	handed   []TID
+	waiting  []*logBatch
+	stopped  chan bool
+	padding1 [128]byte
+}
+
+func DurableFileName(dir string) string {
+	return filepath.Join(dir, "durable")
+}
+
+func NewGroupLogger(dir string, n int) *GroupLogger {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatalf("Could not create log directory %v: %v\n", dir, err)
+	}
+	f, err := os.OpenFile(DurableFileName(dir), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("Could not open durable epoch file: %v\n", err)
+	}
+	g := &GroupLogger{
+		f:       f,
+		batches: make(chan *logBatch, 16*n),
+		handed:  make([]TID, n),
+		stopped: make(chan bool),
+	}
+	go g.run()
+	return g
+}
+
+func (g *GroupLogger) Durable() TID {
+	return TID(atomic.LoadUint64(&g.durable))
+}
+
+func (g *GroupLogger) run() {
+	dirty := make(map[*os.File]bool)
+	for b := range g.batches {
+		g.write(b, dirty)
+		// Pick up whatever else is ready so one fsync covers it.
+		more := true
+		for more {
+			select {
+			case b, ok := <-g.batches:
+				if !ok {
+					more = false
+					break
+				}
+				g.write(b, dirty)
+			default:
+				more = false
+			}
+		}
+		for f, _ := range dirty {
+			if err := f.Sync(); err != nil {
+				log.Fatalf("Could not sync redo log: %v\n", err)
+			}
+			delete(dirty, f)
+		}
+		g.advance()
+	}
+	g.f.Close()
+	close(g.stopped)
+}
+
+func (g *GroupLogger) write(b *logBatch, dirty map[*os.File]bool) {
+	if len(b.buf) > 0 {
+		if _, err := b.f.Write(b.buf); err != nil {
+			log.Fatalf("%v Could not write redo log: %v\n", b.w, err)
+		}
+		dirty[b.f] = true
+	}
+	if b.close {
+		if err := b.f.Sync(); err != nil {
+			log.Fatalf("%v Could not sync redo log: %v\n", b.w, err)
+		}
+		b.f.Close()
+		delete(dirty, b.f)
+	}
+	if b.next-EPOCH_INCR > g.handed[b.w] {
+		g.handed[b.w] = b.next - EPOCH_INCR
+	}
+	if len(b.replies) > 0 {
+		g.waiting = append(g.waiting, b)
+	}
+}
+
+// Move the durable epoch up to the newest epoch every worker has
+// handed over, and answer the clients who were waiting on it.
+func (g *GroupLogger) advance() {
+	d := g.handed[0]
+	for i := 1; i < len(g.handed); i++ {
+		if g.handed[i] < d {
+			d = g.handed[i]
+		}
+	}
+	if d != g.Durable() {
+		var x [8]byte
+		binary.LittleEndian.PutUint64(x[:], uint64(d))
+		if _, err := g.f.WriteAt(x[:], 0); err != nil {
+			log.Fatalf("Could not write durable epoch: %v\n", err)
+		}
+		if err := g.f.Sync(); err != nil {
+			log.Fatalf("Could not sync durable epoch: %v\n", err)
+		}
+		atomic.StoreUint64(&g.durable, uint64(d))
+	}
+	j := 0
+	for _, b := range g.waiting {
+		if b.epoch > d {
+			g.waiting[j] = b
+			j++
+			continue
+		}
+		for _, r := range b.replies {
+			// Don't let a client that went away hold up the log.
+			select {
+			case r.W <- struct {
+				R *Result
+				E error
+			}{r.r, nil}:
+			default:
+				dlog.Printf("Dropped a reply; no room on its channel\n")
+			}
+		}
+	}
+	g.waiting = g.waiting[:j]
+}
+
+// Write out everything handed over so far and stop.
+func (g *GroupLogger) Stop() {
+	close(g.batches)
+	<-g.stopped
+}
@@ -0,0 +1,111 @@
+package ddtxn
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HLL records count distinct keys approximately, with a HyperLogLog
+// sketch of HLL_REGISTERS one-byte registers kept in value.  Writing
+// a Key to one adds it; reads get the estimated number of distinct
+// keys added, off by about 1.6%.  Sketches merge by taking the larger
+// of each register, so Doppel splits them: each worker keeps its own
+// sketch during a split phase.  Like a BITMAP's, the record's sketch
+// is never changed in place.
+const (
+	HLL_BITS      = 12
+	HLL_REGISTERS = 1 << HLL_BITS
+)
+
+func hllHash(k Key) uint64 {
+	h := fnv.New64a()
+	h.Write(k[:])
+	// fnv's low bits are poor; mix them (from splitmix64)
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Add k to the sketch in regs, in place.
+func hllAdd(regs []byte, k Key) {
+	h := hllHash(k)
+	i := h >> (64 - HLL_BITS)
+	// The position of the first 1 in the rest, which is never all 0s
+	r := byte(bits.LeadingZeros64(h<<HLL_BITS|1<<(HLL_BITS-1))) + 1
+	if r > regs[i] {
+		regs[i] = r
+	}
+}
+
+// A copy of regs to change, or an empty sketch if regs is nil.
+func hllCopy(regs []byte) []byte {
+	x := make([]byte, HLL_REGISTERS)
+	copy(x, regs)
+	return x
+}
+
+// a merged with b, in a new slice.
+func hllMerge(a, b []byte) []byte {
+	x := hllCopy(a)
+	for i := range b {
+		if b[i] > x[i] {
+			x[i] = b[i]
+		}
+	}
+	return x
+}
+
+// The number of distinct keys added to the sketch in regs.
+func hllEstimate(regs []byte) uint64 {
+	if regs == nil {
+		return 0
+	}
+	m := float64(HLL_REGISTERS)
+	sum := 0.0
+	zeros := 0
+	for _, r := range regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Few keys; count the empty registers instead
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// The entry buffered for a write of v to an HLL record, or ETYPE if v
+// isn't a Key.
+func hllEntry(v Value) (Entry, error) {
+	k, ok := v.(Key)
+	if !ok {
+		return Entry{}, ETYPE
+	}
+	return Entry{key: k}, nil
+}
+
+// An HLL record's sketch; don't change it.
+func (br *BRecord) Sketch() []byte {
+	b, _ := br.value.([]byte)
+	return b
+}
+
+// An HLL record's estimated number of distinct keys.
+func (br *BRecord) Estimate() uint64 {
+	return hllEstimate(br.Sketch())
+}
+
+// Add the keys in entries to an HLL record.
+func (s *Store) SetHLL(br *BRecord, entries []Entry) {
+	s.cow(br)
+	regs := hllCopy(br.Sketch())
+	for i := range entries {
+		hllAdd(regs, entries[i].key)
+	}
+	br.value = regs
+}
@@ -0,0 +1,259 @@
+package ddtxn
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/narula/ddtxn/dlog"
+)
+
+// A secondary index over WRITE records holding values of one type.
+// Each such record has at most one entry per index: a WRITE record
+// at the key Entry() returns, whose value is the indexed record's
+// Key.  Transactions move entries in the same commit that changes
+// the record, so an entry is there exactly when its record holds a
+// value that maps to it.
+//
+// Entries of a unique index are shared by every record mapping to
+// them, and writing a second one returns EUNIQUE.  Entries of other
+// indexes should include the record's key, for instance with
+// PrefixKey(); keep them under a prefix passed to AddOrdered() to
+// find them with Scan().
+//
+// An index with List set instead of Entry keeps its entries in LIST
+// records, which Doppel can split.  A record's Entry is added to the
+// list when it comes to map to that list, but a LIST only keeps its
+// top entries and can't drop one, so readers must check that the
+// record still holds a value that maps there.
+type Index struct {
+	Name    string
+	Example Value // a value of the type indexed
+	Unique  bool
+	// The entry for record k holding v, or false if it has none
+	Entry func(k Key, v Value) (Key, bool)
+	// For a unique index whose Entry() is a hash of part of the
+	// value: whether a and b have the same part.  Values that only
+	// collide take the next free entry after it.
+	Same func(a, b Value) bool
+	// The LIST record for record k holding v, and its Entry there
+	List func(k Key, v Value) (Key, Entry, bool)
+	t    reflect.Type
+}
+
+// What an entry of an index with Same holds once its record has
+// moved on; later entries past it still count.
+var vacant = Key{}
+
+var indexes []*Index
+
+// Maintain x in every store.  Like RegisterTxn(), call it in init(),
+// before any store exists.
+func RegisterIndex(x *Index) {
+	x.t = reflect.TypeOf(x.Example)
+	for _, y := range indexes {
+		if y.Name == x.Name {
+			log.Fatalf("Index %v already registered\n", x.Name)
+		}
+	}
+	indexes = append(indexes, x)
+}
+
+// Whether some index covers values like v.
+func isIndexed(v Value) bool {
+	if v == nil {
+		return false
+	}
+	t := reflect.TypeOf(v)
+	for _, x := range indexes {
+		if x.t == t {
+			return true
+		}
+	}
+	return false
+}
+
+// k is about to hold v.  Read what it holds now and move its entries.
+func reindex(tx ETransaction, k Key, v Value) error {
+	if err := tx.MaybeWrite(k); err != nil {
+		return err
+	}
+	var old Value
+	br, err := tx.Read(k)
+	if err == nil {
+		old = br.Value()
+	} else if err != ENOKEY {
+		return err
+	}
+	return moveEntries(tx, k, old, v)
+}
+
+// Replace k's entries for old with ones for v; either may be nil.
+func moveEntries(tx ETransaction, k Key, old, v Value) error {
+	for _, x := range indexes {
+		ov, nv := old, v
+		if ov != nil && reflect.TypeOf(ov) != x.t {
+			ov = nil
+		}
+		if nv != nil && reflect.TypeOf(nv) != x.t {
+			nv = nil
+		}
+		if x.List != nil {
+			if err := moveListEntry(tx, x, k, ov, nv); err != nil {
+				return err
+			}
+			continue
+		}
+		var oe, ne Key
+		var had, has bool
+		if ov != nil {
+			oe, had = x.Entry(k, ov)
+		}
+		if nv != nil {
+			ne, has = x.Entry(k, nv)
+		}
+		if had && has && oe == ne && (x.Same == nil || x.Same(ov, nv)) {
+			continue
+		}
+		if had {
+			if err := dropEntry(tx, x, k, oe); err != nil {
+				return err
+			}
+		}
+		if !has {
+			continue
+		}
+		if x.Unique {
+			var err error
+			if ne, err = freeEntry(tx, x, k, nv, ne); err != nil {
+				return err
+			}
+		}
+		if err := tx.Write(ne, k, WRITE); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add k's Entry to the list v maps to, unless old mapped there too.
+func moveListEntry(tx ETransaction, x *Index, k Key, old, v Value) error {
+	if v == nil {
+		return nil
+	}
+	l, e, has := x.List(k, v)
+	if !has {
+		return nil
+	}
+	if old != nil {
+		if ol, _, had := x.List(k, old); had && ol == l {
+			return nil
+		}
+	}
+	return tx.WriteList(l, e, LIST)
+}
+
+// Remove k's entry, which is at e or, for an index with Same, past
+// it.
+func dropEntry(tx ETransaction, x *Index, k Key, e Key) error {
+	if x.Same == nil {
+		if err := tx.Delete(e); err != nil && err != ENOKEY {
+			return err
+		}
+		return nil
+	}
+	for {
+		if err := tx.MaybeWrite(e); err != nil {
+			return err
+		}
+		br, err := tx.Read(e)
+		if err == ENOKEY {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if o, ok := br.Value().(Key); ok && o == k {
+			return tx.Write(e, vacant, WRITE)
+		}
+		e, _ = nextKey(e)
+	}
+}
+
+// The entry of unique index x for k holding v, searching from e: the
+// one k has already, or a free one.  EUNIQUE if another record has
+// it.
+func freeEntry(tx ETransaction, x *Index, k Key, v Value, e Key) (Key, error) {
+	var free Key
+	found := false
+	for {
+		if err := tx.MaybeWrite(e); err != nil {
+			return e, err
+		}
+		br, err := tx.Read(e)
+		if err == ENOKEY {
+			break
+		} else if err != nil {
+			return e, err
+		}
+		o, ok := br.Value().(Key)
+		if ok && o == k {
+			return e, nil
+		}
+		if x.Same == nil {
+			dlog.Printf("%v: %v already has %v\n", x.Name, e, br.Value())
+			return e, EUNIQUE
+		}
+		if o == vacant {
+			if !found {
+				free, found = e, true
+			}
+		} else if obr, err := tx.Read(o); err != nil {
+			return e, err
+		} else if x.Same(obr.Value(), v) {
+			dlog.Printf("%v: %v already has %v\n", x.Name, e, o)
+			return e, EUNIQUE
+		}
+		e, _ = nextKey(e)
+	}
+	if found {
+		return free, nil
+	}
+	return e, nil
+}
+
+// Add entries for data loaded with CreateKey().
+func (s *Store) loadEntries(k Key, v Value) {
+	t := reflect.TypeOf(v)
+	for _, x := range indexes {
+		if x.t != t {
+			continue
+		}
+		if x.List != nil {
+			if l, le, ok := x.List(k, v); ok {
+				br, err := s.getKey(l, nil)
+				if err != nil {
+					br = s.CreateKey(l, nil, LIST)
+				}
+				s.SetList(br, le, LIST)
+			}
+			continue
+		}
+		e, ok := x.Entry(k, v)
+		if !ok {
+			continue
+		}
+		for x.Unique {
+			br, err := s.getKey(e, nil)
+			if err != nil || br.value == k || br.value == vacant {
+				break
+			}
+			if x.Same != nil {
+				if obr, err := s.getKey(br.value.(Key), nil); err != nil || !x.Same(obr.value, v) {
+					e, _ = nextKey(e)
+					continue
+				}
+			}
+			log.Fatalf("%v: %v and %v both have %v\n", x.Name, k, br.value, e)
+		}
+		s.CreateKey(e, k, WRITE)
+	}
+}
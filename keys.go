@@ -57,6 +57,17 @@ func SKey(s string) Key {
 	return Key(b)
 }
 
+// Keys with the same prefix (up to 8 bytes) sort by x, for ordered
+// indexes.
+func PrefixKey(prefix string, x uint64) Key {
+	var b [16]byte
+	n := copy(b[:8], prefix)
+	for i := 0; i < 8; i++ {
+		b[n+i] = byte(x >> uint(56-8*i))
+	}
+	return Key(b)
+}
+
 func UserKey(bidder uint64) Key {
 	return CKey(uint64(bidder), 'u')
 }
@@ -4,21 +4,28 @@ import (
 	"fmt"
 	"log"
 	"runtime/debug"
+	"sync/atomic"
 )
 
 // Local per-worker store. Specific types to more quickly apply local
-// changes
+// changes.  The maps only have keys written since the last Merge().
 
 type LocalStore struct {
 	padding0   [128]byte
 	sums       map[Key]int32
 	max        map[Key]int32
+	min        map[Key]int32
+	wide       map[Key]wide    // SUM64, MAX64, FSUM and FMAX
+	sets       map[Key][]Entry // members added, sorted
+	bitmaps    map[Key][]byte
+	hlls       map[Key][]byte // sketches, changed in place
 	bw         map[Key]Value
 	lists      map[Key][]Entry
 	oos        map[Key]Overwrite
 	s          *Store
 	Ncopy      int64
 	candidates *Candidates
+	merged     []*BRecord // for versionMerged()
 	padding    [128]byte
 }
 
@@ -28,6 +35,11 @@ func NewLocalStore(s *Store) *LocalStore {
 	ls := &LocalStore{
 		sums:       make(map[Key]int32),
 		max:        make(map[Key]int32),
+		min:        make(map[Key]int32),
+		wide:       make(map[Key]wide),
+		sets:       make(map[Key][]Entry),
+		bitmaps:    make(map[Key][]byte),
+		hlls:       make(map[Key][]byte),
 		bw:         make(map[Key]Value),
 		lists:      make(map[Key][]Entry),
 		oos:        make(map[Key]Overwrite),
@@ -37,26 +49,15 @@ func NewLocalStore(s *Store) *LocalStore {
 	return ls
 }
 
-func (ls *LocalStore) ApplyList(key Key, entry Entry) {
-	l, ok := ls.lists[key]
-	if !ok {
-		l = make([]Entry, 0, 300)
-		ls.lists[key] = l
-	}
-	// TODO: Use listApply or add one to list to keep them sorted;
-	// handle duplicates
-	ls.lists[key] = append(l, entry)
+// Keeps each key's entries the way l says, so Merge() can hand them
+// to BRecord.Apply().
+func (ls *LocalStore) ApplyList(key Key, entry Entry, l ListSpec) {
+	ls.lists[key] = l.add(ls.lists[key], entry)
 }
 
 func (ls *LocalStore) ApplyOO(key Key, a int32, v Value) {
-	y, ok := ls.oos[key]
-	if !ok {
-		y = Overwrite{v: v, i: a}
-	}
-	if y.i < a {
-		y.i = a
-		y.v = v
-		ls.oos[key] = y
+	if y, ok := ls.oos[key]; !ok || y.i < a {
+		ls.oos[key] = Overwrite{v: v, i: a}
 	}
 }
 
@@ -73,6 +74,47 @@ func (ls *LocalStore) ApplyInt32(key Key, key_type KeyType, a int32, op KeyType)
 		if ls.max[key] < delta {
 			ls.max[key] = delta
 		}
+	case MIN:
+		ls.applyMin(key, a)
+	}
+}
+
+func (ls *LocalStore) ApplySet(key Key, member Key) {
+	ls.sets[key] = applyMember(ls.sets[key], Entry{order: SET_ADD, key: member})
+}
+
+func (ls *LocalStore) ApplyBitmap(key Key, b []byte) {
+	ls.bitmaps[key] = orBits(ls.bitmaps[key], b)
+}
+
+func (ls *LocalStore) ApplyHLL(key Key, k Key) {
+	regs, ok := ls.hlls[key]
+	if !ok {
+		regs = hllCopy(nil)
+		ls.hlls[key] = regs
+	}
+	hllAdd(regs, k)
+}
+
+// A 64-bit number accumulated for a key, kept as in BRecord.value64.
+type wide struct {
+	op KeyType
+	x  uint64
+}
+
+func (ls *LocalStore) applyWide(key Key, op KeyType, v Value) {
+	y, ok := ls.wide[key]
+	if !ok {
+		y = wide{op: op, x: bits64(v)}
+	} else {
+		y.x = combine64(op, y.x, v)
+	}
+	ls.wide[key] = y
+}
+
+func (ls *LocalStore) applyMin(key Key, a int32) {
+	if x, ok := ls.min[key]; !ok || a < x {
+		ls.min[key] = a
 	}
 }
 
@@ -89,13 +131,25 @@ func (ls *LocalStore) Apply(key Key, key_type KeyType, v Value, op KeyType) {
 		if ls.max[key] < delta {
 			ls.max[key] = delta
 		}
+	case MIN:
+		ls.applyMin(key, v.(int32))
+	case SUM64, MAX64, FSUM, FMAX:
+		ls.applyWide(key, op, v)
+	case BITMAP:
+		ls.ApplyBitmap(key, v.([]byte))
+	case HLL:
+		ls.ApplyHLL(key, v.(Key))
 	case WRITE:
 		ls.bw[key] = v
 	case OOWRITE:
 		x := v.(Overwrite)
 		ls.ApplyOO(key, x.i, x.v)
 	case LIST:
-		ls.ApplyList(key, v.(Entry))
+		l := ListSpec{Size: DEFAULT_LIST_SIZE}
+		if br, err := ls.s.getKey(key, nil); err == nil {
+			l = br.ListSpec()
+		}
+		ls.ApplyList(key, v.(Entry), l)
 	}
 }
 
@@ -105,29 +159,95 @@ func (ls *LocalStore) Merge() {
 			debug.PrintStack()
 			log.Fatalf("Why is there derived data %v %v\n", k, v)
 		}
+		delete(ls.sums, k)
 		if v == 0 {
 			continue
 		}
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, int32(0), SUM), SUM)
+		ls.s.cow(d)
+		d.Apply(v)
+		ls.versioned(d)
+		ls.Ncopy++
+	}
+
+	for k, v := range ls.max {
+		if *SysType == OCC {
+			debug.PrintStack()
+			log.Fatalf("Why is there derived data %v %v\n", k, v)
+		}
+		delete(ls.max, k)
 		if v == 0 {
 			continue
 		}
-		d := ls.s.getOrCreateTypedKey(k, int32(0), SUM)
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, int32(0), MAX), MAX)
+		ls.s.cow(d)
 		d.Apply(v)
-		ls.sums[k] = 0
+		ls.versioned(d)
 		ls.Ncopy++
 	}
 
-	for k, v := range ls.max {
+	for k, v := range ls.min {
+		if *SysType == OCC {
+			debug.PrintStack()
+			log.Fatalf("Why is there derived data %v %v\n", k, v)
+		}
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, MIN), MIN)
+		ls.s.cow(d)
+		d.Apply(v)
+		ls.versioned(d)
+		delete(ls.min, k)
+		ls.Ncopy++
+	}
+
+	for k, v := range ls.wide {
 		if *SysType == OCC {
 			debug.PrintStack()
 			log.Fatalf("Why is there derived data %v %v\n", k, v)
 		}
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, v.op), v.op)
+		ls.s.cow(d)
+		d.Apply(value64(v.op, v.x))
+		ls.versioned(d)
+		delete(ls.wide, k)
+		ls.Ncopy++
+	}
 
-		if v == 0 {
-			continue
+	for k, v := range ls.sets {
+		if *SysType == OCC {
+			debug.PrintStack()
+			log.Fatalf("Why is there derived data %v %v\n", k, v)
 		}
-		d := ls.s.getOrCreateTypedKey(k, int32(0), MAX)
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, SET), SET)
+		ls.s.cow(d)
 		d.Apply(v)
+		ls.versioned(d)
+		delete(ls.sets, k)
+		ls.Ncopy++
+	}
+
+	for k, v := range ls.bitmaps {
+		if *SysType == OCC {
+			debug.PrintStack()
+			log.Fatalf("Why is there derived data %v %v\n", k, v)
+		}
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, BITMAP), BITMAP)
+		ls.s.cow(d)
+		d.Apply(v)
+		ls.versioned(d)
+		delete(ls.bitmaps, k)
+		ls.Ncopy++
+	}
+
+	for k, v := range ls.hlls {
+		if *SysType == OCC {
+			debug.PrintStack()
+			log.Fatalf("Why is there derived data %v %v\n", k, v)
+		}
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, HLL), HLL)
+		ls.s.cow(d)
+		d.Apply(v)
+		ls.versioned(d)
+		delete(ls.hlls, k)
 		ls.Ncopy++
 	}
 
@@ -137,8 +257,11 @@ func (ls *LocalStore) Merge() {
 			log.Fatalf("Why is there derived data %v %v\n", k, v)
 		}
 
-		d := ls.s.getOrCreateTypedKey(k, "", WRITE)
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, "", WRITE), WRITE)
+		ls.s.cow(d)
 		d.Apply(v)
+		ls.versioned(d)
+		delete(ls.bw, k)
 		ls.Ncopy++
 	}
 
@@ -151,8 +274,10 @@ func (ls *LocalStore) Merge() {
 			continue
 		}
 
-		d := ls.s.getOrCreateTypedKey(k, nil, LIST)
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, LIST), LIST)
+		ls.s.cow(d)
 		d.Apply(v)
+		ls.versioned(d)
 		delete(ls.lists, k)
 		ls.Ncopy++
 	}
@@ -162,9 +287,33 @@ func (ls *LocalStore) Merge() {
 			debug.PrintStack()
 			log.Fatalf("Why is there derived data %v %v\n", k, v)
 		}
-		d := ls.s.getOrCreateTypedKey(k, nil, OOWRITE)
+		d := ls.mergeTo(ls.s.getOrCreateTypedKey(k, nil, OOWRITE), OOWRITE)
+		ls.s.cow(d)
 		d.Apply(v)
+		ls.versioned(d)
 		delete(ls.oos, k)
 		ls.Ncopy++
 	}
 }
+
+// Get d ready to merge split data into: that brings back a
+// tombstone, and puts a new record in its ordered index.  Other
+// workers may be merging into d too.
+func (ls *LocalStore) mergeTo(d *BRecord, kt KeyType) *BRecord {
+	if !d.exists {
+		d.mu.Lock()
+		if !d.exists {
+			ls.s.revive(d, kt)
+		}
+		d.mu.Unlock()
+	}
+	ls.s.indexed(d)
+	return d
+}
+
+// Remember d for versionMerged().
+func (ls *LocalStore) versioned(d *BRecord) {
+	if *Versions > 0 && atomic.CompareAndSwapInt32(&d.vmerged, 0, 1) {
+		ls.merged = append(ls.merged, d)
+	}
+}
@@ -23,22 +23,26 @@ func BenchmarkMany(b *testing.B) {
 		s.CreateKey(ProductKey(i), int32(0), SUM)
 	}
 	for i := 0; i < nb; i++ {
-		s.CreateKey(UserKey(uint64(i)), "x", WRITE)
+		s.CreateKey(UserKey(uint64(i)), int32(0), SUM)
 	}
 	c := NewCoordinator(n, s)
 	val := make([]int32, np)
 
 	var wg sync.WaitGroup
+	b.ReportAllocs()
 	b.StartTimer()
 	for p := 0; p < n; p++ {
 		wg.Add(1)
 		go func(id int) {
 			w := c.Workers[id]
+			// Buys never stash, so one argument struct will do.
+			var args BuyArgs
 			for i := 0; i < b.N/3; i++ {
 				p := ProductKey(i % np)
 				u := UserKey(uint64(i % nb))
 				amt := int32(rand.Intn(100))
-				tx := Query{TXN: D_BUY, K1: u, A: amt, K2: p, W: nil, T: 0}
+				args = BuyArgs{u, p, amt}
+				tx := Query{TXN: D_BUY, Args: &args, W: nil, T: 0}
 				_, err := w.One(tx)
 				if err == nil {
 					atomic.AddInt32(&val[i%np], amt)
@@ -63,25 +67,29 @@ func BenchmarkBuy(b *testing.B) {
 	s := NewStore()
 	// Load
 	for i := 0; i < np; i++ {
-		s.CreateKey(ProductKey(i), int32(0), MAX)
+		s.CreateKey(ProductKey(i), int32(0), SUM)
 	}
 	for i := 0; i < nb; i++ {
-		s.CreateKey(UserKey(uint64(i)), "x", WRITE)
+		s.CreateKey(UserKey(uint64(i)), int32(0), SUM)
 	}
 	c := NewCoordinator(n, s)
 	val := make([]int32, np)
 
 	var wg sync.WaitGroup
+	b.ReportAllocs()
 	b.StartTimer()
 	for p := 0; p < n; p++ {
 		wg.Add(1)
 		go func(id int) {
 			w := c.Workers[id]
+			// Buys never stash, so one argument struct will do.
+			var args BuyArgs
 			for i := 0; i < b.N/3; i++ {
 				p := ProductKey(i % np)
 				u := UserKey(uint64(i % nb))
 				amt := int32(rand.Intn(100))
-				tx := Query{TXN: D_BUY, K1: u, A: amt, K2: p, W: nil, T: 0}
+				args = BuyArgs{u, p, amt}
+				tx := Query{TXN: D_BUY, Args: &args, W: nil, T: 0}
 				_, err := w.One(tx)
 				if err == nil {
 					atomic.AddInt32(&val[i%np], amt)
@@ -112,7 +120,7 @@ func BenchmarkRead(b *testing.B) {
 		s.CreateKey(ProductKey(i), int32(0), SUM)
 	}
 	for i := 0; i < nb; i++ {
-		s.CreateKey(UserKey(uint64(i)), "x", WRITE)
+		s.CreateKey(UserKey(uint64(i)), int32(0), SUM)
 	}
 
 	c := NewCoordinator(n, s)
@@ -120,11 +128,15 @@ func BenchmarkRead(b *testing.B) {
 	read_rate := 50
 
 	var wg sync.WaitGroup
+	b.ReportAllocs()
 	b.StartTimer()
 	for p := 0; p < n; p++ {
 		wg.Add(1)
 		go func(id int) {
 			w := c.Workers[id]
+			// A stashed read is waited for, so these can be reused.
+			var buy BuyArgs
+			var read KeyArgs
 			for i := 0; i < b.N/3; i++ {
 				p := ProductKey(i % np)
 				u := UserKey(uint64(i % nb))
@@ -132,18 +144,20 @@ func BenchmarkRead(b *testing.B) {
 				var tx Query
 				rr := rand.Intn(100)
 				if rr >= read_rate {
-					tx = Query{TXN: D_BUY, K1: u, K2: p, A: amt, W: nil, T: 0}
+					buy = BuyArgs{u, p, amt}
+					tx = Query{TXN: D_BUY, Args: &buy, W: nil, T: 0}
 					_, err := w.One(tx)
 					if err == nil {
 						atomic.AddInt32(&val[i%np], amt)
 					}
 				} else {
-					tx = Query{TXN: D_READ_ONE, K1: p, W: make(chan struct {
+					read = KeyArgs{p}
+					tx = Query{TXN: D_READ_ONE, Args: &read, W: make(chan struct {
 						R *Result
 						E error
-					}), T: 0}
+					}, 1), T: 0}
 					_, err := w.One(tx)
-					if err == ESTASH {
+					if err == ESTASH || err == EPENDING {
 						dlog.Printf("client [%v] waiting for %v; epoch %v\n", w.ID, i%np, w.epoch)
 						<-tx.W
 					}
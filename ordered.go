@@ -0,0 +1,265 @@
+package ddtxn
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ORDERED_LEAF = 64
+)
+
+// Keys starting with an ordered prefix are also kept sorted, so
+// Scan() can read a range of them.  Keys sort byte by byte; see
+// PrefixKey().
+//
+// The index is a list of leaves of up to ORDERED_LEAF records each.
+// Every leaf has a version that changes whenever a record is added to
+// or removed from it; a full leaf is replaced by two new ones and
+// its version changes for good.  A transaction notes the version of
+// every leaf it scans and aborts if any changed by the time it
+// commits, so no key can appear in a range it already scanned.
+//
+// Records join the index when they are loaded, or when a transaction
+// first writes them.  Under OCC that's when Commit() creates and locks
+// them, before validating, as in Silo: a scan that missed the key then
+// fails validation or finds it locked.  They leave the index when
+// reclaim() takes them out of the store, or when that Commit() aborts;
+// tombstones stay in it until then.
+type ordered struct {
+	prefix []byte
+	mu     sync.RWMutex
+	leaves []*leaf // sorted; the first starts at the prefix
+}
+
+type leaf struct {
+	low     Key // the smallest key this leaf holds
+	version uint64
+	recs    []*BRecord // sorted by key
+}
+
+// A leaf and its version when a transaction scanned it.
+type leafRead struct {
+	l       *leaf
+	version uint64
+}
+
+func (n *leafRead) valid() bool {
+	return atomic.LoadUint64(&n.l.version) == n.version
+}
+
+func keyLess(a, b Key) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// The key right after k, or false if k is the last one.
+func nextKey(k Key) (Key, bool) {
+	for i := len(k) - 1; i >= 0; i-- {
+		k[i]++
+		if k[i] != 0 {
+			return k, true
+		}
+	}
+	return k, false
+}
+
+// Keep keys starting with prefix in order, so Scan() can read ranges
+// of them.  Prefixes may not overlap.  Call before starting workers;
+// keys already in the store are added.
+func (s *Store) AddOrdered(prefix string) {
+	var low Key
+	copy(low[:], prefix)
+	o := &ordered{
+		prefix: []byte(prefix),
+		leaves: []*leaf{{low: low}},
+	}
+	s.ordered = append(s.ordered, o)
+	s.each(func(br *BRecord) {
+		if br.exists && bytes.HasPrefix(br.key[:], o.prefix) {
+			atomic.StoreInt32(&br.inorder, 1)
+			o.insert(br, nil)
+		}
+	})
+}
+
+func (s *Store) orderedFor(k Key) *ordered {
+	for _, o := range s.ordered {
+		if bytes.HasPrefix(k[:], o.prefix) {
+			return o
+		}
+	}
+	return nil
+}
+
+// br was just written; put it in its ordered index if it has one and
+// isn't there yet.
+func (s *Store) indexed(br *BRecord) {
+	s.indexedBy(br, nil)
+}
+
+// Like indexed(), for a transaction that scanned the leaves in nodes;
+// its own insert doesn't make them stale.
+func (s *Store) indexedBy(br *BRecord, nodes *[]leafRead) {
+	if len(s.ordered) == 0 || atomic.LoadInt32(&br.inorder) == 1 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&br.inorder, 0, 1) {
+		return
+	}
+	if o := s.orderedFor(br.key); o != nil {
+		o.insert(br, nodes)
+	}
+}
+
+// br is leaving the store, or was never written after all.
+func (s *Store) unindexed(br *BRecord) {
+	if !atomic.CompareAndSwapInt32(&br.inorder, 1, 0) {
+		return
+	}
+	if o := s.orderedFor(br.key); o != nil {
+		o.remove(br)
+	}
+}
+
+// The leaf that holds k.  Call with o.mu held.
+func (o *ordered) find(k Key) int {
+	i := sort.Search(len(o.leaves), func(i int) bool {
+		return keyLess(k, o.leaves[i].low)
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+func (l *leaf) search(k Key) int {
+	return sort.Search(len(l.recs), func(i int) bool {
+		return !keyLess(l.recs[i].key, k)
+	})
+}
+
+// Add br to its leaf.  If nodes has the leaf at the version before,
+// update it (or, if the leaf splits, add the new ones) so that only
+// other inserts make it stale.
+func (o *ordered) insert(br *BRecord, nodes *[]leafRead) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := o.find(br.key)
+	l := o.leaves[i]
+	j := l.search(br.key)
+	l.recs = append(l.recs, nil)
+	copy(l.recs[j+1:], l.recs[j:])
+	l.recs[j] = br
+	v := atomic.AddUint64(&l.version, 1)
+	mine := false
+	if nodes != nil {
+		for k := range *nodes {
+			n := &(*nodes)[k]
+			if n.l == l && n.version == v-1 {
+				n.version = v
+				mine = true
+			}
+		}
+	}
+	if len(l.recs) <= ORDERED_LEAF {
+		return
+	}
+	// Split into two new leaves; anyone who scanned l will abort.
+	h := len(l.recs) / 2
+	a := &leaf{low: l.low, recs: make([]*BRecord, h, ORDERED_LEAF+1)}
+	b := &leaf{low: l.recs[h].key, recs: make([]*BRecord, len(l.recs)-h, ORDERED_LEAF+1)}
+	copy(a.recs, l.recs[:h])
+	copy(b.recs, l.recs[h:])
+	leaves := make([]*leaf, 0, len(o.leaves)+1)
+	leaves = append(leaves, o.leaves[:i]...)
+	leaves = append(leaves, a, b)
+	leaves = append(leaves, o.leaves[i+1:]...)
+	o.leaves = leaves
+	if mine {
+		*nodes = append(*nodes, leafRead{l: a}, leafRead{l: b})
+	}
+}
+
+func (o *ordered) remove(br *BRecord) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l := o.leaves[o.find(br.key)]
+	j := l.search(br.key)
+	if j == len(l.recs) || l.recs[j] != br {
+		return
+	}
+	copy(l.recs[j:], l.recs[j+1:])
+	l.recs[len(l.recs)-1] = nil
+	l.recs = l.recs[:len(l.recs)-1]
+	atomic.AddUint64(&l.version, 1)
+}
+
+// Append records with keys from start through end to recs, stopping
+// after n of them if n > 0, and append every leaf looked at to nodes
+// if it isn't nil.  more is true if it stopped because of n.
+func (o *ordered) collect(start, end Key, n int, recs []*BRecord, nodes *[]leafRead) ([]*BRecord, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	got := 0
+	for i := o.find(start); i < len(o.leaves); i++ {
+		l := o.leaves[i]
+		if i > 0 && keyLess(end, l.low) {
+			break
+		}
+		if nodes != nil {
+			*nodes = append(*nodes, leafRead{l: l, version: atomic.LoadUint64(&l.version)})
+		}
+		for j := l.search(start); j < len(l.recs); j++ {
+			if keyLess(end, l.recs[j].key) {
+				return recs, false
+			}
+			if n > 0 && got == n {
+				return recs, true
+			}
+			recs = append(recs, l.recs[j])
+			got++
+		}
+	}
+	return recs, false
+}
+
+// Call f on each record with a key from start through end, in order,
+// until f has taken limit of them (no limit if 0).  f returns false
+// for records the transaction doesn't see, like tombstones.  Both
+// start and end must have the same ordered prefix.
+func (s *Store) scan(start, end Key, limit int, nodes *[]leafRead, f func(br *BRecord) (bool, error)) error {
+	o := s.orderedFor(start)
+	if o == nil || !bytes.HasPrefix(end[:], o.prefix) {
+		return ENOINDEX
+	}
+	var buf []*BRecord
+	taken := 0
+	for !keyLess(end, start) {
+		var more bool
+		want := 0
+		if limit > 0 {
+			want = limit - taken
+		}
+		buf, more = o.collect(start, end, want, buf[:0], nodes)
+		for _, br := range buf {
+			ok, err := f(br)
+			if err != nil {
+				return err
+			}
+			if ok {
+				taken++
+			}
+		}
+		if !more || (limit > 0 && taken == limit) {
+			return nil
+		}
+		// Some weren't taken; keep going after the last one
+		var next bool
+		if start, next = nextKey(buf[len(buf)-1].key); !next {
+			return nil
+		}
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package ddtxn
 import (
 	"flag"
 	"log"
+	"math"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/narula/ddtxn/dlog"
 	"github.com/narula/ddtxn/spinlock"
@@ -13,6 +16,7 @@ import (
 
 var Conflicts = flag.Bool("conflicts", false, "Measure conflicts\n")
 var Spinlock = flag.Bool("spinlock", false, "Use spinlocks for 2PL\n")
+var LockTimeout = flag.Int("lockus", 1000, "2PL gives up on a lock after this many microseconds and aborts with EABORT, so deadlocks resolve; it used to wait forever, which 0 still does\n")
 
 type KeyType int
 
@@ -22,28 +26,80 @@ const (
 	WRITE
 	LIST
 	OOWRITE
+	DELETE // not a record type; what Delete() buffers as a write
+	MIN
+	SUM64 // SUM and MAX of int64s; see WriteInt64()
+	MAX64
+	FSUM // SUM and MAX of float64s; see WriteFloat64()
+	FMAX
+	SET // see sets.go
+	BITMAP
+	HLL // see hll.go
 )
 
+// What a MIN record holds until something writes it, so the first
+// write always lowers it.
+const MIN_EMPTY = math.MaxInt32
+
+// An OOWRITE value: v wins over the current value if i is larger.
 type Overwrite struct {
 	v Value
 	i int32
 }
+
+func MakeOverwrite(v Value, i int32) Overwrite {
+	return Overwrite{v: v, i: i}
+}
+
+func (o Overwrite) Value() Value {
+	return o.v
+}
+
+func (o Overwrite) Order() int32 {
+	return o.i
+}
+
 type BRecord struct {
 	padding   [128]byte
 	key       Key
 	key_type  KeyType
 	int_value int32
+	value64   uint64 // the int64 or float64 bits of SUM64, MAX64, FSUM and FMAX records
 	dd        bool
 	last      wfmutex.WFMutex
 	lock      spinlock.RWSpinlock
 	value     Value
 	entries   []Entry
 	mu        sync.RWMutex
-	conflict  int32 // how many times was the lock already held when someone wanted it
-	exists    bool
+	conflict  int32  // how many times was the lock already held when someone wanted it
+	wlocks    uint64 // times SLock()ed, so an upgrade can tell if it lost its place
+	exists    bool   // false for a tombstone; see Store.tombstone()
+	ckmu      sync.RWMutex
+	ckgen     uint64    // checkpoint generation the record was saved for or created in
+	saved     *recState // contents as of checkpoint ckgen, if modified since
+	snapat    uint64    // snapshot epoch prev was saved for or the record created in
+	prev      recState  // contents as of snapshot snapat, if modified since
+	prevok    bool      // false if the record was created after snapshot snapat
+	loaded    bool      // created by CreateKey(), not a transaction
+	versions  []version // with -versions, oldest first
+	vbase     int32     // 1 once versions has what br held before its first change
+	vmerged   int32     // 1 while waiting for versionMerged()
+	vtid      TID       // in copies from ReadAt(), who wrote this version
+	tombed    int32     // 1 while on Store.tombs
+	inorder   int32     // 1 once given to Store.indexed()
 	padding1  [128]byte
 }
 
+// A record's contents, as saved for a checkpoint.
+type recState struct {
+	key_type  KeyType
+	exists    bool
+	int_value int32
+	value64   uint64
+	value     Value
+	entries   []Entry
+}
+
 func MakeBR(k Key, val Value, kt KeyType) *BRecord {
 	//dlog.Printf("Making %v %v %v\n", k, val, kt)
 	b := &BRecord{
@@ -61,6 +117,15 @@ func MakeBR(k Key, val Value, kt KeyType) *BRecord {
 		if val != nil {
 			b.int_value = val.(int32)
 		}
+	case MIN:
+		b.int_value = MIN_EMPTY
+		if val != nil {
+			b.int_value = val.(int32)
+		}
+	case SUM64, MAX64, FSUM, FMAX:
+		if val != nil {
+			b.value64 = bits64(val)
+		}
 	case WRITE:
 		if val != nil {
 			b.value = val
@@ -73,11 +138,25 @@ func MakeBR(k Key, val Value, kt KeyType) *BRecord {
 			b.int_value = x.i
 		}
 	case LIST:
-		if val == nil {
-			b.entries = make([]Entry, 0)
-		} else {
-			b.entries = make([]Entry, 1)
-			b.entries[0] = val.(Entry)
+		b.entries = make([]Entry, 0)
+		switch x := val.(type) {
+		case Entry:
+			b.entries = append(b.entries, x)
+		case ListSpec:
+			b.int_value = x.encode()
+		}
+	case SET:
+		b.entries = make([]Entry, 0)
+		if val != nil {
+			b.entries = append(b.entries, Entry{order: SET_ADD, key: val.(Key)})
+		}
+	case BITMAP:
+		if val != nil {
+			b.value = orBits(nil, val.([]byte))
+		}
+	case HLL:
+		if val != nil {
+			b.value = hllCopy(val.([]byte))
 		}
 	}
 	return b
@@ -89,6 +168,87 @@ func (br *BRecord) SLock() {
 	} else {
 		br.mu.Lock()
 	}
+	atomic.AddUint64(&br.wlocks, 1)
+}
+
+// Turn a read lock from SRLock() into a write lock.  This drops the
+// read lock while waiting, so two upgraders can't wait on each other.
+// held is false if the write lock timed out, leaving no lock at all.
+// ok is false if anyone else write locked the record in the meantime;
+// what the caller read may be stale and it should abort.
+func (br *BRecord) SUpgrade() (held bool, ok bool) {
+	n := atomic.LoadUint64(&br.wlocks)
+	br.SRUnlock()
+	if !br.SLockTimeout() {
+		return false, false
+	}
+	return true, atomic.LoadUint64(&br.wlocks) == n+1
+}
+
+// SLock(), but give up after -lockus and return false.
+func (br *BRecord) SLockTimeout() bool {
+	if *LockTimeout <= 0 {
+		br.SLock()
+		return true
+	}
+	return br.trySLock() || spinFor(br.trySLock)
+}
+
+// SRLock(), but give up after -lockus and return false.
+func (br *BRecord) SRLockTimeout() bool {
+	if *LockTimeout <= 0 {
+		br.SRLock()
+		return true
+	}
+	return br.trySRLock() || spinFor(br.trySRLock)
+}
+
+func (br *BRecord) trySLock() bool {
+	var ok bool
+	if *Spinlock {
+		ok = br.lock.TryLock()
+	} else {
+		ok = br.mu.TryLock()
+	}
+	if ok {
+		atomic.AddUint64(&br.wlocks, 1)
+	}
+	return ok
+}
+
+func (br *BRecord) trySRLock() bool {
+	if *Spinlock {
+		return br.lock.TryRLock()
+	}
+	return br.mu.TryRLock()
+}
+
+// Keep calling try until it works or -lockus runs out.  Past the
+// first few tries it sleeps, twice as long each time up to 100us, so
+// waiters don't take the CPU from the holder.
+func spinFor(try func() bool) bool {
+	deadline := time.Now().Add(time.Duration(*LockTimeout) * time.Microsecond)
+	nap := time.Microsecond
+	for i := 1; ; i++ {
+		if try() {
+			return true
+		}
+		now := time.Now()
+		if now.After(deadline) {
+			return false
+		}
+		if i < spinlock.PREEMPT {
+			runtime.Gosched()
+			continue
+		}
+		if left := deadline.Sub(now); nap > left {
+			nap = left
+		}
+		time.Sleep(nap)
+		if nap < 100*time.Microsecond {
+			nap *= 2
+		}
+	}
 }
 
 func (br *BRecord) SUnlock() {
@@ -121,10 +281,20 @@ func (br *BRecord) Value() Value {
 		return br.int_value
 	case MAX:
 		return br.int_value
+	case MIN:
+		return br.int_value
+	case SUM64, MAX64, FSUM, FMAX:
+		return value64(br.key_type, atomic.LoadUint64(&br.value64))
 	case WRITE:
 		return br.value
 	case LIST:
 		return br.entries
+	case SET:
+		return br.Members()
+	case BITMAP:
+		return br.Bitmap()
+	case HLL:
+		return br.Estimate()
 	case OOWRITE:
 		if br.value == nil {
 			log.Fatalf("How %v\n", br.key)
@@ -134,6 +304,54 @@ func (br *BRecord) Value() Value {
 	return nil
 }
 
+// Typed getters, for transactions outside this package.
+
+func (br *BRecord) Key() Key {
+	return br.key
+}
+
+func (br *BRecord) Type() KeyType {
+	return br.key_type
+}
+
+func (br *BRecord) Exists() bool {
+	return br.exists
+}
+
+// For a record from ReadAt(), the TID of the transaction that wrote
+// it; 0 if it was loaded.
+func (br *BRecord) Version() TID {
+	return br.vtid
+}
+
+// The value of a SUM, MAX or MIN record, or the order of an OOWRITE
+// one.
+func (br *BRecord) Int32() int32 {
+	return atomic.LoadInt32(&br.int_value)
+}
+
+// The value of a SUM64 or MAX64 record.
+func (br *BRecord) Int64() int64 {
+	return int64(atomic.LoadUint64(&br.value64))
+}
+
+// The value of an FSUM or FMAX record.
+func (br *BRecord) Float64() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&br.value64))
+}
+
+// A copy of a LIST record's entries, in the order its ListSpec says.
+func (br *BRecord) Entries() []Entry {
+	x := make([]Entry, len(br.entries))
+	copy(x, br.entries)
+	return x
+}
+
+// An OOWRITE record's value and the order it was written with.
+func (br *BRecord) OOValue() (Value, int32) {
+	return br.value, br.int_value
+}
+
 func (br *BRecord) Lock() (bool, uint64) {
 	x, last := br.last.Lock()
 	if *Conflicts {
@@ -144,7 +362,14 @@ func (br *BRecord) Lock() (bool, uint64) {
 	return x, last
 }
 
-func (br *BRecord) Unlock(tid TID) {
+func (br *BRecord) Unlock(tid TID) error {
+	return br.last.Unlock(uint64(tid))
+}
+
+// 2PL doesn't lock last, but keeps the TID of br's last write there.
+// The caller holds br's write lock.
+func (br *BRecord) setLast(tid TID) {
+	br.last.Lock()
 	br.last.Unlock(uint64(tid))
 }
 
@@ -174,6 +399,12 @@ func (br *BRecord) Verify(last uint64) bool {
 	return true
 }
 
+// A tombstone no one is writing reads the same as a missing key.
+func (br *BRecord) tombstoned() bool {
+	ok, last := br.IsUnlocked()
+	return ok && !br.exists && br.Verify(last)
+}
+
 func (br *BRecord) Own(last uint64) bool {
 	ok, new_last := br.IsUnlocked()
 	if ok {
@@ -189,6 +420,71 @@ func (br *BRecord) Own(last uint64) bool {
 	return true
 }
 
+func (br *BRecord) state() *recState {
+	st := &recState{}
+	br.copyState(st)
+	return st
+}
+
+func (br *BRecord) copyState(st *recState) {
+	st.key_type = br.key_type
+	st.exists = br.exists
+	st.int_value = atomic.LoadInt32(&br.int_value)
+	st.value64 = atomic.LoadUint64(&br.value64)
+	st.value = br.value
+	st.entries = nil
+	if br.entries != nil {
+		st.entries = make([]Entry, len(br.entries))
+		copy(st.entries, br.entries)
+	}
+}
+
+// Fill in r with br's contents as of snapshot e, or return false if
+// br didn't exist then.  Snapshot e must still be the latest.
+func (br *BRecord) readSnapshot(r *BRecord, e uint64) bool {
+	br.ckmu.RLock()
+	defer br.ckmu.RUnlock()
+	if br.snapat == e {
+		if !br.prevok {
+			return false
+		}
+		// Never changed once saved, so no need to copy the entries
+		return r.fromState(br.key, &br.prev)
+	}
+	// Writers have to save prev under ckmu before changing anything
+	var st recState
+	br.copyState(&st)
+	return r.fromState(br.key, &st)
+}
+
+// Make r a record holding st, or return false if st is a tombstone.
+func (r *BRecord) fromState(k Key, st *recState) bool {
+	if !st.exists {
+		return false
+	}
+	r.key = k
+	r.key_type = st.key_type
+	r.exists = true
+	r.int_value = st.int_value
+	r.value64 = st.value64
+	r.value = st.value
+	r.entries = st.entries
+	return true
+}
+
+// What checkpoint generation g should write for br, or nil if br was
+// created after g started.
+func (br *BRecord) snapshotState(g uint64) *recState {
+	br.ckmu.Lock()
+	defer br.ckmu.Unlock()
+	if br.ckgen < g {
+		return br.state()
+	}
+	st := br.saved
+	br.saved = nil
+	return st
+}
+
 // Used during "merge" phase, along with br.mu
 func (br *BRecord) Apply(val Value) {
 	if br == nil {
@@ -205,6 +501,20 @@ func (br *BRecord) Apply(val Value) {
 		if br.int_value < delta {
 			br.int_value = delta
 		}
+	case MIN:
+		delta := val.(int32)
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		if br.int_value > delta {
+			br.int_value = delta
+		}
+	case SUM64, MAX64, FSUM, FMAX:
+		for {
+			x := atomic.LoadUint64(&br.value64)
+			if atomic.CompareAndSwapUint64(&br.value64, x, combine64(br.key_type, x, val)) {
+				break
+			}
+		}
 	case WRITE:
 		br.mu.Lock()
 		defer br.mu.Unlock()
@@ -214,82 +524,211 @@ func (br *BRecord) Apply(val Value) {
 		defer br.mu.Unlock()
 		entries := val.([]Entry)
 		br.listApply(entries)
+	case SET:
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		br.entries = unionMembers(br.entries, val.([]Entry))
+	case BITMAP:
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		br.value = orBits(br.Bitmap(), val.([]byte))
+	case HLL:
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		br.value = hllMerge(br.Sketch(), val.([]byte))
 	case OOWRITE:
 		br.mu.Lock()
 		defer br.mu.Unlock()
 		x := val.(Overwrite)
-		if br.int_value < x.i {
+		if br.int_value < x.i || br.value == nil {
 			br.int_value = x.i
 			br.value = x.v
 		}
 	}
 }
 
+func isWide(kt KeyType) bool {
+	return kt == SUM64 || kt == MAX64 || kt == FSUM || kt == FMAX
+}
+
+// The bits kept in value64 for an int64 or float64.
+func bits64(v Value) uint64 {
+	switch x := v.(type) {
+	case int64:
+		return uint64(x)
+	case float64:
+		return math.Float64bits(x)
+	}
+	log.Fatalf("Not an int64 or float64: %v\n", v)
+	return 0
+}
+
+// The int64 or float64 in the value64 of a kt record.
+func value64(kt KeyType, x uint64) Value {
+	if kt == SUM64 || kt == MAX64 {
+		return int64(x)
+	}
+	return math.Float64frombits(x)
+}
+
+// What a kt record holding x holds after a write of v.
+func combine64(kt KeyType, x uint64, v Value) uint64 {
+	switch kt {
+	case SUM64:
+		return x + uint64(v.(int64))
+	case MAX64:
+		if y := v.(int64); y > int64(x) {
+			return uint64(y)
+		}
+	case FSUM:
+		return math.Float64bits(math.Float64frombits(x) + v.(float64))
+	case FMAX:
+		if y := v.(float64); y > math.Float64frombits(x) {
+			return math.Float64bits(y)
+		}
+	}
+	return x
+}
+
+// An element of a LIST record.  Lists are kept sorted by order,
+// highest first unless the record's ListSpec says otherwise; key is
+// what the entry refers to and top is for the application.  A list
+// has at most one entry per key.
 type Entry struct {
 	order int
 	key   Key
 	top   int
 }
 
+func MakeEntry(order int, key Key, top int) Entry {
+	return Entry{order: order, key: key, top: top}
+}
+
+func (e Entry) Order() int {
+	return e.order
+}
+
+func (e Entry) Key() Key {
+	return e.key
+}
+
+func (e Entry) Top() int {
+	return e.top
+}
+
 const (
 	DEFAULT_LIST_SIZE = 10
 )
 
-func (br *BRecord) AddOneToRecord(e Entry) {
-	br.entries = AddOneToList(br.entries, e)
+// Which entries a LIST record keeps: the Size with the highest order,
+// or the lowest if Ascending, sorted that way.  Pass one to
+// CreateKey() as a LIST record's value to set it; the zero ListSpec
+// keeps DEFAULT_LIST_SIZE entries, highest first.  A record that is
+// deleted and written again gets the zero ListSpec.
+type ListSpec struct {
+	Size      int
+	Ascending bool
 }
 
-func AddOneToList(lst []Entry, e Entry) []Entry {
-	added := false
-	for i := 0; i < len(lst); i++ {
-		if lst[i].order < e.order {
-			lst := append(lst, Entry{})
-			copy(lst[i+1:], lst[i:])
-			lst[i] = e
-			added = true
+// LIST records keep their ListSpec in int_value: the size, negated
+// if ascending.
+func (l ListSpec) encode() int32 {
+	if l.Size <= 0 || l.Size > math.MaxInt32 {
+		log.Fatalf("Bad list size %v\n", l.Size)
+	}
+	if l.Ascending {
+		return int32(-l.Size)
+	}
+	return int32(l.Size)
+}
+
+func (br *BRecord) ListSpec() ListSpec {
+	n := atomic.LoadInt32(&br.int_value)
+	switch {
+	case n == 0:
+		return ListSpec{Size: DEFAULT_LIST_SIZE}
+	case n < 0:
+		return ListSpec{Size: int(-n), Ascending: true}
+	}
+	return ListSpec{Size: int(n)}
+}
+
+// Whether a goes before b.
+func (l ListSpec) before(a, b Entry) bool {
+	if l.Ascending {
+		return a.order < b.order
+	}
+	return a.order > b.order
+}
+
+// Add e to lst, which follows l, keeping whichever of e and an entry
+// with the same key comes first.
+func (l ListSpec) add(lst []Entry, e Entry) []Entry {
+	for i := range lst {
+		if lst[i].key == e.key {
+			if !l.before(e, lst[i]) {
+				return lst
+			}
+			copy(lst[i:], lst[i+1:])
+			lst = lst[:len(lst)-1]
 			break
 		}
 	}
-	if added {
-		if len(lst) <= DEFAULT_LIST_SIZE {
-			//
-		} else {
-			lst = lst[:DEFAULT_LIST_SIZE]
-		}
-	} else if len(lst) < DEFAULT_LIST_SIZE {
-		// This goes at the end
-		lst = append(lst, e)
-	} else {
-		lst = lst[:DEFAULT_LIST_SIZE]
+	i := 0
+	for i < len(lst) && !l.before(e, lst[i]) {
+		i++
+	}
+	if i == l.Size {
+		return lst
 	}
-	if len(lst) > DEFAULT_LIST_SIZE {
-		log.Fatalf("How did this happen?  %v %v %v\n", e, lst, lst[:DEFAULT_LIST_SIZE])
+	if len(lst) < l.Size {
+		lst = append(lst, Entry{})
 	}
+	copy(lst[i+1:], lst[i:])
+	lst[i] = e
 	return lst
 }
 
-// default desc
-func (br *BRecord) listApply(entries []Entry) {
-	lidx := 0
-	widx := 0
-	i := 0
-	new_entries := make([]Entry, DEFAULT_LIST_SIZE)
-	for i < DEFAULT_LIST_SIZE {
-		if lidx < len(br.entries) && widx < len(entries) && br.entries[lidx].order > entries[widx].order {
-			new_entries[i] = br.entries[lidx]
-			lidx++
-			i++
-		} else if widx < len(entries) {
-			new_entries[i] = entries[widx]
-			widx++
-			i++
-		} else if lidx < len(br.entries) {
-			new_entries[i] = br.entries[lidx]
-			widx++
-			i++
+// Merge sorted lists a and b into a new list following l.
+func (l ListSpec) merge(a, b []Entry) []Entry {
+	x := make([]Entry, 0, l.Size)
+	ai, bi := 0, 0
+	for len(x) < l.Size {
+		var e Entry
+		if ai < len(a) && (bi == len(b) || !l.before(b[bi], a[ai])) {
+			e = a[ai]
+			ai++
+		} else if bi < len(b) {
+			e = b[bi]
+			bi++
 		} else {
 			break
 		}
+		dup := false
+		for i := range x {
+			if x[i].key == e.key {
+				// The one already there comes first
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			x = append(x, e)
+		}
 	}
-	br.entries = new_entries[:i]
+	return x
+}
+
+func (br *BRecord) AddOneToRecord(e Entry) {
+	br.entries = br.ListSpec().add(br.entries, e)
+}
+
+func AddOneToList(lst []Entry, e Entry) []Entry {
+	return ListSpec{Size: DEFAULT_LIST_SIZE}.add(lst, e)
+}
+
+// entries must be sorted and have one entry per key, like the
+// LocalStore's.
+func (br *BRecord) listApply(entries []Entry) {
+	br.entries = br.ListSpec().merge(br.entries, entries)
 }
@@ -0,0 +1,155 @@
+package ddtxn
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type byTID []logRecord
+
+func (r byTID) Len() int           { return len(r) }
+func (r byTID) Less(i, j int) bool { return r[i].tid < r[j].tid }
+func (r byTID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Rebuild a store from the latest checkpoint in dir and the redo logs
+// written since.  Log records are replayed in TID order.  A torn
+// record at the end of a log, or records from epochs that group
+// commit never made durable, are cut off the file so new records
+// append cleanly.  Returns the store and the highest TID recovered;
+// workers started on the store hand out TIDs above it and the
+// coordinator starts in a later epoch.
+func NewStoreFromDisk(dir string) (*Store, TID, error) {
+	s := NewStore()
+	var epoch, maxtid TID
+	ckpt, err := latestCheckpoint(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ckpt != "" {
+		epoch, maxtid, err = s.loadCheckpoint(ckpt)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	cut, err := readDurable(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "worker-*.log"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []logRecord
+	for _, f := range files {
+		r, err := readLog(f, cut)
+		if err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, r...)
+	}
+	sort.Sort(byTID(recs))
+	maxepoch := epoch
+	for i := range recs {
+		r := &recs[i]
+		if r.tid > maxtid {
+			maxtid = r.tid
+		}
+		if r.epoch > maxepoch {
+			maxepoch = r.epoch
+		}
+		if r.epoch < epoch {
+			// Already in the checkpoint
+			continue
+		}
+		for j := range r.writes {
+			s.replay(&r.writes[j])
+		}
+	}
+	s.recoveredTID = maxtid
+	s.recoveredEpoch = maxepoch
+	return s, maxtid, nil
+}
+
+// The group commit watermark, or ^0 if there isn't one.
+func readDurable(dir string) (TID, error) {
+	b, err := ioutil.ReadFile(DurableFileName(dir))
+	if os.IsNotExist(err) {
+		return ^TID(0), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < 8 {
+		// Never advanced, so nothing is durable.
+		return 0, nil
+	}
+	return TID(binary.LittleEndian.Uint64(b)), nil
+}
+
+// Read the records in one worker's log up to the first torn record or
+// the first record from an epoch after cut, and truncate the file
+// there.
+func readLog(file string, cut TID) ([]logRecord, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var recs []logRecord
+	off := 0
+	for off < len(b) {
+		r, n, err := readRecord(b[off:])
+		if err == ETORN || (err == nil && r.epoch > cut) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, r)
+		off += n
+	}
+	if off < len(b) {
+		if err := os.Truncate(file, int64(off)); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// Redo one logged write, the same way Commit() or Merge() would have
+// applied it.
+func (s *Store) replay(w *logWrite) {
+	br, err := s.getKey(w.key, nil)
+	if w.op == DELETE {
+		if err == nil {
+			s.remove(br)
+		}
+		return
+	}
+	if err == ENOKEY {
+		br = s.CreateKey(w.key, nil, w.op)
+	}
+	switch w.op {
+	case SUM, MAX, MIN:
+		br.Apply(w.a)
+	case SUM64, MAX64, FSUM, FMAX:
+		br.Apply(w.v)
+	case WRITE:
+		br.Apply(w.v)
+	case LIST:
+		// Apply() merges a sorted batch; a logged write is one entry.
+		br.AddOneToRecord(w.e)
+	case SET:
+		br.entries = applyMember(br.entries, w.e)
+	case BITMAP:
+		br.Apply(w.v)
+	case HLL:
+		regs := hllCopy(br.Sketch())
+		hllAdd(regs, w.e.key)
+		br.value = regs
+	case OOWRITE:
+		br.Apply(Overwrite{v: w.v, i: w.a})
+	}
+}
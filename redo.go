@@ -0,0 +1,314 @@
+package ddtxn
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var LogDir = flag.String("logdir", "", "Directory for per-worker redo logs.  Empty means no logging\n")
+var FsyncPolicy = flag.Int("fsync", FSYNC_COMMIT, "When to fsync the redo log: 0 never, 1 every commit, 2 every -fsyncms, 3 group commit by epoch\n")
+var FsyncInterval = flag.Int("fsyncms", 10, "Milliseconds between fsyncs with -fsync=2\n")
+
+// Fsync policies
+const (
+	FSYNC_NEVER    = iota // hand records to the OS, never fsync
+	FSYNC_COMMIT          // fsync before Commit() returns
+	FSYNC_INTERVAL        // fsync at most every -fsyncms
+	FSYNC_EPOCH           // buffer per epoch; the GroupLogger makes epochs durable
+)
+
+const (
+	LOG_HEADER = 8 // length, crc32
+)
+
+var ETORN = errors.New("doppel: torn or corrupt log record")
+
+// A redo log for one worker.  Every committed transaction is one
+// record:
+//
+//	length uint32, crc32 uint32, tid uint64, epoch uint64, nwrites uint32,
+//	nwrites x (key [16]byte, op uint8, operand)
+//
+// The operand depends on op; see appendOp().  Writes to split data
+// are logged by the transaction that made them, so a delta sitting in
+// a LocalStore waiting for Merge() is already durable.
+//
+// With FSYNC_EPOCH records pile up in buf until the worker moves to a
+// new epoch and hands them to the GroupLogger with Roll().
+type RedoLog struct {
+	id       int
+	dir      string
+	f        *os.File
+	buf      []byte
+	start    int // offset of the current record in buf
+	n        uint32
+	lastSync time.Time
+	replies  []pendingReply
+}
+
+func GroupCommit() bool {
+	return *LogDir != "" && *FsyncPolicy == FSYNC_EPOCH
+}
+
+func LogFileName(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("worker-%d.log", id))
+}
+
+// A log segment holds records from epochs before e; it can go once
+// there is a checkpoint for e or later.
+func LogSegmentName(dir string, id int, e TID) string {
+	return filepath.Join(dir, fmt.Sprintf("worker-%d-%016x.log", id, uint64(e)))
+}
+
+func OpenRedoLog(dir string, id int) (*RedoLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(LogFileName(dir, id), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &RedoLog{
+		id:       id,
+		dir:      dir,
+		f:        f,
+		buf:      make([]byte, 0, 4096),
+		lastSync: time.Now(),
+	}
+	return l, nil
+}
+
+// Start a record for transaction tid.
+func (l *RedoLog) Begin(tid TID, epoch TID) {
+	l.start = len(l.buf)
+	l.buf = binary.LittleEndian.AppendUint64(l.buf, 0)
+	l.buf = binary.LittleEndian.AppendUint64(l.buf, uint64(tid))
+	l.buf = binary.LittleEndian.AppendUint64(l.buf, uint64(epoch))
+	l.buf = binary.LittleEndian.AppendUint32(l.buf, 0)
+	l.n = 0
+}
+
+// Add one write to the current record.
+func (l *RedoLog) Add(k Key, op KeyType, a int32, e Entry, v Value) error {
+	var err error
+	l.buf = append(l.buf, k[:]...)
+	l.buf = append(l.buf, byte(op))
+	l.buf, err = appendOp(l.buf, op, a, e, v)
+	l.n++
+	return err
+}
+
+// Drop the current record, for a transaction that aborts after all.
+func (l *RedoLog) Discard() {
+	l.buf = l.buf[:l.start]
+}
+
+// Finish the current record and write it out according to the fsync
+// policy.  The record is in the OS (or on disk) when Commit returns,
+// except with FSYNC_EPOCH where it waits for the next Roll().
+func (l *RedoLog) Commit() error {
+	rec := l.buf[l.start:]
+	binary.LittleEndian.PutUint32(rec[LOG_HEADER+16:], l.n)
+	body := rec[LOG_HEADER:]
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(body))
+	if *FsyncPolicy == FSYNC_EPOCH {
+		return nil
+	}
+	_, err := l.f.Write(l.buf)
+	l.buf = l.buf[:0]
+	if err != nil {
+		return err
+	}
+	switch *FsyncPolicy {
+	case FSYNC_COMMIT:
+		return l.f.Sync()
+	case FSYNC_INTERVAL:
+		if time.Since(l.lastSync) >= time.Duration(*FsyncInterval)*time.Millisecond {
+			l.lastSync = time.Now()
+			return l.f.Sync()
+		}
+	}
+	return nil
+}
+
+// Hold on to a committed transaction's result until its epoch is
+// durable.  w must be buffered; see Query.
+func (l *RedoLog) Pend(w chan struct {
+	R *Result
+	E error
+}, r *Result) {
+	if cap(w) == 0 {
+		log.Fatalf("Query.W must be buffered for group commit\n")
+	}
+	l.replies = append(l.replies, pendingReply{w, r})
+}
+
+// Hand everything logged in epoch e to the group logger and start
+// over; the worker is moving on to epoch next.
+func (l *RedoLog) Roll(e TID, next TID) *logBatch {
+	b := &logBatch{f: l.f, w: l.id, epoch: e, next: next, buf: l.buf, replies: l.replies}
+	l.buf = make([]byte, 0, cap(l.buf))
+	l.replies = nil
+	return b
+}
+
+// Move what's been logged so far into a segment for epochs before e
+// and start a new file.  If b is the batch holding the rest of the
+// old file, the group logger closes the old file after writing it.
+func (l *RedoLog) Rotate(e TID, b *logBatch) error {
+	name := LogFileName(l.dir, l.id)
+	if err := os.Rename(name, LogSegmentName(l.dir, l.id, e)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	old := l.f
+	l.f = f
+	if b != nil {
+		b.close = true
+		return nil
+	}
+	if err := old.Sync(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (l *RedoLog) Close() error {
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	return l.f.Close()
+}
+
+func appendOp(buf []byte, op KeyType, a int32, e Entry, v Value) ([]byte, error) {
+	switch op {
+	case SUM, MAX, MIN:
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(a))
+	case SUM64, MAX64, FSUM, FMAX:
+		buf = binary.LittleEndian.AppendUint64(buf, bits64(v))
+	case LIST, SET, HLL:
+		buf = appendEntry(buf, e)
+	case OOWRITE:
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(a))
+		return AppendValue(buf, v)
+	case WRITE, BITMAP:
+		return AppendValue(buf, v)
+	case DELETE:
+		// No operand
+	default:
+		return buf, fmt.Errorf("redo log: unknown op %v", op)
+	}
+	return buf, nil
+}
+
+func appendEntry(buf []byte, e Entry) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.order))
+	buf = append(buf, e.key[:]...)
+	return binary.LittleEndian.AppendUint64(buf, uint64(e.top))
+}
+
+// A committed transaction read back from a redo log.
+type logRecord struct {
+	tid    TID
+	epoch  TID
+	writes []logWrite
+}
+
+type logWrite struct {
+	key Key
+	op  KeyType
+	a   int32
+	e   Entry
+	v   Value
+}
+
+// Parse the record at the start of b.  Returns the record and its
+// length on disk, or ETORN if b doesn't hold a whole, intact record.
+func readRecord(b []byte) (logRecord, int, error) {
+	var r logRecord
+	if len(b) < LOG_HEADER {
+		return r, 0, ETORN
+	}
+	n := int(binary.LittleEndian.Uint32(b[0:]))
+	if n < 20 || len(b)-LOG_HEADER < n {
+		return r, 0, ETORN
+	}
+	body := b[LOG_HEADER : LOG_HEADER+n]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[4:]) {
+		return r, 0, ETORN
+	}
+	r.tid = TID(binary.LittleEndian.Uint64(body[0:]))
+	r.epoch = TID(binary.LittleEndian.Uint64(body[8:]))
+	nw := int(binary.LittleEndian.Uint32(body[16:]))
+	body = body[20:]
+	r.writes = make([]logWrite, nw)
+	for i := 0; i < nw; i++ {
+		w := &r.writes[i]
+		if len(body) < len(w.key)+1 {
+			return r, 0, ETORN
+		}
+		copy(w.key[:], body)
+		w.op = KeyType(body[len(w.key)])
+		var err error
+		body, err = readOp(body[len(w.key)+1:], w)
+		if err != nil {
+			return r, 0, err
+		}
+	}
+	return r, LOG_HEADER + n, nil
+}
+
+func readOp(b []byte, w *logWrite) ([]byte, error) {
+	switch w.op {
+	case SUM, MAX, MIN:
+		if len(b) < 4 {
+			return b, ETORN
+		}
+		w.a = int32(binary.LittleEndian.Uint32(b))
+		return b[4:], nil
+	case SUM64, MAX64, FSUM, FMAX:
+		if len(b) < 8 {
+			return b, ETORN
+		}
+		w.v = value64(w.op, binary.LittleEndian.Uint64(b))
+		return b[8:], nil
+	case LIST, SET, HLL:
+		return readEntry(b, &w.e)
+	case OOWRITE:
+		if len(b) < 4 {
+			return b, ETORN
+		}
+		w.a = int32(binary.LittleEndian.Uint32(b))
+		var err error
+		w.v, b, err = ReadValue(b[4:])
+		return b, err
+	case WRITE, BITMAP:
+		var err error
+		w.v, b, err = ReadValue(b)
+		return b, err
+	case DELETE:
+		return b, nil
+	}
+	return b, ETORN
+}
+
+func readEntry(b []byte, e *Entry) ([]byte, error) {
+	if len(b) < 16+len(e.key) {
+		return b, ETORN
+	}
+	e.order = int(binary.LittleEndian.Uint64(b))
+	copy(e.key[:], b[8:])
+	e.top = int(binary.LittleEndian.Uint64(b[8+len(e.key):]))
+	return b[16+len(e.key):], nil
+}
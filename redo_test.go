@@ -0,0 +1,458 @@
+package ddtxn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedoLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	w := c.Workers[0]
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	tx := Query{TXN: D_BUY, Args: &BuyArgs{UserKey(1), ProductKey(4), 5}}
+	if _, err := w.One(tx); err != nil {
+		t.Fatalf("Buy %v\n", err)
+	}
+	c.Finish()
+
+	b, err := ioutil.ReadFile(LogFileName(dir, 0))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(b) < LOG_HEADER {
+		t.Fatalf("Log too short %v\n", len(b))
+	}
+	n := binary.LittleEndian.Uint32(b[0:])
+	if int(n) != len(b)-LOG_HEADER {
+		t.Fatalf("Wrong record length %v; file %v\n", n, len(b))
+	}
+	if crc32.ChecksumIEEE(b[LOG_HEADER:]) != binary.LittleEndian.Uint32(b[4:]) {
+		t.Errorf("Bad checksum\n")
+	}
+	if nw := binary.LittleEndian.Uint32(b[LOG_HEADER+16:]); nw != 2 {
+		t.Errorf("Expected 2 writes, got %v\n", nw)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	*FsyncPolicy = FSYNC_EPOCH
+	defer func() {
+		*LogDir = ""
+		*FsyncPolicy = FSYNC_COMMIT
+	}()
+
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	for i := 0; i < 2; i++ {
+		tx := Query{TXN: D_BUY, Args: &BuyArgs{UserKey(uint64(i)), ProductKey(4), 5}, W: make(chan struct {
+			R *Result
+			E error
+		}, 1)}
+		// The transaction commits in this epoch or a later one.
+		w := c.Workers[i]
+		w.RLock()
+		e := w.epoch
+		w.RUnlock()
+		if _, err := w.One(tx); err != EPENDING {
+			t.Fatalf("Buy returned %v, expected EPENDING\n", err)
+		}
+		x := <-tx.W
+		if x.E != nil {
+			t.Fatalf("Buy %v\n", x.E)
+		}
+		if c.DurableEpoch() < e {
+			t.Errorf("Got a reply before epoch %v was durable (%v)\n", e, c.DurableEpoch())
+		}
+	}
+	c.Finish()
+
+	for i := 0; i < 2; i++ {
+		b, err := ioutil.ReadFile(LogFileName(dir, i))
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if len(b) < LOG_HEADER || int(binary.LittleEndian.Uint32(b[0:])) != len(b)-LOG_HEADER {
+			t.Errorf("Worker %v: bad log of length %v\n", i, len(b))
+		}
+	}
+}
+
+func TestGroupCommitUnread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	*FsyncPolicy = FSYNC_EPOCH
+	defer func() {
+		*LogDir = ""
+		*FsyncPolicy = FSYNC_COMMIT
+	}()
+
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	defer c.Finish()
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	// A client that never reads its replies doesn't hold up others'
+	gone := make(chan struct {
+		R *Result
+		E error
+	}, 1)
+	for i := 0; i < 3; i++ {
+		c.Workers[0].One(Query{TXN: D_BUY, Args: &BuyArgs{UserKey(1), ProductKey(4), 5}, W: gone})
+	}
+	tx := Query{TXN: D_BUY, Args: &BuyArgs{UserKey(1), ProductKey(4), 5}, W: make(chan struct {
+		R *Result
+		E error
+	}, 1)}
+	if _, err := c.Workers[0].One(tx); err != EPENDING {
+		t.Fatalf("Buy returned %v, expected EPENDING\n", err)
+	}
+	select {
+	case <-tx.W:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No reply behind a client that went away\n")
+	}
+}
+
+func buyN(t *testing.T, c *Coordinator, n int) {
+	for i := 0; i < n; i++ {
+		w := c.Workers[i%len(c.Workers)]
+		tx := Query{TXN: D_BUY, Args: &BuyArgs{UserKey(uint64(i)), ProductKey(4), 5}}
+		if _, err := w.One(tx); err != nil {
+			t.Fatalf("Buy %v\n", err)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	buyN(t, c, 10)
+	c.Finish()
+
+	// Crash in the middle of writing a record.
+	f, err := os.OpenFile(LogFileName(dir, 1), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	good, _ := f.Seek(0, 2)
+	f.Write([]byte{40, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	s2, tid, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	if tid == 0 {
+		t.Errorf("No TID recovered\n")
+	}
+	br, err := s2.Get(ProductKey(4))
+	if err != nil || br.Value().(int32) != 50 {
+		t.Fatalf("Wrong value after recovery %v %v\n", br, err)
+	}
+	if fi, err := os.Stat(LogFileName(dir, 1)); err != nil || fi.Size() != good {
+		t.Errorf("Torn record not cut off %v %v\n", fi.Size(), good)
+	}
+
+	// Checkpoint everything so far, then keep going on top of it.
+	s2.CreateKey(ProductKey(5), "hi", WRITE)
+	s2.CreateKey(ProductKey(6), Overwrite{"there", 3}, OOWRITE)
+	s2.CreateKey(ProductKey(7), Entry{order: 4, top: 2, key: UserKey(1)}, LIST)
+	s2.CreateKey(ProductKey(8), float64(1.5), FSUM)
+	if err := s2.writeCheckpoint(dir, s2.beginSnapshot(), s2.recoveredEpoch+EPOCH_INCR, tid); err != nil {
+		t.Fatalf("Checkpoint %v\n", err)
+	}
+	c2 := NewCoordinator(2, s2)
+	if c2.GetEpoch() <= s2.recoveredEpoch {
+		t.Errorf("Epoch %v did not move past recovered epoch %v\n", c2.GetEpoch(), s2.recoveredEpoch)
+	}
+	if x := c2.Workers[0].commitTID(); x <= tid {
+		t.Errorf("TID %v not bigger than recovered TID %v\n", x, tid)
+	}
+	buyN(t, c2, 4)
+	var tx ETransaction
+	if *SysType == LOCKING {
+		tx = StartLTransaction(c2.Workers[1])
+	} else {
+		tx = StartOTransaction(c2.Workers[1])
+	}
+	tx.Reset()
+	tx.WriteFloat64(ProductKey(8), 2.25, FSUM)
+	tx.WriteInt64(ProductKey(9), 1<<40, SUM64)
+	tx.Write(ProductKey(10), UserKey(2), SET)
+	tx.Write(ProductKey(10), UserKey(1), SET)
+	tx.Write(ProductKey(10), Removal{UserKey(2)}, SET)
+	tx.Write(ProductKey(11), MakeBitmap(3, 17), BITMAP)
+	tx.Write(ProductKey(12), UserKey(1), HLL)
+	tx.Write(ProductKey(12), UserKey(2), HLL)
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort\n")
+	}
+	c2.Finish()
+
+	s3, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	br, _ = s3.Get(ProductKey(4))
+	if br == nil || br.Value().(int32) != 70 {
+		t.Fatalf("Wrong value after second recovery %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(5))
+	if br == nil || br.Value().(string) != "hi" {
+		t.Errorf("Wrong WRITE value from checkpoint %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(6))
+	if br == nil || br.Value().(Overwrite).i != 3 || br.Value().(Overwrite).v.(string) != "there" {
+		t.Errorf("Wrong OOWRITE value from checkpoint %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(7))
+	if br == nil || len(br.entries) != 1 || br.entries[0].top != 2 || br.entries[0].key != UserKey(1) {
+		t.Errorf("Wrong LIST value from checkpoint %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(8))
+	if br == nil || br.Float64() != 3.75 {
+		t.Errorf("Wrong FSUM value %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(9))
+	if br == nil || br.Int64() != 1<<40 {
+		t.Errorf("Wrong SUM64 value %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(10))
+	if br == nil || fmt.Sprint(br.Members()) != fmt.Sprint([]Key{UserKey(1)}) {
+		t.Errorf("Wrong SET value %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(11))
+	if br == nil || !bytes.Equal(br.Bitmap(), MakeBitmap(3, 17)) {
+		t.Errorf("Wrong BITMAP value %v\n", br)
+	}
+	br, _ = s3.Get(ProductKey(12))
+	if br == nil || br.Estimate() != 2 {
+		t.Errorf("Wrong HLL value %v\n", br)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	s.CreateKey(ProductKey(4), int32(0), SUM)
+	buyN(t, c, 10)
+
+	// Keep committing while the checkpoint is taken and written.
+	done := make(chan bool)
+	go func() {
+		buyN(t, c, 200)
+		done <- true
+	}()
+	if err := c.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint %v\n", err)
+	}
+	<-done
+	c.Finish()
+
+	if f, _ := latestCheckpoint(dir); f == "" {
+		t.Fatalf("No checkpoint\n")
+	}
+	if f, _ := filepath.Glob(filepath.Join(dir, "worker-*-*.log")); len(f) != 0 {
+		t.Errorf("Log segments not removed: %v\n", f)
+	}
+	s2, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	br, _ := s2.Get(ProductKey(4))
+	if br == nil || br.Value().(int32) != 1050 {
+		t.Fatalf("Wrong value after recovery %v\n", br)
+	}
+}
+
+var writeChan = RegisterTxn(TxnInfo{Name: "test_write_chan", Fn: Txn(func(t *KeyArgs, tx ETransaction) (*Result, error) {
+	// No codec can encode a channel
+	if err := tx.Write(t.K, make(chan int), WRITE); err != nil {
+		return nil, err
+	}
+	if tx.Commit() == 0 {
+		return nil, EABORT
+	}
+	return nil, nil
+})})
+
+func TestLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(1, s)
+	w := c.Workers[0]
+	s.CreateKey(ProductKey(4), "old", WRITE)
+	s.CreateKey(ProductKey(5), int32(0), SUM)
+	if _, err := w.One(Query{TXN: writeChan, Args: &KeyArgs{ProductKey(4)}}); err == nil || err == EABORT {
+		t.Fatalf("Unloggable write got %v\n", err)
+	}
+	if br, _ := s.Get(ProductKey(4)); br == nil || br.Value() != "old" {
+		t.Errorf("Unloggable write changed the record %v\n", br)
+	}
+	// AtomicIncr() bypasses Commit() but still logs
+	for i := 0; i < 2; i++ {
+		if _, err := w.One(Query{TXN: D_ATOMIC_INCR_ONE, Args: &KeyArgs{ProductKey(5)}}); err != nil {
+			t.Fatalf("AtomicIncr %v\n", err)
+		}
+	}
+	c.Finish()
+
+	s2, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	if br, _ := s2.Get(ProductKey(4)); br != nil {
+		t.Errorf("Recovered the unloggable write %v\n", br)
+	}
+	if br, _ := s2.Get(ProductKey(5)); br == nil || br.Value().(int32) != 2 {
+		t.Errorf("Wrong value after AtomicIncr recovery %v\n", br)
+	}
+}
+
+// 2PL takes TIDs from each worker's own counter, so a write has to get
+// one above the record's last write or replay puts them out of order.
+func TestRecoverLockingOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	c := NewCoordinator(2, s)
+	// Worker 0's TIDs run well ahead of worker 1's
+	c.Workers[0].resetTID(uint64(c.Workers[1].commitTID()) + 1000<<16)
+	for i, v := range []string{"first", "second"} {
+		tx := StartLTransaction(c.Workers[i])
+		tx.Reset()
+		if err := tx.Write(ProductKey(4), v, WRITE); err != nil {
+			t.Fatalf("Write %v %v\n", v, err)
+		}
+		if tx.Commit() == 0 {
+			t.Fatalf("Abort %v\n", v)
+		}
+	}
+	if br, _ := s.Get(ProductKey(4)); br == nil || br.Value() != "second" {
+		t.Fatalf("Wrong value %v\n", br)
+	}
+	c.Finish()
+
+	s2, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	if br, _ := s2.Get(ProductKey(4)); br == nil || br.Value() != "second" {
+		t.Errorf("Wrong value after recovery %v\n", br)
+	}
+}
+
+// An OCC commit that aborts after locking a record leaves its TID
+// alone, so the next write still commits above the last one.
+func TestRecoverAbortOrder(t *testing.T) {
+	if *SysType == LOCKING {
+		return
+	}
+	dir, err := ioutil.TempDir("", "ddtxn")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() { *LogDir = "" }()
+
+	s := NewStore()
+	s.CreateKey(ProductKey(5), int32(0), SUM)
+	c := NewCoordinator(2, s)
+	c.Workers[0].resetTID(uint64(c.Workers[1].commitTID()) + 1000<<16)
+	write := func(tx ETransaction, v string) {
+		if err := tx.Write(ProductKey(4), v, WRITE); err != nil {
+			t.Fatalf("Write %v %v\n", v, err)
+		}
+	}
+	tx := StartOTransaction(c.Workers[0])
+	tx.Reset()
+	write(tx, "first")
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort first\n")
+	}
+	// Locks ProductKey(4), then finds ProductKey(5) locked
+	tx = StartOTransaction(c.Workers[1])
+	tx.Reset()
+	write(tx, "x")
+	if err := tx.WriteInt32(ProductKey(5), 1, SUM); err != nil {
+		t.Fatalf("Write %v\n", err)
+	}
+	br, _ := s.Get(ProductKey(5))
+	_, last := br.Lock()
+	if tx.Commit() != 0 {
+		t.Fatalf("Commit with a locked key\n")
+	}
+	br.Unlock(TID(last))
+	tx = StartOTransaction(c.Workers[1])
+	tx.Reset()
+	write(tx, "second")
+	if tx.Commit() == 0 {
+		t.Fatalf("Abort second\n")
+	}
+	c.Finish()
+
+	s2, _, err := NewStoreFromDisk(dir)
+	if err != nil {
+		t.Fatalf("Recover %v\n", err)
+	}
+	if br, _ := s2.Get(ProductKey(4)); br == nil || br.Value() != "second" {
+		t.Errorf("Wrong value after recovery %v\n", br)
+	}
+}
@@ -0,0 +1,158 @@
+package ddtxn
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A transaction type.  Register it with RegisterTxn() and run it by
+// putting the returned handle in Query.TXN.
+type TxnInfo struct {
+	Name     string // what clients call it, e.g. over the network
+	Label    string // for stats output; defaults to Name
+	ReadOnly bool
+	Snapshot bool // read-only; run as an STransaction
+	Fn       TransactionFunc
+}
+
+// Per-transaction counters, kept by each worker.
+type TxnStats struct {
+	Commits int64
+	Aborts  int64
+	Stashed int64
+	NoKey   int64
+	NoRetry int64
+
+	// Latency in microseconds, with -latency
+	times   [TIMES]int64
+	tooLong int64
+}
+
+var txnmu sync.Mutex
+
+// Built in first, so their handles match worker.go no matter who else
+// registers during package initialization.
+var txnInfo, txnByName = builtinTxns()
+
+func builtinTxns() ([]TxnInfo, map[string]int) {
+	x := []TxnInfo{
+		{Name: "buy", Fn: Txn(BuyTxn)},
+		{Name: "buy_and_read", Fn: Txn(BuyAndReadTxn)},
+		{Name: "read_one", Fn: Txn(ReadOneTxn), ReadOnly: true},
+		{Name: "read_two", Fn: Txn(ReadTxn), ReadOnly: true},
+		{Name: "incr_one", Fn: Txn(IncrTxn)},
+		{Name: "atomic_incr_one", Fn: Txn(AtomicIncr)},
+		{Name: "rubis_bid", Fn: Txn(StoreBidTxn)},
+		{Name: "rubis_viewbidhist", Fn: Txn(ViewBidHistoryTxn), ReadOnly: true},
+		{Name: "rubis_buynow", Fn: Txn(StoreBuyNowTxn)},
+		{Name: "rubis_comment", Fn: Txn(StoreCommentTxn)},
+		{Name: "rubis_newitem", Fn: Txn(NewItemTxn)},
+		{Name: "rubis_putbid", Fn: Txn(PutBidTxn), ReadOnly: true},
+		{Name: "rubis_putcomment", Fn: Txn(PutCommentTxn), ReadOnly: true},
+		{Name: "rubis_register", Fn: Txn(RegisterUserTxn)},
+		{Name: "rubis_searchcat", Fn: Txn(SearchItemsCategTxn), ReadOnly: true},
+		{Name: "rubis_searchreg", Fn: Txn(SearchItemsRegionTxn), ReadOnly: true},
+		{Name: "rubis_view", Fn: Txn(ViewItemTxn), ReadOnly: true},
+		{Name: "rubis_viewuser", Fn: Txn(ViewUserInfoTxn), ReadOnly: true},
+		{Name: "big_incr", Fn: Txn(BigIncrTxn)},
+		{Name: "big_rw", Fn: Txn(BigRWTxn)},
+	}
+	m := make(map[string]int)
+	for i := range x {
+		x[i].Label = x[i].Name
+		m[x[i].Name] = i
+	}
+	if len(x) != BIG_RW+1 {
+		log.Fatalf("%v built-in transactions, expected %v\n", len(x), BIG_RW+1)
+	}
+	return x, m
+}
+
+// Add a transaction type and return its handle.  Register everything
+// before creating a Coordinator; workers only run the transactions
+// that were registered when they started.
+func RegisterTxn(x TxnInfo) int {
+	txnmu.Lock()
+	defer txnmu.Unlock()
+	if x.Name == "" || x.Fn == nil {
+		log.Fatalf("Transaction needs a name and a function: %v\n", x)
+	}
+	if _, ok := txnByName[x.Name]; ok {
+		log.Fatalf("Transaction %v already registered\n", x.Name)
+	}
+	if x.Label == "" {
+		x.Label = x.Name
+	}
+	h := len(txnInfo)
+	txnInfo = append(txnInfo, x)
+	txnByName[x.Name] = h
+	return h
+}
+
+// The handle of the transaction registered as name.
+func LookupTxn(name string) (int, bool) {
+	txnmu.Lock()
+	defer txnmu.Unlock()
+	h, ok := txnByName[name]
+	return h, ok
+}
+
+func GetTxnInfo(h int) TxnInfo {
+	txnmu.Lock()
+	defer txnmu.Unlock()
+	if h < 0 || h >= len(txnInfo) {
+		log.Fatalf("Unknown transaction number %v\n", h)
+	}
+	return txnInfo[h]
+}
+
+func NumTxns() int {
+	txnmu.Lock()
+	defer txnmu.Unlock()
+	return len(txnInfo)
+}
+
+func registeredTxns() []TxnInfo {
+	txnmu.Lock()
+	defer txnmu.Unlock()
+	return append([]TxnInfo(nil), txnInfo...)
+}
+
+func (ts *TxnStats) latency(start time.Time, committed bool) {
+	y := time.Since(start).Nanoseconds() / 1000 // microseconds
+	if y >= TIMES {
+		ts.tooLong++
+	} else if committed {
+		ts.times[y]++
+	}
+}
+
+func (ts *TxnStats) add(x *TxnStats) {
+	ts.Commits += x.Commits
+	ts.Aborts += x.Aborts
+	ts.Stashed += x.Stashed
+	ts.NoKey += x.NoKey
+	ts.NoRetry += x.NoRetry
+	for i := range ts.times {
+		ts.times[i] += x.times[i]
+	}
+	ts.tooLong += x.tooLong
+}
+
+// Counters for each registered transaction, summed over all workers.
+func CollectTxnCounts(coord *Coordinator) []TxnStats {
+	n := 0
+	for _, w := range coord.Workers {
+		if len(w.Txnstats) > n {
+			n = len(w.Txnstats)
+		}
+	}
+	ts := make([]TxnStats, n)
+	for _, w := range coord.Workers {
+		for j := range w.Txnstats {
+			ts[j].add(&w.Txnstats[j])
+		}
+	}
+	return ts
+}
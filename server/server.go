@@ -0,0 +1,217 @@
+// Package server runs transactions for clients on the other end of a
+// TCP connection.  Each connection is handled by one worker, chosen
+// round robin; a worker serves its connections' requests one at a
+// time, in the order they arrive.
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/narula/ddtxn"
+	"github.com/narula/ddtxn/dlog"
+	"github.com/narula/ddtxn/wire"
+)
+
+const (
+	QUEUE = 1024 // requests waiting for each worker
+)
+
+type Server struct {
+	c       *ddtxn.Coordinator
+	work    []chan *call
+	mu      sync.Mutex
+	ln      map[net.Listener]bool
+	conns   map[*conn]bool
+	next    int
+	closed  bool
+	readers sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+type call struct {
+	c  *conn
+	id uint64
+	q  ddtxn.Query
+}
+
+type conn struct {
+	nc   net.Conn
+	w    int
+	out  chan *wire.Response
+	done chan bool
+}
+
+func New(c *ddtxn.Coordinator) *Server {
+	s := &Server{
+		c:     c,
+		work:  make([]chan *call, len(c.Workers)),
+		ln:    make(map[net.Listener]bool),
+		conns: make(map[*conn]bool),
+	}
+	for i := range s.work {
+		s.work[i] = make(chan *call, QUEUE)
+		s.workers.Add(1)
+		go s.run(i)
+	}
+	return s
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Accept connections on ln until Close().
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln[ln] = true
+	s.mu.Unlock()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return nil
+		}
+		c := &conn{
+			nc:   nc,
+			w:    s.next % len(s.work),
+			out:  make(chan *wire.Response, QUEUE),
+			done: make(chan bool),
+		}
+		s.next++
+		s.conns[c] = true
+		s.readers.Add(1)
+		s.mu.Unlock()
+		go s.read(c)
+		go c.write()
+	}
+}
+
+// Stop accepting connections, close the open ones, and wait for the
+// workers to finish what they were handed.  The coordinator keeps
+// running.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for ln, _ := range s.ln {
+		ln.Close()
+	}
+	for c, _ := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.readers.Wait()
+	for i := range s.work {
+		close(s.work[i])
+	}
+	s.workers.Wait()
+	return nil
+}
+
+func (s *Server) read(c *conn) {
+	defer func() {
+		close(c.done)
+		c.nc.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.readers.Done()
+	}()
+	rd := bufio.NewReader(c.nc)
+	for {
+		var req wire.Request
+		if err := wire.ReadRequest(rd, &req); err != nil {
+			dlog.Printf("Closing connection from %v: %v\n", c.nc.RemoteAddr(), err)
+			return
+		}
+		txn, ok := ddtxn.LookupTxn(req.Txn)
+		if !ok {
+			c.reply(req.ID, nil, ddtxn.EUNKNOWNTXN)
+			continue
+		}
+		q := ddtxn.Query{TXN: txn, Args: req.Args}
+		// Stashed transactions, and with group commit all of
+		// them, answer here later.  Buffered so the worker never
+		// waits on us.
+		q.W = make(chan struct {
+			R *ddtxn.Result
+			E error
+		}, 1)
+		s.work[c.w] <- &call{c, req.ID, q}
+	}
+}
+
+func (s *Server) run(i int) {
+	defer s.workers.Done()
+	w := s.c.Workers[i]
+	for x := range s.work[i] {
+		if *ddtxn.Latency {
+			x.q.S = time.Now()
+		}
+		r, err := w.One(x.q)
+		if err == ddtxn.ESTASH || err == ddtxn.EPENDING {
+			go func(x *call) {
+				y := <-x.q.W
+				x.c.reply(x.id, y.R, y.E)
+			}(x)
+			continue
+		}
+		x.c.reply(x.id, r, err)
+	}
+}
+
+func (c *conn) reply(id uint64, r *ddtxn.Result, err error) {
+	select {
+	case c.out <- &wire.Response{ID: id, Err: err, R: r}:
+	case <-c.done:
+	}
+}
+
+// Write responses as they come, flushing whenever there are no more
+// waiting.
+func (c *conn) write() {
+	wr := bufio.NewWriter(c.nc)
+	for {
+		select {
+		case r := <-c.out:
+			if err := wire.WriteResponse(wr, r); err != nil {
+				c.nc.Close()
+				return
+			}
+			if len(c.out) == 0 {
+				if err := wr.Flush(); err != nil {
+					c.nc.Close()
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/narula/ddtxn"
+	"github.com/narula/ddtxn/wire"
+)
+
+func TestServer(t *testing.T) {
+	s := ddtxn.NewStore()
+	coord := ddtxn.NewCoordinator(2, s)
+	s.CreateKey(ddtxn.ProductKey(4), int32(0), ddtxn.SUM)
+	srv := New(coord)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	go srv.Serve(ln)
+	defer coord.Finish()
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer nc.Close()
+	wr := bufio.NewWriter(nc)
+	rd := bufio.NewReader(nc)
+
+	// Pipeline a batch of buys, then a read and a bad request.
+	n := 20
+	for i := 0; i < n; i++ {
+		a := &ddtxn.BuyArgs{User: ddtxn.UserKey(uint64(i)), Product: ddtxn.ProductKey(4), Amount: 5}
+		if err := wire.WriteRequest(wr, &wire.Request{ID: uint64(i), Txn: "buy", Args: a}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	wr.Flush()
+	for i := 0; i < n; i++ {
+		var r wire.Response
+		if err := wire.ReadResponse(rd, &r); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if r.Err != nil {
+			t.Errorf("Buy %v: %v\n", r.ID, r.Err)
+		}
+	}
+	a := &ddtxn.KeyArgs{K: ddtxn.ProductKey(4)}
+	wire.WriteRequest(wr, &wire.Request{ID: 100, Txn: "read_one", Args: a})
+	wire.WriteRequest(wr, &wire.Request{ID: 101, Txn: "nope", Args: a})
+	wr.Flush()
+	for i := 0; i < 2; i++ {
+		var r wire.Response
+		if err := wire.ReadResponse(rd, &r); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		switch r.ID {
+		case 100:
+			if r.Err != nil || r.R == nil || r.R.V.(int32) != int32(5*n) {
+				t.Errorf("Read got %v %v\n", r.R, r.Err)
+			}
+		case 101:
+			if r.Err != ddtxn.EUNKNOWNTXN {
+				t.Errorf("Expected EUNKNOWNTXN, got %v\n", r.Err)
+			}
+		default:
+			t.Errorf("Unexpected response %v\n", r.ID)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package ddtxn
+
+import (
+	"sort"
+)
+
+// SET records hold a set of keys, kept in entries sorted by key.
+// Writing a Key to one adds it and writing a Removal takes it out; an
+// add and a remove of the same member take effect in transaction
+// order.  Doppel splits only adds, which commute: a transaction that
+// removes a member from a split set stashes, like Delete().
+//
+// BITMAP records hold a []byte, and writing one ORs it in, growing
+// the bitmap if needed.  The bitmap is never changed in place, so
+// readers can keep it.
+
+// Written to a SET record, removes Member.
+type Removal struct {
+	Member Key
+}
+
+// Buffered SET writes are entries: order is one of these and key the
+// member.
+const (
+	SET_ADD    = 1
+	SET_REMOVE = -1
+)
+
+// The entry for a write of v to a SET record, or ETYPE if v is neither
+// a Key nor a Removal.
+func setEntry(v Value) (Entry, error) {
+	switch x := v.(type) {
+	case Key:
+		return Entry{order: SET_ADD, key: x}, nil
+	case Removal:
+		return Entry{order: SET_REMOVE, key: x.Member}, nil
+	}
+	return Entry{}, ETYPE
+}
+
+func memberIndex(m []Entry, k Key) (int, bool) {
+	i := sort.Search(len(m), func(i int) bool {
+		return !keyLess(m[i].key, k)
+	})
+	return i, i < len(m) && m[i].key == k
+}
+
+// Apply a SET write to the members in m.
+func applyMember(m []Entry, e Entry) []Entry {
+	i, ok := memberIndex(m, e.key)
+	switch {
+	case e.order == SET_ADD && !ok:
+		m = append(m, Entry{})
+		copy(m[i+1:], m[i:])
+		m[i] = Entry{order: SET_ADD, key: e.key}
+	case e.order == SET_REMOVE && ok:
+		copy(m[i:], m[i+1:])
+		m = m[:len(m)-1]
+	}
+	return m
+}
+
+// Add the members of sorted m2 to sorted m.
+func unionMembers(m, m2 []Entry) []Entry {
+	x := make([]Entry, 0, len(m)+len(m2))
+	i, j := 0, 0
+	for i < len(m) || j < len(m2) {
+		switch {
+		case j == len(m2) || (i < len(m) && keyLess(m[i].key, m2[j].key)):
+			x = append(x, m[i])
+			i++
+		case i == len(m) || keyLess(m2[j].key, m[i].key):
+			x = append(x, m2[j])
+			j++
+		default:
+			x = append(x, m[i])
+			i++
+			j++
+		}
+	}
+	return x
+}
+
+// A SET record's members, sorted.
+func (br *BRecord) Members() []Key {
+	x := make([]Key, len(br.entries))
+	for i := range br.entries {
+		x[i] = br.entries[i].key
+	}
+	return x
+}
+
+func (br *BRecord) IsMember(k Key) bool {
+	_, ok := memberIndex(br.entries, k)
+	return ok
+}
+
+// A BITMAP with the given bits set.
+func MakeBitmap(bits ...int) []byte {
+	var b []byte
+	for _, i := range bits {
+		for len(b) <= i/8 {
+			b = append(b, 0)
+		}
+		b[i/8] |= 1 << uint(i%8)
+	}
+	return b
+}
+
+// a OR b, in a new slice.
+func orBits(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	x := make([]byte, len(a))
+	copy(x, a)
+	for i := range b {
+		x[i] |= b[i]
+	}
+	return x
+}
+
+// The value for a write of v to a BITMAP record, or ETYPE if v isn't
+// a []byte.
+func bitmapValue(v Value) (Value, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, ETYPE
+	}
+	return b, nil
+}
+
+// A BITMAP record's bits; don't change them.
+func (br *BRecord) Bitmap() []byte {
+	b, _ := br.value.([]byte)
+	return b
+}
@@ -0,0 +1,145 @@
+package ddtxn
+
+import (
+	"sync/atomic"
+)
+
+// A read-only transaction that sees the store as of the last
+// completed phase: every transaction from before the snapshot epoch
+// and none after.  It never locks, stashes or aborts; writes return
+// EREADONLY.  Records keep their contents from the snapshot when they
+// are first changed after it, so reads don't wait for anyone.
+//
+// Workers run transactions registered with TxnInfo.Snapshot this way.
+// The snapshot moves at every epoch, while workers are stopped between
+// transactions, so a snapshot transaction must run on a worker.
+type STransaction struct {
+	padding0 [128]byte
+	w        *Worker
+	s        *Store
+	e        uint64
+	phase    int
+	recs     copies // handed out by Read() and ReadAt()
+	padding  [128]byte
+}
+
+func StartSTransaction(w *Worker) *STransaction {
+	tx := &STransaction{
+		w: w,
+		s: w.store,
+	}
+	return tx
+}
+
+func (tx *STransaction) Reset() {
+	tx.e = atomic.LoadUint64(&tx.s.snapepoch)
+	tx.recs.reset()
+}
+
+// The record returned is a copy, good until the next Reset().
+func (tx *STransaction) Read(k Key) (*BRecord, error) {
+	br, err := tx.s.getKey(k, tx.w.ld)
+	if err != nil {
+		return nil, err
+	}
+	r, err := tx.recs.next()
+	if err != nil {
+		return nil, err
+	}
+	if !br.readSnapshot(r, tx.e) {
+		return nil, ENOKEY
+	}
+	return r, nil
+}
+
+func (tx *STransaction) ReadAt(k Key, tid TID) (*BRecord, error) {
+	return tx.w.readAt(&tx.recs, k, tid)
+}
+
+func (tx *STransaction) Scan(start, end Key, limit int) ([]*BRecord, error) {
+	var recs []*BRecord
+	err := tx.s.scan(start, end, limit, nil, func(br *BRecord) (bool, error) {
+		r, err := tx.recs.next()
+		if err != nil {
+			return false, err
+		}
+		if !br.readSnapshot(r, tx.e) {
+			return false, nil
+		}
+		recs = append(recs, r)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (tx *STransaction) WriteInt32(k Key, a int32, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) WriteInt64(k Key, a int64, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) WriteFloat64(k Key, a float64, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) WriteList(k Key, l Entry, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) WriteOO(k Key, a int32, v Value, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) Write(k Key, v Value, op KeyType) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) Delete(k Key) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) MaybeWrite(k Key) error {
+	return EREADONLY
+}
+
+func (tx *STransaction) Abort() TID {
+	return 0
+}
+
+// Nothing to check; the snapshot's epoch stands in for a TID.
+func (tx *STransaction) Commit() TID {
+	return TID(tx.e)
+}
+
+func (tx *STransaction) SetPhase(p int) {
+	tx.phase = p
+}
+
+func (tx *STransaction) GetPhase() int {
+	return tx.phase
+}
+
+func (tx *STransaction) Store() *Store {
+	return tx.s
+}
+
+func (tx *STransaction) Worker() *Worker {
+	return tx.w
+}
+
+func (tx *STransaction) NoCount() {
+	// noop
+}
+
+func (tx *STransaction) UID(f rune) uint64 {
+	return tx.w.NextKey(f)
+}
+
+func (tx *STransaction) RelinquishKey(n uint64, r rune) {
+	tx.w.GiveBack(n, r)
+}
@@ -33,6 +33,11 @@ func (s *Spinlock) Lock() {
 	}
 }
 
+// TryLock locks s if it is free and reports whether it did.
+func (s *Spinlock) TryLock() bool {
+	return atomic.CompareAndSwapInt32(&s.state, 0, mutexLocked)
+}
+
 // Unlock unlocks s.
 //
 // A locked Spinlock is not associated with a particular goroutine.
@@ -53,7 +58,10 @@ type RWSpinlock struct {
 const spinlockMaxReaders = 1 << 30
 
 func (l *RWSpinlock) RLock() {
-	if atomic.AddInt32(&l.readerCount, 1) < 0 {
+	for atomic.AddInt32(&l.readerCount, 1) < 0 {
+		// A writer has it or is waiting for the readers to leave;
+		// don't count as one of them while waiting.
+		atomic.AddInt32(&l.readerCount, -1)
 		i := PREEMPT
 		for atomic.LoadInt32(&l.readerCount) < 0 {
 			if i == 0 {
@@ -65,6 +73,16 @@ func (l *RWSpinlock) RLock() {
 	}
 }
 
+// TryRLock read locks l if no writer has or wants it, and reports
+// whether it did.
+func (l *RWSpinlock) TryRLock() bool {
+	if atomic.AddInt32(&l.readerCount, 1) < 0 {
+		atomic.AddInt32(&l.readerCount, -1)
+		return false
+	}
+	return true
+}
+
 func (l *RWSpinlock) RUnlock() {
 	atomic.AddInt32(&l.readerCount, -1)
 }
@@ -73,16 +91,30 @@ func (l *RWSpinlock) Lock() {
 	l.w.Lock()
 	r := atomic.AddInt32(&l.readerCount, -spinlockMaxReaders) + spinlockMaxReaders
 	i := PREEMPT
+	// Wait for the readers to leave
 	for r != 0 {
 		if i == 0 {
 			runtime.Gosched()
 			i = PREEMPT
 		}
-		r = atomic.LoadInt32(&l.readerCount)
+		r = atomic.LoadInt32(&l.readerCount) + spinlockMaxReaders
 		i--
 	}
 }
 
+// TryLock write locks l if nobody holds it, and reports whether it
+// did.
+func (l *RWSpinlock) TryLock() bool {
+	if !l.w.TryLock() {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&l.readerCount, 0, -spinlockMaxReaders) {
+		l.w.Unlock()
+		return false
+	}
+	return true
+}
+
 func (l *RWSpinlock) Unlock() {
 	atomic.AddInt32(&l.readerCount, spinlockMaxReaders)
 	l.w.Unlock()
@@ -76,3 +76,53 @@ func TestRWSpinlock(t *testing.T) {
 	}
 	fmt.Printf("Passed TestRWSpinlock\n")
 }
+
+// A writer has to wait for readers that got there first, without new
+// readers starving it.
+func TestRWSpinlockWaits(t *testing.T) {
+	s := new(RWSpinlock)
+	s.RLock()
+	locked := make(chan bool)
+	go func() {
+		s.Lock()
+		locked <- true
+		s.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		// Behind the writer
+		s.RLock()
+		s.RUnlock()
+		done <- true
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Writer got the lock while it was read locked\n")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.RUnlock()
+	<-locked
+	<-done
+}
+
+func TestTryLock(t *testing.T) {
+	s := new(RWSpinlock)
+	if !s.TryRLock() || !s.TryRLock() {
+		t.Fatalf("Could not read lock\n")
+	}
+	if s.TryLock() {
+		t.Fatalf("Write locked while read locked\n")
+	}
+	s.RUnlock()
+	s.RUnlock()
+	if !s.TryLock() {
+		t.Fatalf("Could not write lock\n")
+	}
+	if s.TryLock() || s.TryRLock() {
+		t.Fatalf("Locked twice\n")
+	}
+	s.Unlock()
+	s.RLock()
+	s.RUnlock()
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 
 	"github.com/narula/gotomic"
 
@@ -34,11 +35,20 @@ var UseRLocks = flag.Bool("rlock", true, "Use Rlocks\n")
 var GStore = flag.Bool("gstore", false, "Use Gotomic Hash Map instead of Go maps\n")
 
 var (
-	ENOKEY   = errors.New("doppel: no key")
-	EABORT   = errors.New("doppel: abort")
-	ESTASH   = errors.New("doppel: stash")
-	ENORETRY = errors.New("app error: no retry")
-	EEXISTS  = errors.New("doppel: trying to create key which already exists")
+	ENOKEY      = errors.New("doppel: no key")
+	EABORT      = errors.New("doppel: abort")
+	ESTASH      = errors.New("doppel: stash")
+	ENORETRY    = errors.New("app error: no retry")
+	EEXISTS     = errors.New("doppel: trying to create key which already exists")
+	EPENDING    = errors.New("doppel: result will be sent on Query.W once durable")
+	EUNKNOWNTXN = errors.New("doppel: unknown transaction")
+	EARGS       = errors.New("doppel: wrong argument type for transaction")
+	ETOOLARGE   = errors.New("doppel: transaction touches more than -maxkeys keys")
+	ETYPE       = errors.New("doppel: operation doesn't match the record's type")
+	EREADONLY   = errors.New("doppel: snapshot transactions can't write")
+	EVERSION    = errors.New("doppel: version no longer kept")
+	ENOINDEX    = errors.New("doppel: no ordered index covers the range")
+	EUNIQUE     = errors.New("doppel: another record has the same unique index entry")
 )
 
 const (
@@ -55,6 +65,15 @@ type Store struct {
 	hash_codes      map[Key]uint32
 	any_dd          bool
 	cand            *Candidates
+	recoveredTID    TID
+	recoveredEpoch  TID
+	ckgen           uint64 // bumped every time a checkpoint starts
+	ckactive        int32  // 1 while a checkpoint is being written
+	snapepoch       uint64 // what snapshot transactions read; see setSnapshot()
+	vhorizon        uint64 // no one reads versions older than this
+	tombmu          sync.Mutex
+	tombs           []*BRecord // for reclaim()
+	ordered         []*ordered // see AddOrdered()
 	padding2        [128]byte
 }
 
@@ -96,7 +115,7 @@ func (s *Store) getOrCreateTypedKey(k Key, v Value, kt KeyType) *BRecord {
 		if *GStore {
 			thing, ok := s.gstore.Get(gotomic.Key(k))
 			if !ok {
-				br = MakeBR(k, v, kt)
+				br = s.makeBR(k, v, kt)
 				did := s.gstore.PutIfMissing(gotomic.Key(k), br)
 				if !did {
 					thing, ok = s.gstore.Get(gotomic.Key(k))
@@ -116,7 +135,7 @@ func (s *Store) getOrCreateTypedKey(k Key, v Value, kt KeyType) *BRecord {
 			chunk.Lock()
 			br, ok = chunk.rows[k]
 			if !ok {
-				br = MakeBR(k, v, kt)
+				br = s.makeBR(k, v, kt)
 				chunk.rows[k] = br
 			}
 			chunk.Unlock()
@@ -126,7 +145,11 @@ func (s *Store) getOrCreateTypedKey(k Key, v Value, kt KeyType) *BRecord {
 }
 
 func (s *Store) CreateKey(k Key, v Value, kt KeyType) *BRecord {
-	br := MakeBR(k, v, kt)
+	br := s.makeBR(k, v, kt)
+	// Loading data, not a transaction; every snapshot and version
+	// sees it.
+	br.snapat = 0
+	br.loaded = true
 	if *GStore {
 		x, ok := s.gstore.Put(gotomic.Key(k), br)
 		if ok {
@@ -139,6 +162,10 @@ func (s *Store) CreateKey(k Key, v Value, kt KeyType) *BRecord {
 		chunk.rows[k] = br
 		chunk.Unlock()
 	}
+	s.indexed(br)
+	if kt == WRITE && isIndexed(v) {
+		s.loadEntries(k, v)
+	}
 	return br
 }
 
@@ -146,7 +173,7 @@ func (s *Store) CreateKey(k Key, v Value, kt KeyType) *BRecord {
 // record is locked and inserted while holding the lock on the chunk.
 
 func (s *Store) CreateLockedKey(k Key, kt KeyType) (*BRecord, error) {
-	br := MakeBR(k, nil, kt)
+	br := s.makeBR(k, nil, kt)
 	br.Lock()
 	if *GStore {
 		ok := s.gstore.PutIfMissing(gotomic.Key(k), br)
@@ -171,7 +198,7 @@ func (s *Store) CreateLockedKey(k Key, kt KeyType) (*BRecord, error) {
 }
 
 func (s *Store) CreateMuLockedKey(k Key, kt KeyType) (*BRecord, error) {
-	br := MakeBR(k, nil, kt)
+	br := s.makeBR(k, nil, kt)
 	br.SLock()
 	if *GStore {
 		ok := s.gstore.PutIfMissing(gotomic.Key(k), br)
@@ -195,7 +222,7 @@ func (s *Store) CreateMuLockedKey(k Key, kt KeyType) (*BRecord, error) {
 }
 
 func (s *Store) CreateMuRLockedKey(k Key, kt KeyType) (*BRecord, error) {
-	br := MakeBR(k, nil, kt)
+	br := s.makeBR(k, nil, kt)
 	br.SRLock()
 	if *GStore {
 		ok := s.gstore.PutIfMissing(gotomic.Key(k), br)
@@ -218,7 +245,156 @@ func (s *Store) CreateMuRLockedKey(k Key, kt KeyType) (*BRecord, error) {
 	return br, nil
 }
 
+// Start a checkpoint of everything in the store right now.  Nothing
+// may be modifying the store while this runs; after it returns
+// records save their contents for the checkpoint before changing.
+func (s *Store) beginSnapshot() uint64 {
+	g := atomic.AddUint64(&s.ckgen, 1)
+	atomic.StoreInt32(&s.ckactive, 1)
+	return g
+}
+
+func (s *Store) endSnapshot() {
+	atomic.StoreInt32(&s.ckactive, 0)
+}
+
+// Snapshot transactions now read the store as of the start of epoch
+// e, which must hold exactly the transactions before e.  Nothing may
+// be running transactions while this is called.
+func (s *Store) setSnapshot(e TID) {
+	atomic.StoreUint64(&s.snapepoch, uint64(e))
+}
+
+// Must be called before modifying br.  Save what the current snapshot
+// sees if br hasn't changed since it was taken, and if a checkpoint is
+// being written and hasn't saved br yet, save what it should see.
+func (s *Store) cow(br *BRecord) {
+	if *Versions > 0 {
+		br.baseVersion()
+	}
+	e := atomic.LoadUint64(&s.snapepoch)
+	if atomic.LoadUint64(&br.snapat) < e {
+		br.ckmu.Lock()
+		if br.snapat < e {
+			br.copyState(&br.prev)
+			br.prevok = true
+			atomic.StoreUint64(&br.snapat, e)
+		}
+		br.ckmu.Unlock()
+	}
+	if atomic.LoadInt32(&s.ckactive) == 0 {
+		return
+	}
+	g := atomic.LoadUint64(&s.ckgen)
+	if atomic.LoadUint64(&br.ckgen) >= g {
+		return
+	}
+	br.ckmu.Lock()
+	if br.ckgen < g {
+		br.saved = br.state()
+		atomic.StoreUint64(&br.ckgen, g)
+	}
+	br.ckmu.Unlock()
+}
+
+// Make br a tombstone: it reads as missing until a write brings it
+// back, and reclaim() takes it out of the store.  The caller holds
+// br's lock.
+func (s *Store) tombstone(br *BRecord) {
+	s.cow(br)
+	br.exists = false
+	br.int_value = 0
+	br.value = nil
+	br.entries = nil
+	s.addTomb(br)
+}
+
+// Bring tombstone br back as an empty record of type kt.  The caller
+// holds br's lock.
+func (s *Store) revive(br *BRecord, kt KeyType) {
+	s.cow(br)
+	br.key_type = kt
+	br.int_value = 0
+	br.value64 = 0
+	if kt == MIN {
+		br.int_value = MIN_EMPTY
+	}
+	br.value = nil
+	br.entries = nil
+	br.exists = true
+}
+
+func (s *Store) addTomb(br *BRecord) {
+	if !atomic.CompareAndSwapInt32(&br.tombed, 0, 1) {
+		return
+	}
+	s.tombmu.Lock()
+	s.tombs = append(s.tombs, br)
+	s.tombmu.Unlock()
+}
+
+// Take tombstones out of the store.  Nothing may be running
+// transactions, so no one holds on to them.  They stay while a
+// checkpoint is being written, and with -versions until ReadAt() can't
+// want their history.
+func (s *Store) reclaim() {
+	if atomic.LoadInt32(&s.ckactive) == 1 {
+		return
+	}
+	s.tombmu.Lock()
+	defer s.tombmu.Unlock()
+	h := TID(atomic.LoadUint64(&s.vhorizon))
+	keep := s.tombs[:0]
+	for _, br := range s.tombs {
+		if *Versions > 0 && !br.exists && br.lastVersion() > h {
+			keep = append(keep, br)
+			continue
+		}
+		atomic.StoreInt32(&br.tombed, 0)
+		if br.exists {
+			// Written again since
+			continue
+		}
+		if br.dd {
+			br.dd = false
+			delete(s.dd, br.key)
+		}
+		s.remove(br)
+	}
+	for i := len(keep); i < len(s.tombs); i++ {
+		s.tombs[i] = nil
+	}
+	s.tombs = keep
+}
+
+// Take br out of the store, unless it was already replaced.
+func (s *Store) remove(br *BRecord) {
+	s.unindexed(br)
+	if *GStore {
+		if x, ok := s.gstore.Get(gotomic.Key(br.key)); ok && x.(*BRecord) == br {
+			s.gstore.Delete(gotomic.Key(br.key))
+		}
+		return
+	}
+	chunk := s.store[br.key[0]]
+	chunk.Lock()
+	if chunk.rows[br.key] == br {
+		delete(chunk.rows, br.key)
+	}
+	chunk.Unlock()
+}
+
+// Records created after a checkpoint starts or a snapshot is taken
+// aren't in it.
+func (s *Store) makeBR(k Key, v Value, kt KeyType) *BRecord {
+	br := MakeBR(k, v, kt)
+	br.ckgen = atomic.LoadUint64(&s.ckgen)
+	br.snapat = atomic.LoadUint64(&s.snapepoch)
+	return br
+}
+
 func (s *Store) SetInt32(br *BRecord, v int32, op KeyType) {
+	s.cow(br)
 	switch op {
 	case SUM:
 		br.int_value += v
@@ -226,15 +402,27 @@ func (s *Store) SetInt32(br *BRecord, v int32, op KeyType) {
 		if v > br.int_value {
 			br.int_value = v
 		}
+	case MIN:
+		if v < br.int_value {
+			br.int_value = v
+		}
 	}
 }
 
 func (s *Store) SetList(br *BRecord, ve Entry, op KeyType) {
+	s.cow(br)
 	br.AddOneToRecord(ve)
 }
 
+// Add or remove a SET record's member.
+func (s *Store) SetMember(br *BRecord, e Entry) {
+	s.cow(br)
+	br.entries = applyMember(br.entries, e)
+}
+
 func (s *Store) SetOO(br *BRecord, a int32, v Value, op KeyType) {
 	if v != nil {
+		s.cow(br)
 		if a > br.int_value || br.value == nil {
 			br.int_value = a
 			br.value = v
@@ -243,6 +431,10 @@ func (s *Store) SetOO(br *BRecord, a int32, v Value, op KeyType) {
 }
 
 func (s *Store) Set(br *BRecord, v Value, op KeyType) {
+	switch op {
+	case SUM, MAX, MIN, SUM64, MAX64, FSUM, FMAX, WRITE, LIST, BITMAP:
+		s.cow(br)
+	}
 	switch op {
 	case SUM:
 		br.int_value += v.(int32)
@@ -251,12 +443,20 @@ func (s *Store) Set(br *BRecord, v Value, op KeyType) {
 		if x > br.int_value {
 			br.int_value = v.(int32)
 		}
+	case MIN:
+		if x := v.(int32); x < br.int_value {
+			br.int_value = x
+		}
+	case SUM64, MAX64, FSUM, FMAX:
+		atomic.StoreUint64(&br.value64, combine64(op, br.value64, v))
 	case WRITE:
 		br.value = v
 	case LIST:
 		if v != nil {
 			br.AddOneToRecord(v.(Entry))
 		}
+	case BITMAP:
+		br.value = orBits(br.Bitmap(), v.([]byte))
 	case OOWRITE:
 		if v != nil {
 			x := v.(Overwrite)
@@ -265,6 +465,30 @@ func (s *Store) Set(br *BRecord, v Value, op KeyType) {
 	}
 }
 
+// Call f on every record.  Records created while this runs may or
+// may not be seen.  Doesn't hold any chunk locks while calling f.
+func (s *Store) each(f func(br *BRecord)) {
+	if *GStore {
+		s.gstore.Each(func(k gotomic.Hashable, v gotomic.Thing) bool {
+			f(v.(*BRecord))
+			return false
+		})
+		return
+	}
+	var brs []*BRecord
+	for _, chunk := range s.store {
+		chunk.RLock()
+		for _, br := range chunk.rows {
+			brs = append(brs, br)
+		}
+		chunk.RUnlock()
+		for _, br := range brs {
+			f(br)
+		}
+		brs = brs[:0]
+	}
+}
+
 func (s *Store) Get(k Key) (*BRecord, error) {
 	return s.getKey(k, nil)
 }
@@ -7,30 +7,26 @@ import (
 	"time"
 )
 
-// I tried keeping a slice of interfaces; the reflection was costly.
-// Hard code in random parameter types to re-use for now.
+// A transaction to run.  Args points to the transaction's own
+// argument struct (e.g. *BuyArgs); the worker keeps the pointer until
+// the transaction commits or gives up, including while it is stashed
+// or waiting to be retried, so don't change the struct before then.
+//
+// If W is set, a stashed transaction's result, or with group commit a
+// committed one's, is sent there later instead of returned.  W must be
+// buffered: the group logger drops a reply it has no room for rather
+// than wait on the client.
 type Query struct {
 	TXN int
 	W   chan struct {
 		R *Result
 		E error
 	}
-	T  TID
-	K1 Key
-	K2 Key
-	A  int32
-	U1 uint64
-	U2 uint64
-	U3 uint64
-	U4 uint64
-	U5 uint64
-	U6 uint64
-	U7 uint64
-	S1 string
-	S2 string
-	I  int
-	TS time.Time
-	S  time.Time
+	T    TID
+	Args interface{}
+	I    int
+	TS   time.Time
+	S    time.Time
 }
 
 type Result struct {
@@ -39,20 +35,59 @@ type Result struct {
 
 var Allocate = flag.Bool("allocate", true, "Allocate results")
 
-func IsRead(t int) bool {
-	if t == D_READ_ONE || t == D_READ_TWO {
-		return true
+// Adapt a transaction that takes its parameters as an *A to run on a
+// worker.  Unwrapping the arguments is a type assertion, so there is no
+// reflection or allocation per call.  Queries whose Args aren't an *A
+// fail with EARGS.
+func Txn[A any](f func(*A, ETransaction) (*Result, error)) TransactionFunc {
+	return func(t Query, tx ETransaction) (*Result, error) {
+		a, ok := t.Args.(*A)
+		if !ok {
+			return nil, EARGS
+		}
+		return f(a, tx)
 	}
-	return false
 }
 
-func BuyTxn(t Query, tx ETransaction) (*Result, error) {
+// Arguments for the transactions below.
+type BuyArgs struct {
+	User    Key
+	Product Key
+	Amount  int32
+}
+
+type KeyArgs struct {
+	K Key
+}
+
+type TwoKeyArgs struct {
+	K1 Key
+	K2 Key
+}
+
+type BigArgs struct {
+	Bids    [6]uint64
+	Product uint64
+}
+
+func init() {
+	RegisterValue(TAG_BUY_ARGS, &BuyArgs{})
+	RegisterValue(TAG_KEY_ARGS, &KeyArgs{})
+	RegisterValue(TAG_TWO_KEY_ARGS, &TwoKeyArgs{})
+	RegisterValue(TAG_BIG_ARGS, &BigArgs{})
+}
+
+func IsRead(t int) bool {
+	return GetTxnInfo(t).ReadOnly
+}
+
+func BuyTxn(t *BuyArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
-	err := tx.WriteInt32(t.K1, 1, SUM)
+	err := tx.WriteInt32(t.User, 1, SUM)
 	if err != nil {
 		return nil, err
 	}
-	err = tx.WriteInt32(t.K2, t.A, SUM)
+	err = tx.WriteInt32(t.Product, t.Amount, SUM)
 	if err != nil {
 		return nil, err
 	}
@@ -62,24 +97,24 @@ func BuyTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func BuyAndReadTxn(t Query, tx ETransaction) (*Result, error) {
+func BuyAndReadTxn(t *BuyArgs, tx ETransaction) (*Result, error) {
 	tx.NoCount()
 	var r *Result = nil
-	err := tx.WriteInt32(t.K1, 1, SUM)
+	err := tx.WriteInt32(t.User, 1, SUM)
 	if err != nil {
 		return nil, err
 	}
-	err = tx.WriteInt32(t.K2, t.A, SUM)
+	err = tx.WriteInt32(t.Product, t.Amount, SUM)
 	if err != nil {
 		return nil, err
 	}
-	br, err2 := tx.Read(t.K2)
+	br, err2 := tx.Read(t.Product)
 	if err2 != nil {
 		return r, err2
 	}
 	x := br.int_value
 	if br.dd == true && tx.GetPhase() == SPLIT {
-		log.Fatalf("should not happen %v\n", t.K2)
+		log.Fatalf("should not happen %v\n", t.Product)
 	}
 	if tx.Commit() == 0 {
 		return r, EABORT
@@ -90,9 +125,9 @@ func BuyAndReadTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func ReadOneTxn(t Query, tx ETransaction) (*Result, error) {
+func ReadOneTxn(t *KeyArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
-	v1, err := tx.Read(t.K1)
+	v1, err := tx.Read(t.K)
 	if err != nil {
 		return r, err
 	}
@@ -107,7 +142,7 @@ func ReadOneTxn(t Query, tx ETransaction) (*Result, error) {
 	return r, nil
 }
 
-func ReadTxn(t Query, tx ETransaction) (*Result, error) {
+func ReadTxn(t *TwoKeyArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
 	v1, err := tx.Read(t.K1)
 	if err != nil {
@@ -139,18 +174,32 @@ func ReadTxn(t Query, tx ETransaction) (*Result, error) {
 // just performs atomic increments on keys.  It is impossible to
 // abort, and no stats are kept to indicate this key should be in
 // split phase or not.  This shouldn't be run in a mix with any other
-// transaction types.
-func AtomicIncr(t Query, tx ETransaction) (*Result, error) {
-	br, err := tx.Store().getKey(t.K1, tx.Worker().ld)
-	if err != nil || br == nil {
-		log.Fatalf("Why no key?")
+// transaction types.  Increments commute, so it logs each one under
+// any TID.
+func AtomicIncr(t *KeyArgs, tx ETransaction) (*Result, error) {
+	w := tx.Worker()
+	br, err := tx.Store().getKey(t.K, w.ld)
+	if err != nil || br == nil || !br.exists {
+		return nil, ENOKEY
+	}
+	tid := w.commitTID()
+	if w.rlog != nil {
+		w.rlog.Begin(tid, w.commitEpoch())
+		w.rlog.Add(t.K, SUM, 1, Entry{}, nil)
+		if err := w.rlog.Commit(); err != nil {
+			log.Fatalf("%v Could not write redo log: %v\n", w.ID, err)
+		}
 	}
+	tx.Store().cow(br)
 	atomic.AddInt32(&br.int_value, 1)
+	if *Versions > 0 {
+		tx.Store().addVersion(br, tid)
+	}
 	return nil, nil
 }
 
-func IncrTxn(t Query, tx ETransaction) (*Result, error) {
-	err := tx.WriteInt32(t.K1, 1, SUM)
+func IncrTxn(t *KeyArgs, tx ETransaction) (*Result, error) {
+	err := tx.WriteInt32(t.K, 1, SUM)
 	if err != nil {
 		return nil, err
 	}
@@ -160,19 +209,19 @@ func IncrTxn(t Query, tx ETransaction) (*Result, error) {
 	return nil, nil
 }
 
-func BigIncrTxn(t Query, tx ETransaction) (*Result, error) {
+func BigIncrTxn(t *BigArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
 	key := [6]Key{}
-	key[0] = BidKey(t.U1)
-	key[1] = BidKey(t.U2)
-	key[2] = BidKey(t.U3)
-	key[3] = BidKey(t.U4)
-	key[4] = BidKey(t.U5)
-	key[5] = BidKey(t.U6)
+	for i := range t.Bids {
+		key[i] = BidKey(t.Bids[i])
+	}
 
 	for z := 0; z < 10; z++ {
 		for i := 0; i < 6; i++ {
-			tx.MaybeWrite(key[i])
+			if err := tx.MaybeWrite(key[i]); err != nil {
+				tx.Abort()
+				return nil, err
+			}
 			k, err := tx.Read(key[i])
 			if err == ESTASH {
 				return nil, ESTASH
@@ -189,7 +238,7 @@ func BigIncrTxn(t Query, tx ETransaction) (*Result, error) {
 		}
 	}
 
-	if err := tx.WriteInt32(ProductKey(int(t.U7)), 1, SUM); err != nil {
+	if err := tx.WriteInt32(ProductKey(int(t.Product)), 1, SUM); err != nil {
 		return nil, err
 	}
 	if tx.Commit() == 0 {
@@ -200,21 +249,21 @@ func BigIncrTxn(t Query, tx ETransaction) (*Result, error) {
 
 // Version of Big that puts keys in read set (doesn't rely on
 // commutativity)
-func BigRWTxn(t Query, tx ETransaction) (*Result, error) {
+func BigRWTxn(t *BigArgs, tx ETransaction) (*Result, error) {
 	var r *Result = nil
 
 	key := [7]Key{}
-	key[0] = BidKey(t.U1)
-	key[1] = BidKey(t.U2)
-	key[2] = BidKey(t.U3)
-	key[3] = BidKey(t.U4)
-	key[4] = BidKey(t.U5)
-	key[5] = BidKey(t.U6)
-	key[6] = ProductKey(int(t.U7))
+	for i := range t.Bids {
+		key[i] = BidKey(t.Bids[i])
+	}
+	key[6] = ProductKey(int(t.Product))
 
 	for z := 0; z < 10; z++ {
 		for i := 0; i < 6; i++ {
-			tx.MaybeWrite(key[i])
+			if err := tx.MaybeWrite(key[i]); err != nil {
+				tx.Abort()
+				return nil, err
+			}
 			k, err := tx.Read(key[i])
 			if err == ESTASH {
 				return nil, ESTASH
@@ -231,7 +280,10 @@ func BigRWTxn(t Query, tx ETransaction) (*Result, error) {
 		}
 	}
 
-	tx.MaybeWrite(key[6])
+	if err := tx.MaybeWrite(key[6]); err != nil {
+		tx.Abort()
+		return nil, err
+	}
 	k, err := tx.Read(key[6])
 	if err == ESTASH {
 		return nil, ESTASH
@@ -197,9 +197,9 @@ func PrintStats(out string, stats []int64, f *os.File, coord *Coordinator, s *St
 		}
 		f.WriteString("\n")
 	}
-	for i := 0; i < LAST_TXN; i++ {
-		if stats[i] != 0 {
-			f.WriteString(fmt.Sprintf("txn%v: %v\n", i, stats[i]))
+	for i, ts := range CollectTxnCounts(coord) {
+		if ts.Commits != 0 {
+			f.WriteString(fmt.Sprintf("%v: %v\n", GetTxnInfo(i).Label, ts.Commits))
 		}
 	}
 	WriteChunkStats(s, f)
@@ -262,8 +262,8 @@ func WriteCountKeyStats(coord *Coordinator, nb int, f *os.File) {
 
 func CollectOne(w *Worker) int64 {
 	var nitr int64
-	for j := 0; j < LAST_TXN; j++ {
-		nitr = nitr + w.Nstats[j]
+	for j := range w.Txnstats {
+		nitr = nitr + w.Txnstats[j].Commits
 	}
 	return nitr
 }
@@ -279,10 +279,8 @@ func CollectCounts(coord *Coordinator, stats []int64) (int64, time.Duration, tim
 	for i := 0; i < len(coord.Workers); i++ {
 		for j := 0; j < LAST_STAT; j++ {
 			stats[j] = stats[j] + coord.Workers[i].Nstats[j]
-			if j < LAST_TXN {
-				nitr = nitr + coord.Workers[i].Nstats[j]
-			}
 		}
+		nitr = nitr + CollectOne(coord.Workers[i])
 		nwait = nwait + coord.Workers[i].Nwait
 		nnoticed = nnoticed + coord.Workers[i].Nnoticed
 		nmerge = nmerge + coord.Workers[i].Nmerge
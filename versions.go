@@ -0,0 +1,193 @@
+package ddtxn
+
+import (
+	"flag"
+	"sync/atomic"
+)
+
+var Versions = flag.Int("versions", 0, "Versions of each record to keep for ReadAt(), counting the current one; 0 for none\n")
+
+// A record's contents as written by transaction tid.  Records keep
+// their versions oldest first; the last one is what the record holds
+// now.  Only kept with -versions.
+type version struct {
+	tid TID
+	recState
+}
+
+// Copies of records for reads that can't hand out the record itself,
+// reused from one transaction to the next.
+type copies struct {
+	recs []*BRecord
+	n    int
+}
+
+func (c *copies) reset() {
+	c.n = 0
+}
+
+func (c *copies) next() (*BRecord, error) {
+	if c.n == len(c.recs) {
+		if tooLarge(c.n) {
+			return nil, ETOOLARGE
+		}
+		c.recs = append(c.recs, &BRecord{})
+	}
+	c.n++
+	return c.recs[c.n-1], nil
+}
+
+// Start keeping br's versions, if that hasn't happened yet, with what
+// it holds before its first change.  Called from cow().
+func (br *BRecord) baseVersion() {
+	if atomic.LoadInt32(&br.vbase) == 1 {
+		return
+	}
+	br.ckmu.Lock()
+	if br.vbase == 0 {
+		br.versions = append(br.versions[:0], version{})
+		br.copyState(&br.versions[0].recState)
+		if !br.loaded {
+			// Didn't exist before this transaction created it
+			br.versions[0].exists = false
+		}
+		atomic.StoreInt32(&br.vbase, 1)
+	}
+	br.ckmu.Unlock()
+}
+
+// The TID of the latest version of br, or 0.
+func (br *BRecord) lastVersion() TID {
+	br.ckmu.RLock()
+	defer br.ckmu.RUnlock()
+	if len(br.versions) == 0 {
+		return 0
+	}
+	return br.versions[len(br.versions)-1].tid
+}
+
+// Fill in r with what br held after the last transaction at or before
+// tid wrote it.
+func (br *BRecord) readVersion(r *BRecord, tid TID) error {
+	br.ckmu.RLock()
+	defer br.ckmu.RUnlock()
+	if len(br.versions) == 0 {
+		// Never changed; writers save it under ckmu first
+		var st recState
+		br.copyState(&st)
+		if !br.loaded || !r.fromState(br.key, &st) {
+			return ENOKEY
+		}
+		r.vtid = 0
+		return nil
+	}
+	for i := len(br.versions) - 1; i >= 0; i-- {
+		v := &br.versions[i]
+		if v.tid > tid {
+			continue
+		}
+		// Never changed once saved, so no need to copy the entries
+		if !r.fromState(br.key, &v.recState) {
+			return ENOKEY
+		}
+		r.vtid = v.tid
+		return nil
+	}
+	return EVERSION
+}
+
+// br was just changed by tid; save the result.  Call while still
+// holding br's lock.
+func (s *Store) addVersion(br *BRecord, tid TID) {
+	br.ckmu.Lock()
+	defer br.ckmu.Unlock()
+	n := len(br.versions)
+	// Merges and AtomicIncr() don't order their TIDs against the
+	// record's; keep the versions sorted.
+	if n > 0 && tid < br.versions[n-1].tid {
+		tid = br.versions[n-1].tid
+	}
+	br.versions = append(br.versions, version{tid: tid})
+	br.copyState(&br.versions[n].recState)
+
+	// Drop versions no reader can get to: those hidden by a newer
+	// one from before the horizon, then the oldest past -versions.
+	h := TID(atomic.LoadUint64(&s.vhorizon))
+	i := 0
+	for i+1 < len(br.versions) && br.versions[i+1].tid <= h {
+		i++
+	}
+	if x := len(br.versions) - *Versions; x > i {
+		i = x
+	}
+	if i > 0 {
+		n = copy(br.versions, br.versions[i:])
+		for j := n; j < len(br.versions); j++ {
+			br.versions[j] = version{}
+		}
+		br.versions = br.versions[:n]
+	}
+}
+
+// Read k as of tid, for ReadAt().  While the transaction runs w keeps
+// the versions it needs from being thrown away.
+func (w *Worker) readAt(c *copies, k Key, tid TID) (*BRecord, error) {
+	if *Versions <= 0 {
+		return nil, EVERSION
+	}
+	// 0 means not reading old versions
+	if x := atomic.LoadUint64(&w.readat); x == 0 || uint64(tid)+1 < x {
+		atomic.StoreUint64(&w.readat, uint64(tid)+1)
+	}
+	br, err := w.store.getKey(k, w.ld)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+	if err := br.readVersion(r, tid); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (w *Worker) doneReadAt() {
+	if atomic.LoadUint64(&w.readat) != 0 {
+		atomic.StoreUint64(&w.readat, 0)
+	}
+}
+
+// Versions from before the current snapshot and anything a worker is
+// reading with ReadAt() can go.
+func (c *Coordinator) versionHorizon() {
+	s := c.Workers[0].store
+	h := atomic.LoadUint64(&s.snapepoch)
+	for _, w := range c.Workers {
+		if x := atomic.LoadUint64(&w.readat); x != 0 && x-1 < h {
+			h = x - 1
+		}
+	}
+	atomic.StoreUint64(&s.vhorizon, h)
+}
+
+// Save the contents of everything the workers just merged.  Workers
+// must be stopped.
+func (c *Coordinator) versionMerged() {
+	s := c.Workers[0].store
+	var tid TID
+	for _, w := range c.Workers {
+		if x := w.commitTID(); x > tid {
+			tid = x
+		}
+	}
+	for _, w := range c.Workers {
+		ls := w.local_store
+		for _, br := range ls.merged {
+			atomic.StoreInt32(&br.vmerged, 0)
+			s.addVersion(br, tid)
+		}
+		ls.merged = ls.merged[:0]
+	}
+}
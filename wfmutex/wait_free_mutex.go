@@ -1,8 +1,7 @@
 package wfmutex
 
 import (
-	"log"
-	"runtime/debug"
+	"errors"
 	"sync/atomic"
 )
 
@@ -10,6 +9,12 @@ const (
 	LOCKED uint64 = 1 << 63
 )
 
+var (
+	ENOTLOCKED = errors.New("wfmutex: unlock of unlocked lock")
+	EBADTID    = errors.New("wfmutex: TID has the lock bit set")
+	ECHANGED   = errors.New("wfmutex: lock changed while locked")
+)
+
 type WFMutex struct {
 	w uint64
 }
@@ -42,20 +47,21 @@ func (rw *WFMutex) Read() uint64 {
 	return atomic.LoadUint64(&rw.w)
 }
 
-// Unlock unlocks rw for writing.  It is a run-time error if rw is
-// not locked for writing on entry to Unlock.
-func (rw *WFMutex) Unlock(t uint64) {
+// Unlock unlocks rw for writing and sets its version to t.  It
+// returns an error, and leaves rw alone, if rw is not locked for
+// writing on entry to Unlock.
+func (rw *WFMutex) Unlock(t uint64) error {
 	locked_q := atomic.LoadUint64(&rw.w)
 	x := locked_q & LOCKED
 	if x == 0 {
-		debug.PrintStack()
-		log.Fatalf("Trying to unlock an unlocked lock\n")
+		return ENOTLOCKED
 	}
 	if t&LOCKED != 0 {
-		log.Fatalf("Bad TID %v\n", t)
+		return EBADTID
 	}
 	done := atomic.CompareAndSwapUint64(&rw.w, locked_q, t)
 	if !done {
-		log.Fatalf("Compare and swap failed but should have succeeded\n")
+		return ECHANGED
 	}
+	return nil
 }
@@ -0,0 +1,226 @@
+// Package wire is the protocol spoken between Doppel clients and
+// servers over TCP.  Every message is a frame:
+//
+//	length uint32, body
+//
+// Requests and responses carry an ID chosen by the client, so many
+// can be in flight on one connection and responses can come back out
+// of order.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/narula/ddtxn"
+)
+
+const (
+	MAX_FRAME = 16 << 20
+)
+
+var EFRAME = errors.New("wire: bad frame")
+
+// Run transaction Txn with arguments Args (e.g. *ddtxn.BuyArgs).
+// Args is sent with ddtxn.AppendValue(), so its type needs a
+// registered codec on both ends.
+type Request struct {
+	ID   uint64
+	Txn  string
+	Args interface{}
+}
+
+type Response struct {
+	ID  uint64
+	Err error
+	R   *ddtxn.Result
+}
+
+// Errors that keep their identity across the wire, so callers can
+// compare against them.  Anything else arrives as a new error with
+// the same message.
+var codes = []error{
+	nil,
+	ddtxn.EABORT,
+	ddtxn.ENOKEY,
+	ddtxn.ENORETRY,
+	ddtxn.EEXISTS,
+	ddtxn.EUNKNOWNTXN,
+	ddtxn.EARGS,
+	ddtxn.ETOOLARGE,
+	ddtxn.ETYPE,
+	ddtxn.EREADONLY,
+	ddtxn.EVERSION,
+	ddtxn.ENOINDEX,
+	ddtxn.EUNIQUE,
+}
+
+const (
+	codeOther = 255
+)
+
+func WriteRequest(w *bufio.Writer, r *Request) error {
+	b := make([]byte, 4, 128)
+	b = binary.LittleEndian.AppendUint64(b, r.ID)
+	b = appendString(b, r.Txn)
+	b, err := ddtxn.AppendValue(b, r.Args)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, b)
+}
+
+func ReadRequest(rd *bufio.Reader, r *Request) error {
+	b, err := readFrame(rd)
+	if err != nil {
+		return err
+	}
+	d := decoder{b: b}
+	r.ID = d.uint64()
+	r.Txn = d.string()
+	r.Args = nil
+	if d.err != nil {
+		return d.err
+	}
+	r.Args, _, err = ddtxn.ReadValue(d.b)
+	return err
+}
+
+// A result that can't be encoded is sent as an error instead.
+func WriteResponse(w *bufio.Writer, r *Response) error {
+	b := make([]byte, 4, 64)
+	b = binary.LittleEndian.AppendUint64(b, r.ID)
+	code := codeOther
+	for i, e := range codes {
+		if r.Err == e {
+			code = i
+			break
+		}
+	}
+	b = append(b, byte(code))
+	if code == codeOther {
+		return writeFrame(w, appendString(b, r.Err.Error()))
+	}
+	if r.R == nil {
+		return writeFrame(w, append(b, 0))
+	}
+	x, err := ddtxn.AppendValue(append(b, 1), r.R.V)
+	if err != nil {
+		return WriteResponse(w, &Response{ID: r.ID, Err: err})
+	}
+	return writeFrame(w, x)
+}
+
+func ReadResponse(rd *bufio.Reader, r *Response) error {
+	b, err := readFrame(rd)
+	if err != nil {
+		return err
+	}
+	d := decoder{b: b}
+	r.ID = d.uint64()
+	code := int(d.byte())
+	r.Err = nil
+	r.R = nil
+	if code == codeOther {
+		r.Err = errors.New(d.string())
+		return d.err
+	}
+	if code >= len(codes) {
+		return EFRAME
+	}
+	r.Err = codes[code]
+	if d.byte() == 1 && d.err == nil {
+		v, _, err := ddtxn.ReadValue(d.b)
+		if err != nil {
+			return err
+		}
+		r.R = &ddtxn.Result{V: v}
+	}
+	return d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// b has 4 bytes reserved at the front for the length.
+func writeFrame(w *bufio.Writer, b []byte) error {
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := w.Write(b)
+	return err
+}
+
+func readFrame(rd *bufio.Reader) ([]byte, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(rd, h[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(h[:])
+	if n > MAX_FRAME {
+		return nil, EFRAME
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reads fields off the front of b; the first short read sets err and
+// everything after returns zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) need(n int) bool {
+	if d.err == nil && len(d.b) < n {
+		d.err = EFRAME
+	}
+	return d.err == nil
+}
+
+func (d *decoder) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+	x := d.b[0]
+	d.b = d.b[1:]
+	return x
+}
+
+func (d *decoder) uint64() uint64 {
+	if !d.need(8) {
+		return 0
+	}
+	x := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return x
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = EFRAME
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.need(len(d.b) + 1)
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
@@ -3,7 +3,6 @@ package ddtxn
 import (
 	"flag"
 	"log"
-	"runtime/debug"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -34,8 +33,8 @@ const (
 //	TIMES = 10000000
 )
 
+// Handles of the built-in transactions; see registry.go.
 const (
-	// Transactions
 	D_BUY = iota
 	D_BUY_AND_READ
 	D_READ_ONE
@@ -58,10 +57,11 @@ const (
 
 	BIG_INCR
 	BIG_RW
-	LAST_TXN
+)
 
-	// Stats
-	NABORTS
+// Stats
+const (
+	NABORTS = iota
 	NENOKEY
 	NSTASHED
 	NENORETRY
@@ -73,6 +73,7 @@ const (
 	NLOCKED
 	NDIDSTASHED
 	NREADABORTS
+	NLOCKTIMEOUT
 	LAST_STAT
 )
 
@@ -88,12 +89,17 @@ type Worker struct {
 	done        chan bool
 	waiters     *TStore
 	E           ETransaction
-	txns        []TransactionFunc
+	snap        *STransaction
+	txns        []TxnInfo
+	rlog        *RedoLog
+	logErr      error           // why the last Commit() couldn't log its writes
+	rotate      *sync.WaitGroup // start a new log segment at the next epoch
 
 	ld *gotomic.LocalData
 
 	// Stats
 	Nstats       []int64
+	Txnstats     []TxnStats // by transaction handle
 	Nwait        time.Duration
 	Nmerge       time.Duration
 	Nmergewait   time.Duration
@@ -102,20 +108,13 @@ type Worker struct {
 	Nnoticed     time.Duration
 	NKeyAccesses []int64
 	tickle       chan TID
+	readat       uint64 // oldest TID+1 read with ReadAt() right now, or 0
 
 	// Rubis junk
 	LastKey      []int
 	CurrKey      []int
 	PreAllocated bool
 	start        int
-
-	// Tracking latency
-	times   [4][TIMES]int64
-	tooLong [4]int64
-}
-
-func (w *Worker) Register(fn int, transaction TransactionFunc) {
-	w.txns[fn] = transaction
 }
 
 func NewWorker(id int, s *Store, c *Coordinator) *Worker {
@@ -127,42 +126,34 @@ func NewWorker(id int, s *Store, c *Coordinator) *Worker {
 		Nstats:       make([]int64, LAST_STAT),
 		epoch:        TID(c.epochTID),
 		done:         make(chan bool),
-		txns:         make([]TransactionFunc, LAST_TXN),
+		txns:         registeredTxns(),
 		tickle:       make(chan TID),
 		PreAllocated: false,
 		ld:           gotomic.InitLocalData(),
 	}
+	w.Txnstats = make([]TxnStats, len(w.txns))
+	if s.recoveredTID != 0 {
+		w.resetTID(uint64(s.recoveredTID))
+	}
 	if *SysType == DOPPEL {
 		w.waiters = TSInit(START_SIZE)
 	} else {
 		w.waiters = TSInit(1)
 	}
+	if *LogDir != "" {
+		var err error
+		w.rlog, err = OpenRedoLog(*LogDir, id)
+		if err != nil {
+			log.Fatalf("%v Could not open redo log in %v: %v\n", id, *LogDir, err)
+		}
+	}
 	if *SysType == LOCKING {
 		w.E = StartLTransaction(w)
 	} else {
 		w.E = StartOTransaction(w)
 	}
 	w.E.SetPhase(SPLIT)
-	w.Register(D_BUY, BuyTxn)
-	w.Register(D_BUY_AND_READ, BuyAndReadTxn)
-	w.Register(D_READ_ONE, ReadOneTxn)
-	w.Register(D_READ_TWO, ReadTxn)
-	w.Register(D_INCR_ONE, IncrTxn)
-	w.Register(D_ATOMIC_INCR_ONE, AtomicIncr)
-	w.Register(RUBIS_BID, StoreBidTxn)
-	w.Register(RUBIS_VIEWBIDHIST, ViewBidHistoryTxn)
-	w.Register(RUBIS_BUYNOW, StoreBuyNowTxn)
-	w.Register(RUBIS_COMMENT, StoreCommentTxn)
-	w.Register(RUBIS_NEWITEM, NewItemTxn)
-	w.Register(RUBIS_PUTBID, PutBidTxn)
-	w.Register(RUBIS_PUTCOMMENT, PutCommentTxn)
-	w.Register(RUBIS_REGISTER, RegisterUserTxn)
-	w.Register(RUBIS_SEARCHCAT, SearchItemsCategTxn)
-	w.Register(RUBIS_SEARCHREG, SearchItemsRegionTxn)
-	w.Register(RUBIS_VIEW, ViewItemTxn)
-	w.Register(RUBIS_VIEWUSER, ViewUserInfoTxn)
-	w.Register(BIG_INCR, BigIncrTxn)
-	w.Register(BIG_RW, BigRWTxn)
+	w.snap = StartSTransaction(w)
 	go w.run()
 	return w
 }
@@ -173,86 +164,101 @@ func (w *Worker) stashTxn(t Query) {
 	}
 }
 
+// What to run t with.
+func (w *Worker) tx(t Query) ETransaction {
+	if w.txns[t.TXN].Snapshot {
+		return w.snap
+	}
+	return w.E
+}
+
 func (w *Worker) doTxn(t Query) (*Result, error) {
-	if t.TXN >= LAST_TXN {
-		debug.PrintStack()
-		log.Fatalf("Unknown transaction number %v\n", t.TXN)
+	if t.TXN < 0 || t.TXN >= len(w.txns) {
+		return nil, EUNKNOWNTXN
+	}
+	ts := &w.Txnstats[t.TXN]
+	tx := w.tx(t)
+	tx.Reset()
+	w.logErr = nil
+	x, err := w.txns[t.TXN].Fn(t, tx)
+	w.doneReadAt()
+	if err == EABORT && w.logErr != nil {
+		err = w.logErr
+	}
+	if err != nil {
+		// In case the transaction returned without releasing its
+		// locks
+		tx.Abort()
 	}
-	w.E.Reset()
-	x, err := w.txns[t.TXN](t, w.E)
 	if err == ESTASH {
 		if w.E.GetPhase() != SPLIT {
 			log.Fatalf("Cannot stash a transaction outside of split phase")
 		}
 		w.Nstats[NSTASHED]++
+		ts.Stashed++
 		w.stashTxn(t)
 		return nil, err
 	} else if err == nil {
-		w.Nstats[t.TXN]++
+		ts.Commits++
 		if *Latency {
-			x := time.Since(t.S)
-			if t.TXN < 4 {
-				y := x.Nanoseconds() / 1000 // microseconds
-				if y >= TIMES {
-					w.tooLong[t.TXN]++
-				} else {
-					w.times[t.TXN][y]++
-				}
-			}
+			ts.latency(t.S, true)
 		}
 	} else if err == EABORT {
 		if *Latency {
-			if t.TXN == D_READ_TWO {
+			if w.txns[t.TXN].ReadOnly {
 				w.Nstats[NREADABORTS]++
 			}
-			x := time.Since(t.S)
-			if t.TXN < 4 {
-				y := x.Nanoseconds() / 1000 // microseconds
-				if y >= TIMES {
-					w.tooLong[t.TXN]++
-				}
-			}
+			ts.latency(t.S, false)
 		}
 		w.Nstats[NABORTS]++
+		ts.Aborts++
 	} else if err == ENOKEY {
 		w.Nstats[NENOKEY]++
-	} else if err == ENORETRY {
+		ts.NoKey++
+	} else if err == ENORETRY || err == EUNIQUE {
 		w.Nstats[NENORETRY]++
+		ts.NoRetry++
 	}
 	return x, err
 }
 
 func (w *Worker) doTxn2(t Query) (*Result, error) {
-	if t.TXN >= LAST_TXN {
-		debug.PrintStack()
-		log.Fatalf("Unknown transaction number %v\n", t.TXN)
+	if t.TXN < 0 || t.TXN >= len(w.txns) {
+		return nil, EUNKNOWNTXN
+	}
+	ts := &w.Txnstats[t.TXN]
+	tx := w.tx(t)
+	tx.Reset()
+	w.logErr = nil
+	x, err := w.txns[t.TXN].Fn(t, tx)
+	w.doneReadAt()
+	if err == EABORT && w.logErr != nil {
+		err = w.logErr
+	}
+	if err != nil {
+		// In case the transaction returned without releasing its
+		// locks
+		tx.Abort()
 	}
-	w.E.Reset()
-	x, err := w.txns[t.TXN](t, w.E)
 	if err == ESTASH {
 		log.Fatalf("Should not be in stashing stage right now\n")
 	} else if err == nil {
-		w.Nstats[t.TXN]++
+		ts.Commits++
 		if *Latency {
-			x := time.Since(t.S)
-			if t.TXN < 4 {
-				y := x.Nanoseconds() / 1000
-				if y >= TIMES {
-					w.tooLong[t.TXN]++
-				} else {
-					w.times[t.TXN][y]++
-				}
-			}
+			ts.latency(t.S, true)
 		}
 	} else if err == EABORT {
-		if *Latency && t.TXN == D_READ_TWO {
+		if *Latency && w.txns[t.TXN].ReadOnly {
 			w.Nstats[NREADABORTS]++
 		}
 		w.Nstats[NABORTS]++
+		ts.Aborts++
 	} else if err == ENOKEY {
 		w.Nstats[NENOKEY]++
-	} else if err == ENORETRY {
+		ts.NoKey++
+	} else if err == ENORETRY || err == EUNIQUE {
 		w.Nstats[NENORETRY]++
+		ts.NoRetry++
 	}
 	return x, err
 }
@@ -272,6 +278,10 @@ func (w *Worker) joinPhase() {
 			} else {
 				committed = true
 				if w.waiters.t[i].W != nil {
+					if err == nil && w.rlog != nil && GroupCommit() {
+						w.rlog.Pend(w.waiters.t[i].W, r)
+						continue
+					}
 					w.waiters.t[i].W <- struct {
 						R *Result
 						E error
@@ -279,10 +289,26 @@ func (w *Worker) joinPhase() {
 				}
 			}
 		}
+		if !committed && w.waiters.t[i].W != nil {
+			// Gave up; don't leave whoever sent it waiting
+			w.waiters.t[i].W <- struct {
+				R *Result
+				E error
+			}{nil, EABORT}
+		}
 	}
 	w.waiters.clear()
 }
 
+// The running transaction's write to k couldn't be logged, so it has
+// to abort.  Retrying won't help, so doTxn() returns err instead of
+// EABORT.
+func (w *Worker) logFailed(k Key, err error) error {
+	dlog.Printf("%v Could not log write to %v: %v\n", w.ID, k, err)
+	w.logErr = err
+	return err
+}
+
 func (w *Worker) transition() {
 	if *SysType == DOPPEL {
 		w.Lock()
@@ -327,8 +353,40 @@ func (w *Worker) transition() {
 		//dlog.Printf("%v %v Coordinator says %v done, moving to split; waited %v\n", time.Now().UnixNano(), w.ID, e, tt)
 		end := time.Since(start)
 		w.Nwait += end
-		w.epoch = e
+		w.setEpoch(e)
+	}
+}
+
+// Move to epoch e.  With group commit, everything logged in earlier
+// epochs goes to the logger.  Must hold the write lock.
+func (w *Worker) setEpoch(e TID) {
+	if e <= w.epoch {
+		return
+	}
+	if w.rlog != nil {
+		var b *logBatch
+		if GroupCommit() {
+			b = w.rlog.Roll(w.epoch, e)
+		}
+		if w.rotate != nil {
+			if err := w.rlog.Rotate(e, b); err != nil {
+				log.Fatalf("%v Could not start new log segment: %v\n", w.ID, err)
+			}
+			w.rotate.Done()
+			w.rotate = nil
+		}
+		if b != nil {
+			w.coordinator.logger.batches <- b
+		}
 	}
+	atomic.StoreUint64((*uint64)(&w.epoch), uint64(e))
+}
+
+// The epoch to commit in.  The coordinator moves it every phase, so
+// it's loaded atomically for transactions not run by One(), like
+// tests'.
+func (w *Worker) commitEpoch() TID {
+	return TID(atomic.LoadUint64((*uint64)(&w.epoch)))
 }
 
 // Periodically check if the epoch changed.  This is important because
@@ -353,6 +411,12 @@ func (w *Worker) run() {
 				} else {
 					w.RUnlock()
 				}
+			} else if GroupCommit() {
+				// Don't hold up the durable epoch if no one is
+				// calling One().
+				w.Lock()
+				w.setEpoch(w.coordinator.GetEpoch())
+				w.Unlock()
 			}
 		case <-w.tickle:
 			if *SysType == DOPPEL {
@@ -362,21 +426,55 @@ func (w *Worker) run() {
 	}
 }
 
+// Run one transaction.  With group commit, a client that passes t.W
+// gets EPENDING back and its result on t.W once the transaction's
+// epoch is durable.
 func (w *Worker) One(t Query) (*Result, error) {
 	w.RLock()
-	if *SysType == DOPPEL {
-		e := w.coordinator.GetEpoch()
-		if w.epoch != e {
+	e := w.coordinator.GetEpoch()
+	if w.epoch != e {
+		if *SysType == DOPPEL {
 			w.RUnlock()
 			w.tickle <- e
 			w.RLock()
+		} else {
+			w.RUnlock()
+			w.Lock()
+			w.setEpoch(e)
+			w.Unlock()
+			w.RLock()
 		}
 	}
 	r, err := w.doTxn(t)
+	if err == nil && t.W != nil && w.rlog != nil && GroupCommit() {
+		w.rlog.Pend(t.W, r)
+		r, err = nil, EPENDING
+	}
 	w.RUnlock()
 	return r, err
 }
 
+// Hand the last epoch to the group logger.
+func (w *Worker) finishLog() {
+	w.Lock()
+	defer w.Unlock()
+	if w.rlog != nil && GroupCommit() {
+		w.coordinator.logger.batches <- w.rlog.Roll(w.epoch, w.epoch+EPOCH_INCR)
+	}
+}
+
+func (w *Worker) closeLog() {
+	w.Lock()
+	defer w.Unlock()
+	if w.rlog == nil {
+		return
+	}
+	if err := w.rlog.Close(); err != nil {
+		log.Fatalf("%v Could not close redo log: %v\n", w.ID, err)
+	}
+	w.rlog = nil
+}
+
 func (w *Worker) Finished() {
 	dlog.Printf("%v FINISHED (e=%v)\n", w.ID, w.epoch)
 	w.coordinator.Finished[w.ID] = true
@@ -392,8 +490,6 @@ func (w *Worker) PreallocateRubis(nx, nb, start int) {
 
 		k := UserKey(uint64(x))
 		w.store.CreateKey(k, &User{}, WRITE)
-		k = NicknameKey(uint64(x))
-		w.store.CreateKey(k, uint64(0), WRITE)
 		k = RatingKey(uint64(x))
 		w.store.CreateKey(k, int32(0), SUM)
 
@@ -473,7 +569,7 @@ func (w *Worker) nextTID() TID {
 }
 
 func (w *Worker) commitTID() TID {
-	return w.nextTID() | w.epoch
+	return w.nextTID() | w.commitEpoch()
 }
 
 func (w *Worker) Store() *Store {